@@ -0,0 +1,156 @@
+package netflow
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+)
+
+// AccountingMode decide which length of packet is counted.
+type AccountingMode string
+
+const (
+	// AccountL3 count the total length in ip header, it's the default.
+	AccountL3 AccountingMode = "l3"
+	// AccountL2 count the frame length on the wire, include ethernet/vlan/pppoe headers.
+	AccountL2 AccountingMode = "l2"
+	// AccountL1 count the frame with fcs, padding, preamble and inter-frame gap.
+	AccountL1 AccountingMode = "l1"
+)
+
+const (
+	ethMinFrameLen = 60 // without fcs
+	ethFCSLen      = 4
+	ethPreambleLen = 8 // preamble + start frame delimiter
+	ethIFGLen      = 12
+)
+
+var (
+	errInvalidAccountingMode = errors.New("invalid accounting mode")
+)
+
+// WithAccountingMode set the layer of counted bytes, it's applied to process, service, device and flow stats.
+func WithAccountingMode(mode AccountingMode) optionFunc {
+	return func(o *Netflow) error {
+		switch mode {
+		case AccountL3, AccountL2, AccountL1:
+		default:
+			return errInvalidAccountingMode
+		}
+
+		o.accounting = mode
+		return nil
+	}
+}
+
+// packetLength return the counted length by mode, ipLen is the l3 length, wireLen
+// is the original length of frame reported by pcap.
+func packetLength(mode AccountingMode, ipLen int64, wireLen int) int64 {
+	switch mode {
+	case AccountL2:
+		return int64(wireLen)
+	case AccountL1:
+		frame := wireLen
+		if frame < ethMinFrameLen {
+			frame = ethMinFrameLen
+		}
+		return int64(frame + ethFCSLen + ethPreambleLen + ethIFGLen)
+	}
+	return ipLen
+}
+
+// DeviceStats is the traffic of a capture device, packets dropped by sampling are counted.
+type DeviceStats struct {
+	Name       string         `json:"name"`
+	Mode       AccountingMode `json:"mode"`
+	In         int64          `json:"in"`
+	Out        int64          `json:"out"`
+	InPackets  int64          `json:"in_packets"`
+	OutPackets int64          `json:"out_packets"`
+	Ignored    int64          `json:"ignored"` // packets can't be decoded
+
+	// routed by this host, neither end is local.
+	Forwarded        int64 `json:"forwarded"`
+	ForwardedPackets int64 `json:"forwarded_packets"`
+}
+
+// deviceCounter is updated by the capture goroutine of device.
+type deviceCounter struct {
+	name string
+
+	// atomic
+	in         int64
+	out        int64
+	inPackets  int64
+	outPackets int64
+	ignored    int64
+	forwarded  int64
+	fwdPackets int64
+
+	// traffic history of in and out.
+	series *trafficSeries
+}
+
+func newDeviceCounter(name string) *deviceCounter {
+	return &deviceCounter{name: name, series: newTrafficSeries(defaultRetention)}
+}
+
+func (dc *deviceCounter) increase(length int64, side sideOption) {
+	if dc == nil {
+		return
+	}
+
+	switch side {
+	case inputSide:
+		atomic.AddInt64(&dc.in, length)
+		atomic.AddInt64(&dc.inPackets, 1)
+		dc.series.increase(length, side)
+		dc.series.increasePackets(1, side)
+	case outputSide:
+		atomic.AddInt64(&dc.out, length)
+		atomic.AddInt64(&dc.outPackets, 1)
+		dc.series.increase(length, side)
+		dc.series.increasePackets(1, side)
+	case forwardSide:
+		atomic.AddInt64(&dc.forwarded, length)
+		atomic.AddInt64(&dc.fwdPackets, 1)
+	}
+}
+
+func (dc *deviceCounter) ignore() {
+	if dc == nil {
+		return
+	}
+	atomic.AddInt64(&dc.ignored, 1)
+}
+
+func (dc *deviceCounter) stats(mode AccountingMode) DeviceStats {
+	return DeviceStats{
+		Name:       dc.name,
+		Mode:       mode,
+		In:         atomic.LoadInt64(&dc.in),
+		Out:        atomic.LoadInt64(&dc.out),
+		InPackets:  atomic.LoadInt64(&dc.inPackets),
+		OutPackets: atomic.LoadInt64(&dc.outPackets),
+		Ignored:    atomic.LoadInt64(&dc.ignored),
+
+		Forwarded:        atomic.LoadInt64(&dc.forwarded),
+		ForwardedPackets: atomic.LoadInt64(&dc.fwdPackets),
+	}
+}
+
+// GetDeviceStats return the total traffic of capture devices, sorted by name.
+func (nf *Netflow) GetDeviceStats() []DeviceStats {
+	nf.deviceLock.Lock()
+	defer nf.deviceLock.Unlock()
+
+	res := make([]DeviceStats, 0, len(nf.devices))
+	for _, dc := range nf.devices {
+		res = append(res, dc.stats(nf.accounting))
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
@@ -0,0 +1,62 @@
+package netflow
+
+import (
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacketLength(t *testing.T) {
+	assert.EqualValues(t, 1440, packetLength(AccountL3, 1440, 1458))
+	assert.EqualValues(t, 1458, packetLength(AccountL2, 1440, 1458))
+	assert.EqualValues(t, 1458+4+8+12, packetLength(AccountL1, 1440, 1458))
+
+	// short frames are padded to the minimum size on the wire.
+	assert.EqualValues(t, 60+4+8+12, packetLength(AccountL1, 40, 54))
+
+	nf := &Netflow{}
+	assert.Nil(t, WithAccountingMode(AccountL1)(nf))
+	assert.Equal(t, AccountL1, nf.accounting)
+	assert.Equal(t, errInvalidAccountingMode, WithAccountingMode("l4")(nf))
+}
+
+func TestDeviceAccounting(t *testing.T) {
+	data := buildTestFrame(t, 1400,
+		&layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeIPv4},
+		testIPv4(layers.IPProtocolTCP),
+		testTCP(),
+	)
+	wireLen := len(data)
+	assert.Equal(t, 14+4+20+20+1400, wireLen)
+
+	var (
+		counter = newDeviceCounter("eth0")
+		d       = newPacketDecoder(layers.LinkTypeEthernet)
+		meta    packetMeta
+		nf      = &Netflow{
+			bindAddrs: parseBindAddrs(map[string]nullObject{"10.0.0.1": {}}),
+			devices:   map[string]*deviceCounter{"eth0": counter},
+		}
+	)
+
+	// the captured data is cut by snaplen, l2 still counts the whole frame.
+	nf.accounting = AccountL2
+	assert.True(t, nf.handlePacket(d, data[:defaultSnapLen], wireLen, &meta, counter))
+	assert.EqualValues(t, wireLen, meta.length)
+
+	nf.accounting = AccountL1
+	assert.True(t, nf.handlePacket(d, data[:defaultSnapLen], wireLen, &meta, counter))
+	assert.EqualValues(t, wireLen+24, meta.length)
+
+	assert.False(t, nf.handlePacket(d, []byte{0x01}, 1, &meta, counter))
+
+	stats := nf.GetDeviceStats()
+	assert.Equal(t, 1, len(stats))
+	assert.Equal(t, "eth0", stats[0].Name)
+	assert.Equal(t, AccountL1, stats[0].Mode)
+	assert.EqualValues(t, 2*wireLen+24, stats[0].Out)
+	assert.EqualValues(t, 2, stats[0].OutPackets)
+	assert.EqualValues(t, 1, stats[0].Ignored)
+}
@@ -0,0 +1,160 @@
+package netflow
+
+import (
+	"errors"
+	"sort"
+)
+
+// GroupKind decide how processes are folded together in GetGroupRank.
+type GroupKind string
+
+const (
+	GroupByProcess   GroupKind = "process"
+	GroupByContainer GroupKind = "container"
+	GroupByPod       GroupKind = "pod"
+	GroupByUnit      GroupKind = "unit"
+
+	// rollup modes of service, children are folded into the ancestor.
+	GroupByParent GroupKind = "parent"
+	GroupByPgid   GroupKind = "pgid"
+	GroupByExe    GroupKind = "exe"
+	GroupByName   GroupKind = "name"
+)
+
+var (
+	errInvalidGroupKind = errors.New("invalid group kind")
+)
+
+// ProcessGroup is the sum of traffic of processes sharing the same group key.
+type ProcessGroup struct {
+	Kind         GroupKind          `json:"kind"`
+	Key          string             `json:"key"`
+	Name         string             `json:"name,omitempty"`
+	Exe          string             `json:"exe,omitempty"`
+	Runtime      string             `json:"runtime,omitempty"`
+	Pids         []string           `json:"pids"`
+	InodeCount   int                `json:"inode_count"`
+	Connections  map[string]int     `json:"connections"`
+	TrafficStats *trafficStatsEntry `json:"traffic_stats"`
+}
+
+// groupKey return the key of process for the kind, empty means the process
+// doesn't belong to any group of the kind, eg: a host process has no container.
+func groupKey(po *Process, kind GroupKind, tree *processTree) string {
+	switch kind {
+	case GroupByProcess:
+		return po.Pid
+	case GroupByContainer:
+		return po.ContainerID
+	case GroupByPod:
+		return po.PodUID
+	case GroupByUnit:
+		return po.Unit
+	case GroupByParent:
+		return tree.serviceRoot(po.Pid)
+	case GroupByPgid:
+		return po.Pgid
+	case GroupByExe:
+		return po.Exe
+	case GroupByName:
+		return po.Name
+	}
+	return ""
+}
+
+func isValidGroupKind(kind GroupKind) bool {
+	switch kind {
+	case GroupByProcess, GroupByContainer, GroupByPod, GroupByUnit,
+		GroupByParent, GroupByPgid, GroupByExe, GroupByName:
+		return true
+	}
+	return false
+}
+
+// groupProcesses fold processes by kind, the stats of processes must be analysed before.
+func groupProcesses(pos []*Process, kind GroupKind) []*ProcessGroup {
+	var (
+		dict   = make(map[string]*ProcessGroup, len(pos))
+		groups = make(sortedGroups, 0, len(pos))
+		tree   *processTree
+	)
+
+	if kind == GroupByParent {
+		tree = newProcessTree(pos)
+	}
+
+	for _, po := range pos {
+		key := groupKey(po, kind, tree)
+		if key == "" {
+			continue
+		}
+
+		group, ok := dict[key]
+		if !ok {
+			group = &ProcessGroup{
+				Kind:         kind,
+				Key:          key,
+				TrafficStats: new(trafficStatsEntry),
+			}
+			switch kind {
+			case GroupByContainer:
+				group.Runtime = po.Runtime
+			case GroupByProcess, GroupByParent, GroupByExe, GroupByName:
+				group.Name = po.Name
+				group.Exe = po.Exe
+			}
+
+			dict[key] = group
+			groups = append(groups, group)
+		}
+
+		group.Pids = append(group.Pids, po.Pid)
+		group.InodeCount += po.InodeCount
+		for state, n := range po.Connections {
+			if group.Connections == nil {
+				group.Connections = make(map[string]int)
+			}
+			group.Connections[state] += n
+		}
+		if po.TrafficStats == nil {
+			continue
+		}
+
+		group.TrafficStats.In += po.TrafficStats.In
+		group.TrafficStats.Out += po.TrafficStats.Out
+		group.TrafficStats.InRate += po.TrafficStats.InRate
+		group.TrafficStats.OutRate += po.TrafficStats.OutRate
+		group.TrafficStats.OuterIn += po.TrafficStats.OuterIn
+		group.TrafficStats.OuterOut += po.TrafficStats.OuterOut
+		group.TrafficStats.InPackets += po.TrafficStats.InPackets
+		group.TrafficStats.OutPackets += po.TrafficStats.OutPackets
+		group.TrafficStats.InPacketRate += po.TrafficStats.InPacketRate
+		group.TrafficStats.OutPacketRate += po.TrafficStats.OutPacketRate
+		group.TrafficStats.NewConnsIn += po.TrafficStats.NewConnsIn
+		group.TrafficStats.NewConnsOut += po.TrafficStats.NewConnsOut
+		group.TrafficStats.NewSockets += po.TrafficStats.NewSockets
+		group.TrafficStats.NewConnRate += po.TrafficStats.NewConnRate
+		group.TrafficStats.TCP.add(&po.TrafficStats.TCP)
+		group.TrafficStats.Backlog.add(&po.TrafficStats.Backlog)
+		group.TrafficStats.addRates(po.TrafficStats)
+	}
+
+	sort.Sort(groups)
+	return groups
+}
+
+type sortedGroups []*ProcessGroup
+
+func (s sortedGroups) Len() int {
+	return len(s)
+}
+
+func (s sortedGroups) Less(i, j int) bool {
+	val1 := s[i].TrafficStats.In + s[i].TrafficStats.Out
+	val2 := s[j].TrafficStats.In + s[j].TrafficStats.Out
+	return val1 > val2
+}
+
+func (s sortedGroups) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
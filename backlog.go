@@ -0,0 +1,216 @@
+package netflow
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// the send queue is growing after it grows in the rescans without being drained.
+	minGrowingScans = 3
+)
+
+// BacklogStats is the bytes in the socket queues of process in the window,
+// the queues are summed by every rescan of socket tables, the max is of the
+// buckets, eg: the average of a minute for long windows.
+type BacklogStats struct {
+	TxQueue    int64 `json:"tx_queue"`
+	RxQueue    int64 `json:"rx_queue"`
+	TxQueueMax int64 `json:"tx_queue_max"`
+	RxQueueMax int64 `json:"rx_queue_max"`
+}
+
+// backlogCounter fold the buckets into the stats.
+type backlogCounter struct {
+	tx, rx       int64
+	txMax, rxMax int64
+	scans        int64
+}
+
+func (c *backlogCounter) add(ent *trafficEntry) {
+	if ent.queueScans == 0 {
+		return
+	}
+
+	c.tx += ent.TxQueue * ent.queueScans
+	c.rx += ent.RxQueue * ent.queueScans
+	c.scans += ent.queueScans
+	if ent.TxQueue > c.txMax {
+		c.txMax = ent.TxQueue
+	}
+	if ent.RxQueue > c.rxMax {
+		c.rxMax = ent.RxQueue
+	}
+}
+
+func (c *backlogCounter) stats() BacklogStats {
+	res := BacklogStats{TxQueueMax: c.txMax, RxQueueMax: c.rxMax}
+	if c.scans > 0 {
+		res.TxQueue = c.tx / c.scans
+		res.RxQueue = c.rx / c.scans
+	}
+	return res
+}
+
+// add fold the backlog of other process, it's used by groups.
+func (s *BacklogStats) add(other *BacklogStats) {
+	s.TxQueue += other.TxQueue
+	s.RxQueue += other.RxQueue
+	s.TxQueueMax += other.TxQueueMax
+	s.RxQueueMax += other.RxQueueMax
+}
+
+// SocketBacklog is a socket whose send queue keeps growing, the peer or the
+// network can't drain it, eg: a slow client or a congested link.
+type SocketBacklog struct {
+	Local   string `json:"local"`
+	Remote  string `json:"remote"`
+	State   string `json:"state"`
+	Inode   string `json:"inode"`
+	Netns   string `json:"netns"`
+	Pid     string `json:"pid"`
+	Name    string `json:"name"`
+	TxQueue int64  `json:"tx_queue"`
+	RxQueue int64  `json:"rx_queue"`
+
+	// bytes grown since the send queue started growing at Since, in Scans rescans.
+	Growth int64 `json:"growth"`
+	Since  int64 `json:"since"`
+	Scans  int   `json:"scans"`
+
+	Timer       string        `json:"timer"`
+	Retransmits int64         `json:"retransmits"`
+	Rto         time.Duration `json:"rto"`
+	Cwnd        int64         `json:"cwnd"`
+}
+
+// queueKey is the socket of send queue, orphaned sockets have no inode, eg:
+// FIN_WAIT1 after close(), so it's the tuple in the namespace.
+type queueKey struct {
+	netns string
+	key   flowKey
+}
+
+type queueTrend struct {
+	conn  *ConnectionItem // of the latest rescan
+	first int64           // tx queue when it started growing
+	since int64
+	scans int
+	seen  uint64
+}
+
+// sendQueueTable track the send queues of sockets between rescans, only the
+// sockets with bytes in the send queue are kept.
+type sendQueueTable struct {
+	sync.Mutex
+
+	dict map[queueKey]*queueTrend
+	scan uint64
+}
+
+func newSendQueueTable() *sendQueueTable {
+	return &sendQueueTable{
+		dict: make(map[queueKey]*queueTrend),
+	}
+}
+
+func (t *sendQueueTable) begin() {
+	t.Lock()
+	defer t.Unlock()
+
+	t.scan++
+}
+
+// observe compare the send queue of socket with the last rescan, the growth
+// is reset when the queue is drained a bit.
+func (t *sendQueueTable) observe(now int64, conn *ConnectionItem) {
+	t.Lock()
+	defer t.Unlock()
+
+	key := queueKey{netns: conn.Netns, key: conn.key}
+	if conn.TxQueue == 0 {
+		delete(t.dict, key)
+		return
+	}
+
+	ent, ok := t.dict[key]
+	switch {
+	case !ok:
+		ent = &queueTrend{first: conn.TxQueue, since: now}
+		t.dict[key] = ent
+
+	case conn.TxQueue > ent.conn.TxQueue:
+		ent.scans++
+
+	case conn.TxQueue < ent.conn.TxQueue:
+		ent.first, ent.since, ent.scans = conn.TxQueue, now, 0
+	}
+	ent.conn, ent.seen = conn, t.scan
+}
+
+// end remove the sockets gone from the socket tables, the sockets of skipped
+// namespaces are kept.
+func (t *sendQueueTable) end(skipped map[string]bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	for key, ent := range t.dict {
+		if ent.seen != t.scan && !skipped[key.netns] {
+			delete(t.dict, key)
+		}
+	}
+}
+
+// growing return the sockets whose send queue grows in minGrowingScans rescans
+// without being drained, the largest queue goes first.
+func (t *sendQueueTable) growing(pm *processController, limit int) []*SocketBacklog {
+	t.Lock()
+	res := make([]*SocketBacklog, 0, 16)
+	for _, ent := range t.dict {
+		if ent.scans < minGrowingScans {
+			continue
+		}
+
+		conn := ent.conn
+		res = append(res, &SocketBacklog{
+			Local:       conn.SrcIP + ":" + conn.SrcPort,
+			Remote:      conn.DestIP + ":" + conn.DestPort,
+			State:       conn.State,
+			Inode:       conn.Inode,
+			Netns:       conn.Netns,
+			TxQueue:     conn.TxQueue,
+			RxQueue:     conn.RxQueue,
+			Growth:      conn.TxQueue - ent.first,
+			Since:       ent.since,
+			Scans:       ent.scans,
+			Timer:       timerNames[conn.Timer],
+			Retransmits: conn.Retransmits,
+			Rto:         conn.Rto,
+			Cwnd:        conn.Cwnd,
+		})
+	}
+	t.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].TxQueue == res[j].TxQueue {
+			return res[i].Local+res[i].Remote < res[j].Local+res[j].Remote
+		}
+		return res[i].TxQueue > res[j].TxQueue
+	})
+	if len(res) > limit {
+		res = res[:limit]
+	}
+
+	for _, item := range res {
+		if po := pm.GetProcessByInode(item.Inode); po != nil {
+			item.Pid, item.Name = po.Pid, po.Name
+		}
+	}
+	return res
+}
+
+// GetGrowingSendQueues return the sockets whose send queue keeps growing by rescans.
+func (nf *Netflow) GetGrowingSendQueues(limit int) []*SocketBacklog {
+	return nf.sendQueues.growing(nf.processHash, limit)
+}
@@ -0,0 +1,115 @@
+package netflow
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendQueueTable(t *testing.T) {
+	var (
+		table = newSendQueueTable()
+		pm    = NewProcessController(context.Background())
+		now   = int64(1700000000)
+	)
+	pm.Add("100", &Process{Pid: "100", Name: "nginx"})
+	pm.inodePidMap = map[string]string{"1": "100"}
+
+	scan := func(skipped map[string]bool, conns ...*ConnectionItem) {
+		table.begin()
+		for _, conn := range conns {
+			table.observe(now, conn)
+		}
+		table.end(skipped)
+		now++
+	}
+	conn := func(inode string, tx int64) *ConnectionItem {
+		port, _ := strconv.Atoi(inode)
+		return &ConnectionItem{
+			Inode: inode, Netns: "1", TxQueue: tx,
+			SrcIP: "10.0.0.1", SrcPort: "80", DestIP: "10.0.0.2", DestPort: strconv.Itoa(50000 + port),
+			key: testFlowKey("10.0.0.1", 80, "10.0.0.2", uint16(50000+port)),
+		}
+	}
+
+	// the queue of 1 keeps growing, 2 is drained, 3 is flat.
+	scan(nil, conn("1", 100), conn("2", 100), conn("3", 500))
+	scan(nil, conn("1", 200), conn("2", 300), conn("3", 500))
+	scan(nil, conn("1", 200), conn("2", 50), conn("3", 500))
+	scan(nil, conn("1", 400), conn("2", 60), conn("3", 500))
+	assert.Equal(t, 0, len(table.growing(pm, 10)))
+
+	scan(nil, conn("1", 800), conn("2", 70), conn("3", 500))
+	res := table.growing(pm, 10)
+	assert.Equal(t, 1, len(res))
+	assert.Equal(t, "1", res[0].Inode)
+	assert.Equal(t, "nginx", res[0].Name)
+	assert.EqualValues(t, 700, res[0].Growth)
+	assert.Equal(t, int64(1700000000), res[0].Since)
+	assert.Equal(t, "10.0.0.2:50001", res[0].Remote)
+
+	scan(nil, conn("1", 900), conn("2", 80), conn("3", 500))
+	assert.Equal(t, []string{"1", "2"}, []string{table.growing(pm, 10)[0].Inode, table.growing(pm, 10)[1].Inode})
+	assert.Equal(t, 1, len(table.growing(pm, 1)))
+
+	// orphaned sockets have no inode, they're tracked by the tuple.
+	orphan := func(port uint16, tx int64) *ConnectionItem {
+		return &ConnectionItem{
+			Inode: "0", Netns: "1", TxQueue: tx, State: "FIN_WAIT1",
+			SrcIP: "10.0.0.1", SrcPort: "80", DestIP: "10.0.0.3", DestPort: strconv.Itoa(int(port)),
+			key: testFlowKey("10.0.0.1", 80, "10.0.0.3", port),
+		}
+	}
+	table = newSendQueueTable()
+	for i := int64(1); i <= minGrowingScans+1; i++ {
+		scan(nil, orphan(60000, 100*i), orphan(60001, 1000-100*i))
+	}
+	res = table.growing(pm, 10)
+	assert.Equal(t, 2, len(table.dict))
+	assert.Equal(t, 1, len(res))
+	assert.Equal(t, "10.0.0.3:60000", res[0].Remote)
+	assert.EqualValues(t, 300, res[0].Growth)
+	assert.Equal(t, "", res[0].Pid)
+
+	scan(nil, conn("1", 100), conn("2", 100), conn("3", 500))
+	scan(nil, conn("1", 200), conn("2", 300), conn("3", 500))
+
+	// the sockets of skipped namespaces are kept, closed or drained ones are removed.
+	scan(map[string]bool{"1": true})
+	assert.Equal(t, 3, len(table.dict))
+	scan(nil, conn("1", 0))
+	assert.Equal(t, 0, len(table.dict))
+}
+
+func TestProcessBacklog(t *testing.T) {
+	var (
+		pm  = NewProcessController(context.Background())
+		po  = &Process{Pid: "100", series: newTrafficSeries(defaultRetention)}
+		now = int64(1700000000)
+	)
+	pm.Add("100", po)
+	pm.inodePidMap = map[string]string{"1": "100", "2": "100", "3": "100"}
+
+	for idx, tx := range []int64{100, 300, 200} {
+		conns := newConnCounter(pm, false)
+		conns.add(&ConnectionItem{Inode: "1", State: "ESTABLISHED", TxQueue: tx, RxQueue: 10}, false)
+		conns.add(&ConnectionItem{Inode: "2", State: "ESTABLISHED", TxQueue: tx}, false)
+		conns.add(&ConnectionItem{Inode: "3", State: "LISTEN", TxQueue: 4096, RxQueue: 5}, false)
+		conns.commit(now+int64(idx), nil)
+	}
+
+	stats := po.getSeries().analyseAt(now+2, 5)
+	assert.Equal(t, BacklogStats{TxQueue: 400, RxQueue: 10, TxQueueMax: 600, RxQueueMax: 10}, stats.Backlog)
+
+	// buckets of minutes hold the average of rescans.
+	ents := po.getSeries().historyAt(now+2, now-3600, now+2)
+	assert.EqualValues(t, 400, ents[len(ents)-1].TxQueue)
+	stats = po.getSeries().analyseAt(now+2, 600)
+	assert.EqualValues(t, 400, stats.Backlog.TxQueueMax)
+
+	group := stats.copyStats().Backlog
+	group.add(&stats.Backlog)
+	assert.EqualValues(t, 800, group.TxQueue)
+}
@@ -0,0 +1,173 @@
+package netflow
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+const (
+	// enough for link + ip + tcp headers, bytes are counted by the ip total length.
+	defaultSnapLen     = 128
+	defaultReadTimeout = 500 * time.Millisecond
+)
+
+// captureConfig is the tuning of pcap handler, it's read only after Netflow is created.
+type captureConfig struct {
+	snapLen         int
+	promisc         bool
+	bufferSize      int // bytes of kernel buffer, 0 means the default of libpcap
+	immediate       bool
+	timestampSource string
+	readTimeout     time.Duration
+}
+
+func newCaptureConfig() captureConfig {
+	return captureConfig{
+		snapLen:     defaultSnapLen,
+		readTimeout: defaultReadTimeout,
+	}
+}
+
+// WithSnapLen set the max bytes captured of each packet, the default only captures headers.
+func WithSnapLen(n int) optionFunc {
+	return func(o *Netflow) error {
+		if n < 64 {
+			return errors.New("snaplen must >= 64")
+		}
+
+		o.capture.snapLen = n
+		return nil
+	}
+}
+
+// WithPromisc capture the packets not sent to the host, eg: port mirroring.
+func WithPromisc(promisc bool) optionFunc {
+	return func(o *Netflow) error {
+		o.capture.promisc = promisc
+		return nil
+	}
+}
+
+// WithBufferSize set the kernel buffer size in bytes, a larger buffer reduces drops on bursts.
+func WithBufferSize(size int) optionFunc {
+	return func(o *Netflow) error {
+		if size <= 0 {
+			return errors.New("invalid buffer size")
+		}
+
+		o.capture.bufferSize = size
+		return nil
+	}
+}
+
+// WithImmediateMode deliver packets as soon as they arrive instead of batching them.
+func WithImmediateMode(immediate bool) optionFunc {
+	return func(o *Netflow) error {
+		o.capture.immediate = immediate
+		return nil
+	}
+}
+
+// WithTimestampSource set the timestamp source of pcap, eg: "host", "adapter".
+func WithTimestampSource(source string) optionFunc {
+	return func(o *Netflow) error {
+		if source == "" {
+			return errors.New("invalid timestamp source")
+		}
+
+		o.capture.timestampSource = source
+		return nil
+	}
+}
+
+// WithReadTimeout set the read timeout of pcap, the capture checks ctx after timeout.
+func WithReadTimeout(dur time.Duration) optionFunc {
+	return func(o *Netflow) error {
+		if dur <= 0 {
+			return errors.New("invalid read timeout")
+		}
+
+		o.capture.readTimeout = dur
+		return nil
+	}
+}
+
+// newInactiveHandle apply the capture config before activating the handler.
+func newInactiveHandle(device string, cfg *captureConfig) (*pcap.InactiveHandle, error) {
+	inactive, err := pcap.NewInactiveHandle(device)
+	if err != nil {
+		return nil, err
+	}
+
+	err = configureInactiveHandle(inactive, cfg)
+	if err != nil {
+		inactive.CleanUp()
+		return nil, err
+	}
+	return inactive, nil
+}
+
+func configureInactiveHandle(inactive *pcap.InactiveHandle, cfg *captureConfig) error {
+	if err := inactive.SetSnapLen(cfg.snapLen); err != nil {
+		return err
+	}
+	if err := inactive.SetPromisc(cfg.promisc); err != nil {
+		return err
+	}
+	if err := inactive.SetTimeout(cfg.readTimeout); err != nil {
+		return err
+	}
+	if cfg.bufferSize > 0 {
+		if err := inactive.SetBufferSize(cfg.bufferSize); err != nil {
+			return err
+		}
+	}
+	if cfg.immediate {
+		if err := inactive.SetImmediateMode(true); err != nil {
+			return err
+		}
+	}
+	if cfg.timestampSource != "" {
+		source, err := pcap.TimestampSourceFromString(cfg.timestampSource)
+		if err != nil {
+			return err
+		}
+		if err := inactive.SetTimestampSource(source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// directedHandle is a pcap handler of the capture direction, both directions
+// are delivered when it's pcap.DirectionInOut.
+type directedHandle struct {
+	*pcap.Handle
+	direction pcap.Direction
+}
+
+// openPcapHandlers open a handler for the incoming and the outgoing packets,
+// so the direction is known on any link type, eg: ethernet of lo. one handler
+// of both directions is returned when the direction isn't supported.
+func openPcapHandlers(device string, cfg *captureConfig, filter string) ([]*directedHandle, error) {
+	in, err := buildPcapHandler(device, cfg, filter, pcap.DirectionIn)
+	if err != nil {
+		handler, err := buildPcapHandler(device, cfg, filter, pcap.DirectionInOut)
+		if err != nil {
+			return nil, err
+		}
+		return []*directedHandle{{Handle: handler, direction: pcap.DirectionInOut}}, nil
+	}
+
+	out, err := buildPcapHandler(device, cfg, filter, pcap.DirectionOut)
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	return []*directedHandle{
+		{Handle: in, direction: pcap.DirectionIn},
+		{Handle: out, direction: pcap.DirectionOut},
+	}, nil
+}
@@ -0,0 +1,35 @@
+package netflow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptureOptions(t *testing.T) {
+	nf := &Netflow{capture: newCaptureConfig()}
+	assert.Equal(t, defaultSnapLen, nf.capture.snapLen)
+	assert.Equal(t, defaultReadTimeout, nf.capture.readTimeout)
+
+	assert.Nil(t, WithSnapLen(256)(nf))
+	assert.Nil(t, WithPromisc(true)(nf))
+	assert.Nil(t, WithBufferSize(64<<20)(nf))
+	assert.Nil(t, WithImmediateMode(true)(nf))
+	assert.Nil(t, WithTimestampSource("adapter")(nf))
+	assert.Nil(t, WithReadTimeout(100*time.Millisecond)(nf))
+
+	assert.Equal(t, captureConfig{
+		snapLen:         256,
+		promisc:         true,
+		bufferSize:      64 << 20,
+		immediate:       true,
+		timestampSource: "adapter",
+		readTimeout:     100 * time.Millisecond,
+	}, nf.capture)
+
+	assert.NotNil(t, WithSnapLen(10)(nf))
+	assert.NotNil(t, WithBufferSize(0)(nf))
+	assert.NotNil(t, WithTimestampSource("")(nf))
+	assert.NotNil(t, WithReadTimeout(0)(nf))
+}
@@ -7,9 +7,18 @@ import (
 	log "github.com/sirupsen/logrus"
 	"net/http"
 	_ "net/http/pprof" // 引入 pprof 包
+	"os"
 )
 
 func main() {
+	// netflow report --since 24h
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		if err := report(os.Args[2:]); err != nil {
+			log.Fatal("report failed:", err)
+		}
+		return
+	}
+
 	pname := flag.String("f", "", "choose p")
 	filter := flag.String("p", "", "choose port")
 	configPathPtr := flag.String("config", "/usr/local/super-agent/config.yaml", "super-agent config file path")
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/rfyiamcool/go-netflow"
+	"github.com/rfyiamcool/go-netflow/utils"
+)
+
+// report 汇总存储的流量历史, eg: netflow report --since 24h --kind user
+func report(args []string) error {
+	var (
+		fs    = flag.NewFlagSet("report", flag.ExitOnError)
+		dir   = fs.String("dir", netflow.DefaultStoreDir, "dir of the traffic store")
+		since = fs.Duration("since", 24*time.Hour, "report the traffic since the duration ago")
+		kind  = fs.String("kind", netflow.SampleProcess, "process, device or user")
+		key   = fs.String("key", "", "only report the pid, process name, device or user")
+		limit = fs.Int("limit", 20, "size of rows")
+	)
+	fs.Parse(args)
+
+	store, err := netflow.OpenStore(*dir, 0)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	now := time.Now()
+	samples, err := store.Query(netflow.StoreQuery{
+		Kind:  *kind,
+		Key:   *key,
+		Start: now.Add(-*since).Unix(),
+		End:   now.Unix() + 1,
+	})
+	if err != nil {
+		return err
+	}
+
+	// processes are folded by name, pids are changed after restart.
+	type row struct {
+		name           string
+		in, out        int64
+		packets, conns int64
+	}
+	var (
+		rows  []*row
+		index = make(map[string]*row)
+	)
+	for _, sample := range samples {
+		name := sample.Key
+		if sample.Name != "" {
+			name = sample.Name
+		}
+
+		r, ok := index[name]
+		if !ok {
+			r = &row{name: name}
+			index[name] = r
+			rows = append(rows, r)
+		}
+		r.in += sample.In
+		r.out += sample.Out
+		r.packets += sample.InPackets + sample.OutPackets
+		r.conns += sample.NewConns
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].in+rows[i].out > rows[j].in+rows[j].out
+	})
+	if len(rows) > *limit {
+		rows = rows[:*limit]
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{*kind, "in", "out", "total", "packets", "new_conns"})
+	for _, r := range rows {
+		table.Append([]string{r.name, utils.HumanBytes(r.in), utils.HumanBytes(r.out), utils.HumanBytes(r.in + r.out),
+			strconv.FormatInt(r.packets, 10), strconv.FormatInt(r.conns, 10)})
+	}
+	fmt.Printf("traffic since %s\n", now.Add(-*since).Format("2006-01-02 15:04:05"))
+	table.Render()
+	return nil
+}
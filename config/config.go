@@ -25,6 +25,12 @@ type (
 		FrpcRoot string `json:"frpcroot" yaml:"frpcroot"`
 	}
 
+	// traffic history is persisted when Dir is set.
+	StoreConfig struct {
+		Dir      string `json:"dir" yaml:"dir"`
+		BudgetMB int64  `json:"budgetMB" yaml:"budgetMB"`
+	}
+
 	MonitorConfig struct {
 		CollectdRddPath string `json:"collectdRddPath" yaml:"collectdRddPath"`
 		ReportInterval  int64  `json:"reportInterval" yaml:"reportInterval"`
@@ -37,6 +43,7 @@ type (
 		Agent                AgentConfig   `json:"agent" yaml:"agent"`
 		Pppoe                PppoeConfig   `json:"pppoe" yaml:"pppoe"`
 		MonitorConfig        MonitorConfig `json:"monitor" yaml:"monitor"`
+		Store                StoreConfig   `json:"store" yaml:"store"`
 		MockedServerConfPath string        `json:"mockedServerConfPath" yaml:"mockedServerConfPath"`
 		DeviceIdPath         string        `json:"deviceIdPath" yaml:"deviceIdPath"`
 		Nethogs              string        `json:"nethogs" yaml:"nethogs"`
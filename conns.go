@@ -0,0 +1,102 @@
+package netflow
+
+// connCounter count the tcp sockets of processes during a rescan of socket tables.
+type connCounter struct {
+	pm *processController
+
+	// the first rescan has no previous tables to diff.
+	first bool
+
+	// key -> pid, val -> sockets by state
+	states map[string]map[string]int
+
+	// key -> pid, val -> sockets not seen by the last rescan
+	opened map[string]int64
+
+	// key -> pid, val -> bytes in the send and receive queues
+	queues map[string][2]int64
+}
+
+func newConnCounter(pm *processController, first bool) *connCounter {
+	return &connCounter{
+		pm:     pm,
+		first:  first,
+		states: make(map[string]map[string]int),
+		opened: make(map[string]int64),
+		queues: make(map[string][2]int64),
+	}
+}
+
+// add count the socket into its process, the socket of unknown inode is skipped,
+// eg: TIME_WAIT sockets have no inode.
+func (c *connCounter) add(conn *ConnectionItem, isNew bool) {
+	po := c.pm.GetProcessByInode(conn.Inode)
+	if po == nil {
+		return
+	}
+
+	states, ok := c.states[po.Pid]
+	if !ok {
+		states = make(map[string]int)
+		c.states[po.Pid] = states
+	}
+	states[conn.State]++
+
+	if isNew && !c.first {
+		c.opened[po.Pid]++
+	}
+
+	// the queues of listening sockets are the backlog of accept.
+	if conn.State != StateMapping[ListenSymbol] {
+		queues := c.queues[po.Pid]
+		queues[0] += conn.TxQueue
+		queues[1] += conn.RxQueue
+		c.queues[po.Pid] = queues
+	}
+}
+
+// commit replace the connections of processes, count the new sockets and the
+// queues, the processes of skipped namespaces keep the last counts.
+func (c *connCounter) commit(now int64, skipped map[string]bool) {
+	c.pm.updateConnections(now, c, skipped)
+}
+
+func (pm *processController) updateConnections(now int64, c *connCounter, skipped map[string]bool) {
+	pm.Lock()
+	defer pm.Unlock()
+
+	for pid, po := range pm.dict {
+		if po.Netns != "" && skipped[po.Netns] {
+			continue
+		}
+		po.Connections = c.states[pid]
+		if n := c.opened[pid]; n > 0 {
+			po.getSeries().increaseSocketsAt(now, n)
+		}
+		queues := c.queues[pid]
+		po.getSeries().increaseBacklogAt(now, queues[0], queues[1])
+	}
+}
+
+// activeConnections return the sockets of process except the listening ones.
+func (p *Process) activeConnections() int {
+	var count int
+	for state, n := range p.Connections {
+		if state != StateMapping[ListenSymbol] {
+			count += n
+		}
+	}
+	return count
+}
+
+func copyStates(states map[string]int) map[string]int {
+	if states == nil {
+		return nil
+	}
+
+	res := make(map[string]int, len(states))
+	for state, n := range states {
+		res[state] = n
+	}
+	return res
+}
@@ -0,0 +1,69 @@
+package netflow
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnCounter(t *testing.T) {
+	pm := NewProcessController(context.Background())
+	for _, pid := range []string{"100", "101", "102"} {
+		pm.Add(pid, &Process{Pid: pid, Netns: "1", series: newTrafficSeries(defaultRetention)})
+	}
+	pm.dict["102"].Netns = "2"
+	pm.dict["102"].Connections = map[string]int{"ESTABLISHED": 3}
+	pm.inodePidMap = map[string]string{"1": "100", "2": "100", "3": "100", "4": "101", "5": "102"}
+
+	now := int64(1700000000)
+	conns := newConnCounter(pm, false)
+	conns.add(&ConnectionItem{Inode: "1", State: "LISTEN"}, false)
+	conns.add(&ConnectionItem{Inode: "2", State: "ESTABLISHED"}, true)
+	conns.add(&ConnectionItem{Inode: "3", State: "ESTABLISHED"}, true)
+	conns.add(&ConnectionItem{Inode: "4", State: "CLOSE_WAIT"}, false)
+	conns.add(&ConnectionItem{Inode: "0", State: "TIME_WAIT"}, true)
+	conns.commit(now, map[string]bool{"2": true})
+
+	assert.Equal(t, map[string]int{"LISTEN": 1, "ESTABLISHED": 2}, pm.dict["100"].Connections)
+	assert.Equal(t, 2, pm.dict["100"].activeConnections())
+	assert.Equal(t, 1, pm.dict["101"].activeConnections())
+
+	// the process of skipped namespace keeps the last counts.
+	assert.Equal(t, 3, pm.dict["102"].activeConnections())
+
+	stats := pm.dict["100"].getSeries().analyseAt(now, 10)
+	assert.EqualValues(t, 2, stats.NewSockets)
+	assert.EqualValues(t, 0, pm.dict["101"].getSeries().analyseAt(now, 10).NewSockets)
+
+	// all sockets are new to the first rescan.
+	conns = newConnCounter(pm, true)
+	conns.add(&ConnectionItem{Inode: "4", State: "ESTABLISHED"}, true)
+	conns.commit(now, nil)
+	assert.EqualValues(t, 0, pm.dict["101"].getSeries().analyseAt(now, 10).NewSockets)
+	assert.Nil(t, pm.dict["100"].Connections)
+}
+
+func TestConnRates(t *testing.T) {
+	var (
+		nf   = &Netflow{}
+		proc = &Process{series: newTrafficSeries(defaultRetention)}
+	)
+
+	// the SYN of sampled packets is scaled as the packets.
+	nf.increaseProcessTraffic(proc, &packetMeta{length: 60, packets: 10, side: inputSide, tcp: tcpHeader{flags: tcpSYN}})
+	nf.increaseProcessTraffic(proc, &packetMeta{length: 60, packets: 1, side: outputSide, tcp: tcpHeader{flags: tcpSYN}})
+	nf.increaseProcessTraffic(proc, &packetMeta{length: 1500, packets: 9, side: inputSide})
+
+	stats := proc.getSeries().analyse(2)
+	assert.EqualValues(t, 10, stats.NewConnsIn)
+	assert.EqualValues(t, 1, stats.NewConnsOut)
+	assert.EqualValues(t, 19, stats.InPackets)
+	assert.EqualValues(t, 11/2, stats.NewConnRate)
+
+	// new sockets win when SYNs are missed.
+	stats = &trafficStatsEntry{NewConnsIn: 2, NewSockets: 30, InPackets: 60}
+	stats.setCountRates(10)
+	assert.EqualValues(t, 3, stats.NewConnRate)
+	assert.EqualValues(t, 6, stats.InPacketRate)
+}
@@ -0,0 +1,209 @@
+package netflow
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	conntrackFile = "/proc/net/nf_conntrack"
+)
+
+// conntrackEntry is the original and the reply tuple of a tracked connection,
+// they differ when the connection is translated by nat.
+type conntrackEntry struct {
+	orig  flowKey
+	reply flowKey
+}
+
+// conntrackRef is the entry of packet, translated is the tuple of the same
+// packet on the other side of nat, reply is true when the packet goes in the
+// reply direction.
+type conntrackRef struct {
+	entry      *conntrackEntry
+	translated flowKey
+	reply      bool
+}
+
+// conntrackTable is rebuilt on each rescan and swapped atomically, the capture
+// goroutines never lock.
+type conntrackTable struct {
+	path string
+	v    atomic.Value // map[flowKey]conntrackRef
+}
+
+func newConntrackTable(path string) *conntrackTable {
+	ct := &conntrackTable{path: path}
+	ct.store(nil)
+	return ct
+}
+
+// WithConntrack read the conntrack table of host, translated flows are
+// classified by the tuple after nat.
+func WithConntrack(enable bool) optionFunc {
+	return func(o *Netflow) error {
+		o.conntrack = nil
+		if enable {
+			o.conntrack = newConntrackTable(conntrackFile)
+		}
+		return nil
+	}
+}
+
+// store index the entries by the tuples seen before and after nat in both
+// directions, only translated connections are kept, the others are classified
+// by addresses.
+func (ct *conntrackTable) store(entries []*conntrackEntry) {
+	dict := make(map[flowKey]conntrackRef, len(entries)*4)
+	for _, ent := range entries {
+		if ent.orig == ent.reply.reverse() {
+			continue
+		}
+		// the original side, eg: the public address of dnat.
+		dict[ent.orig] = conntrackRef{entry: ent, translated: ent.reply.reverse()}
+		dict[ent.orig.reverse()] = conntrackRef{entry: ent, translated: ent.reply, reply: true}
+		// the translated side, eg: the address of container.
+		dict[ent.reply.reverse()] = conntrackRef{entry: ent, translated: ent.orig}
+		dict[ent.reply] = conntrackRef{entry: ent, translated: ent.orig.reverse(), reply: true}
+	}
+	ct.v.Store(dict)
+}
+
+func (ct *conntrackTable) lookup(key flowKey) (conntrackRef, bool) {
+	if ct == nil {
+		return conntrackRef{}, false
+	}
+
+	dict, _ := ct.v.Load().(map[flowKey]conntrackRef)
+	ref, ok := dict[key]
+	return ref, ok
+}
+
+// translate return the tuple of packet on the other side of nat.
+func (ct *conntrackTable) translate(key flowKey) (flowKey, bool) {
+	ref, ok := ct.lookup(key)
+	if !ok {
+		return flowKey{}, false
+	}
+	return ref.translated, true
+}
+
+// side return the direction of packet when the connection is translated to or
+// from a local address.
+func (ct *conntrackTable) side(key flowKey, local *addrSet) (sideOption, bool) {
+	tkey, ok := ct.translate(key)
+	if !ok {
+		return 0, false
+	}
+
+	switch {
+	case local.contains(tkey.srcIP):
+		return outputSide, true
+	case local.contains(tkey.dstIP):
+		return inputSide, true
+	}
+	return 0, false
+}
+
+// rescan reload the conntrack table, it's empty when conntrack isn't loaded.
+func (ct *conntrackTable) rescan() error {
+	file, err := os.Open(ct.path)
+	if os.IsNotExist(err) {
+		ct.store(nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var (
+		entries = make([]*conntrackEntry, 0, 1000)
+		scanner = bufio.NewScanner(file)
+	)
+	for scanner.Scan() {
+		if ent, ok := parseConntrackLine(scanner.Text()); ok {
+			entries = append(entries, ent)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	ct.store(entries)
+	return nil
+}
+
+// parseConntrackLine parse the tcp and udp entries of nf_conntrack, eg:
+// ipv4 2 tcp 6 431999 ESTABLISHED src=1.1.1.1 dst=10.0.0.1 sport=55000 dport=8080 src=172.17.0.2 dst=1.1.1.1 sport=80 dport=55000 [ASSURED] mark=0 use=2
+func parseConntrackLine(line string) (*conntrackEntry, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 6 {
+		return nil, false
+	}
+
+	var proto uint8
+	switch fields[2] {
+	case "tcp":
+		proto = protoTCP
+	case "udp":
+		proto = protoUDP
+	default:
+		return nil, false
+	}
+
+	var (
+		ips   [4]net.IP // orig src, orig dst, reply src, reply dst
+		ports [4]uint16
+		nips  int
+		nport int
+	)
+	for _, field := range fields[5:] {
+		k, v, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+
+		switch k {
+		case "src", "dst":
+			if nips < len(ips) {
+				ips[nips] = net.ParseIP(v)
+				nips++
+			}
+		case "sport", "dport":
+			if nport < len(ports) {
+				port, err := strconv.ParseUint(v, 10, 16)
+				if err != nil {
+					return nil, false
+				}
+				ports[nport] = uint16(port)
+				nport++
+			}
+		}
+	}
+	if nips != len(ips) || nport != len(ports) {
+		return nil, false
+	}
+	for _, ip := range ips {
+		if ip == nil {
+			return nil, false
+		}
+	}
+
+	return &conntrackEntry{
+		orig:  newFlowKey(ips[0], ports[0], ips[1], ports[1], proto),
+		reply: newFlowKey(ips[2], ports[2], ips[3], ports[3], proto),
+	}, true
+}
+
+func (nf *Netflow) rescanConntrack() error {
+	err := nf.conntrack.rescan()
+	if err != nil {
+		nf.logDebug("failed to read conntrack ", err)
+	}
+	return nil
+}
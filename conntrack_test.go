@@ -0,0 +1,60 @@
+package netflow
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testConntrack = `ipv4     2 tcp      6 431999 ESTABLISHED src=1.1.1.1 dst=10.0.0.1 sport=55000 dport=8080 src=172.17.0.2 dst=1.1.1.1 sport=80 dport=55000 [ASSURED] mark=0 zone=0 use=2
+ipv4     2 udp      17 20 src=10.0.0.1 dst=8.8.8.8 sport=53000 dport=53 src=8.8.8.8 dst=10.0.0.1 sport=53 dport=53000 mark=0 zone=0 use=2
+ipv4     2 icmp     1 29 src=10.0.0.1 dst=8.8.8.8 type=8 code=0 id=1 src=8.8.8.8 dst=10.0.0.1 type=0 code=0 id=1 mark=0 zone=0 use=2
+ipv6     10 tcp      6 60 SYN_SENT src=fd00::1 dst=fd00::2 sport=41000 dport=443 [UNREPLIED] src=fd00::2 dst=fd00::1 sport=443 dport=41000 mark=0 zone=0 use=2
+`
+
+func TestParseConntrackLine(t *testing.T) {
+	ent, ok := parseConntrackLine("ipv4 2 tcp 6 431999 ESTABLISHED src=1.1.1.1 dst=10.0.0.1 sport=55000 dport=8080 " +
+		"src=172.17.0.2 dst=1.1.1.1 sport=80 dport=55000 [ASSURED] mark=0 use=2")
+	assert.True(t, ok)
+	assert.Equal(t, testFlowKey("1.1.1.1", 55000, "10.0.0.1", 8080), ent.orig)
+	assert.Equal(t, testFlowKey("172.17.0.2", 80, "1.1.1.1", 55000), ent.reply)
+
+	_, ok = parseConntrackLine("ipv4 2 icmp 1 29 src=10.0.0.1 dst=8.8.8.8 type=8 code=0 id=1 src=8.8.8.8 dst=10.0.0.1 type=0 code=0 id=1")
+	assert.False(t, ok)
+
+	_, ok = parseConntrackLine("ipv4 2 tcp 6 431999 ESTABLISHED src=1.1.1.1 dst=10.0.0.1 sport=55000")
+	assert.False(t, ok)
+}
+
+func TestConntrackRescan(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nf_conntrack")
+	assert.Nil(t, os.WriteFile(path, []byte(testConntrack), 0644))
+
+	ct := newConntrackTable(path)
+	assert.Nil(t, ct.rescan())
+
+	// only the translated connection is kept.
+	ref, ok := ct.lookup(testFlowKey("1.1.1.1", 55000, "10.0.0.1", 8080))
+	assert.True(t, ok)
+	assert.False(t, ref.reply)
+	assert.Equal(t, testFlowKey("172.17.0.2", 80, "1.1.1.1", 55000), ref.entry.reply)
+
+	ref, ok = ct.lookup(testFlowKey("10.0.0.1", 8080, "1.1.1.1", 55000))
+	assert.True(t, ok)
+	assert.True(t, ref.reply)
+
+	_, ok = ct.lookup(testFlowKey("fd00::1", 41000, "fd00::2", 443))
+	assert.False(t, ok)
+
+	// conntrack isn't loaded.
+	ct.path = filepath.Join(t.TempDir(), "missing")
+	assert.Nil(t, ct.rescan())
+	_, ok = ct.lookup(testFlowKey("1.1.1.1", 55000, "10.0.0.1", 8080))
+	assert.False(t, ok)
+
+	var disabled *conntrackTable
+	_, ok = disabled.lookup(testFlowKey("1.1.1.1", 55000, "10.0.0.1", 8080))
+	assert.False(t, ok)
+}
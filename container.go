@@ -0,0 +1,142 @@
+package netflow
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	runtimeDocker     = "docker"
+	runtimeContainerd = "containerd"
+	runtimeCrio       = "cri-o"
+	runtimePodman     = "podman"
+)
+
+var (
+	// 64 hex chars, the full id used by docker, containerd and cri-o.
+	containerIDRegexp = regexp.MustCompile(`[0-9a-f]{64}`)
+
+	// kubepods/burstable/pod<uid> or kubepods-burstable-pod<uid_with_underscore>.slice
+	podUIDRegexp = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+)
+
+// cgroupInfo describe which cgroup, container, pod and systemd unit a process belongs to.
+type cgroupInfo struct {
+	Path        string
+	ContainerID string
+	Runtime     string
+	PodUID      string
+	Unit        string
+}
+
+// getProcessCgroup read /proc/<pid>/cgroup and resolve the container attribution.
+func getProcessCgroup(pid string) *cgroupInfo {
+	f, err := os.Open(fmt.Sprintf("/proc/%s/cgroup", pid))
+	if err != nil {
+		return &cgroupInfo{}
+	}
+	defer f.Close()
+
+	return parseCgroupPath(parseCgroupFile(f))
+}
+
+// parseCgroupFile pick the most meaningful path from a cgroup file, it supports
+// v1 (hierarchy-id:controllers:path) and v2 (0::path) formats.
+func parseCgroupFile(r io.Reader) string {
+	var (
+		unified string
+		systemd string
+		other   string
+	)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		controllers, path := fields[1], fields[2]
+		switch {
+		case fields[0] == "0" && controllers == "":
+			unified = path
+		case controllers == "name=systemd":
+			systemd = path
+		case strings.Contains(controllers, "memory"), strings.Contains(controllers, "cpu"):
+			if other == "" || other == "/" {
+				other = path
+			}
+		}
+	}
+
+	// the hybrid mode mounts an empty unified hierarchy, so only trust
+	// it when it carries a real path.
+	for _, path := range []string{unified, systemd, other} {
+		if path != "" && path != "/" {
+			return path
+		}
+	}
+	if unified != "" {
+		return unified
+	}
+	return systemd
+}
+
+// parseCgroupPath derive container id, runtime, pod uid and systemd unit from cgroup path.
+func parseCgroupPath(path string) *cgroupInfo {
+	info := &cgroupInfo{Path: path}
+	if path == "" {
+		return info
+	}
+
+	if m := podUIDRegexp.FindStringSubmatch(path); m != nil {
+		info.PodUID = strings.ReplaceAll(m[1], "_", "-")
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		part := parts[i]
+
+		id := containerIDRegexp.FindString(part)
+		if id != "" && info.ContainerID == "" {
+			info.ContainerID = id
+			info.Runtime = guessContainerRuntime(part, parts[:i])
+		}
+
+		if info.Unit == "" && (strings.HasSuffix(part, ".service") || strings.HasSuffix(part, ".scope")) && id == "" {
+			info.Unit = part
+		}
+	}
+
+	return info
+}
+
+func guessContainerRuntime(part string, parents []string) string {
+	switch {
+	case strings.HasPrefix(part, "docker-"):
+		return runtimeDocker
+	case strings.HasPrefix(part, "cri-containerd-"):
+		return runtimeContainerd
+	case strings.HasPrefix(part, "crio-"):
+		return runtimeCrio
+	case strings.HasPrefix(part, "libpod-"):
+		return runtimePodman
+	}
+
+	for i := len(parents) - 1; i >= 0; i-- {
+		switch {
+		case parents[i] == "docker":
+			return runtimeDocker
+		case parents[i] == "crio":
+			return runtimeCrio
+		case strings.HasPrefix(parents[i], "kubepods"):
+			// cgroupfs driver of kubelet doesn't tell the runtime, containerd is the most common one.
+			return runtimeContainerd
+		}
+	}
+	return ""
+}
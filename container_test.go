@@ -0,0 +1,100 @@
+package netflow
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testContainerID = "3f4e5d6c7b8a99887766554433221100ffeeddccbbaa00112233445566778899"
+
+func TestParseCgroupFile(t *testing.T) {
+	v1 := `12:pids:/docker/` + testContainerID + `
+4:memory:/docker/` + testContainerID + `
+1:name=systemd:/docker/` + testContainerID + `
+0::/
+`
+	assert.Equal(t, "/docker/"+testContainerID, parseCgroupFile(strings.NewReader(v1)))
+
+	v2 := "0::/system.slice/nginx.service\n"
+	assert.Equal(t, "/system.slice/nginx.service", parseCgroupFile(strings.NewReader(v2)))
+
+	assert.Equal(t, "", parseCgroupFile(strings.NewReader("")))
+}
+
+func TestParseCgroupPath(t *testing.T) {
+	cases := []struct {
+		path    string
+		id      string
+		runtime string
+		pod     string
+		unit    string
+	}{
+		{
+			path:    "/docker/" + testContainerID,
+			id:      testContainerID,
+			runtime: runtimeDocker,
+		},
+		{
+			path:    "/system.slice/docker-" + testContainerID + ".scope",
+			id:      testContainerID,
+			runtime: runtimeDocker,
+		},
+		{
+			path:    "/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod1b2c3d4e_0000_1111_2222_333344445555.slice/cri-containerd-" + testContainerID + ".scope",
+			id:      testContainerID,
+			runtime: runtimeContainerd,
+			pod:     "1b2c3d4e-0000-1111-2222-333344445555",
+		},
+		{
+			path:    "/kubepods/besteffort/pod1b2c3d4e-0000-1111-2222-333344445555/" + testContainerID,
+			id:      testContainerID,
+			runtime: runtimeContainerd,
+			pod:     "1b2c3d4e-0000-1111-2222-333344445555",
+		},
+		{
+			path:    "/kubepods.slice/kubepods-pod1b2c3d4e_0000_1111_2222_333344445555.slice/crio-" + testContainerID + ".scope",
+			id:      testContainerID,
+			runtime: runtimeCrio,
+			pod:     "1b2c3d4e-0000-1111-2222-333344445555",
+		},
+		{
+			path: "/system.slice/nginx.service",
+			unit: "nginx.service",
+		},
+		{
+			path: "/user.slice/user-0.slice/session-3.scope",
+			unit: "session-3.scope",
+		},
+	}
+
+	for _, c := range cases {
+		info := parseCgroupPath(c.path)
+		assert.Equal(t, c.path, info.Path)
+		assert.Equal(t, c.id, info.ContainerID, c.path)
+		assert.Equal(t, c.runtime, info.Runtime, c.path)
+		assert.Equal(t, c.pod, info.PodUID, c.path)
+		assert.Equal(t, c.unit, info.Unit, c.path)
+	}
+}
+
+func TestGroupProcesses(t *testing.T) {
+	pos := []*Process{
+		{Pid: "1", ContainerID: "aaa", TrafficStats: &trafficStatsEntry{In: 100, Out: 100}},
+		{Pid: "2", ContainerID: "bbb", TrafficStats: &trafficStatsEntry{In: 50, Out: 0}},
+		{Pid: "3", ContainerID: "aaa", TrafficStats: &trafficStatsEntry{In: 10, Out: 10}},
+		{Pid: "4", TrafficStats: &trafficStatsEntry{In: 1000, Out: 1000}},
+	}
+
+	groups := groupProcesses(pos, GroupByContainer)
+	assert.Equal(t, 2, len(groups))
+	assert.Equal(t, "aaa", groups[0].Key)
+	assert.Equal(t, []string{"1", "3"}, groups[0].Pids)
+	assert.EqualValues(t, 110, groups[0].TrafficStats.In)
+	assert.Equal(t, "bbb", groups[1].Key)
+
+	groups = groupProcesses(pos, GroupByProcess)
+	assert.Equal(t, 4, len(groups))
+	assert.Equal(t, "4", groups[0].Key)
+}
@@ -2,6 +2,7 @@ package core
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/olekukonko/tablewriter"
 	"github.com/rfyiamcool/go-netflow"
@@ -11,6 +12,7 @@ import (
 	"github.com/rfyiamcool/go-netflow/utils"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cast"
+	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
@@ -28,8 +30,22 @@ func Start(c config.Config) {
 		filter = fmt.Sprintf("tcp and port %s ", c.Filter)
 	}
 	println(filter)
+
+	// 持久化流量历史, 通过 /api/v1/history 查询
+	var store *netflow.Store
+	if c.Store.Dir != "" {
+		store, err = netflow.OpenStore(c.Store.Dir, c.Store.BudgetMB<<20)
+		if err != nil {
+			log.Fatalf("Failed to open store: %v", err)
+			return
+		}
+		defer store.Close()
+
+		http.Handle("/api/v1/history", store)
+	}
+
 	nf, err = netflow.New(netflow.WithName(c.Nethogs), netflow.WithCaptureTimeout(12*30*24*60*time.Minute), netflow.WithPcapFilter(filter),
-		netflow.WithQueueSize(20000))
+		netflow.WithQueueSize(20000), netflow.WithStore(store))
 	if err != nil {
 		log.Fatalf("Failed to create netflow instance: %v", err)
 		return
@@ -45,6 +61,8 @@ func Start(c config.Config) {
 	defer func() {
 		nf.Stop()
 	}()
+	// 发送队列持续增长的 socket, eg: /api/v1/sockets/growing?limit=20
+	http.HandleFunc("/api/v1/sockets/growing", serveGrowingSendQueues)
 	// Set up necessary variables
 	var (
 		recentRankLimit = 1
@@ -81,6 +99,16 @@ func Start(c config.Config) {
 	//}
 }
 
+func serveGrowingSendQueues(w http.ResponseWriter, r *http.Request) {
+	limit := cast.ToInt(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = 20
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(nf.GetGrowingSendQueues(limit))
+}
+
 // 处理信号
 func handleSignals(sigch chan os.Signal, cancelFunc context.CancelFunc) {
 	for sig := range sigch {
@@ -111,7 +139,7 @@ func processRanking(ctx context.Context, c config.Config, nf netflow.Interface,
 // 渲染和遍历
 func showTable(c config.Config, ps []*netflow.Process) {
 	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"pid", "name", "exe", "inodes", "sum_in", "sum_out", "in_rate", "out_rate"})
+	table.SetHeader([]string{"pid", "name", "exe", "inodes", "sum_in", "sum_out", "in_rate", "out_rate", "in_p95", "out_p95", "pps", "new_conns"})
 	table.SetRowLine(true)
 	var (
 		items [][]string
@@ -120,11 +148,16 @@ func showTable(c config.Config, ps []*netflow.Process) {
 	)
 	for _, po := range ps {
 		inRate, outRate := formatRates(po.TrafficStats.InRate, po.TrafficStats.OutRate)
+		inP95, outP95 := formatRates(po.TrafficStats.InRates.P95, po.TrafficStats.OutRates.P95)
 		item := []string{po.Pid, po.Name, po.Exe, cast.ToString(po.InodeCount),
 			utils.HumanBytes(po.TrafficStats.In * 8),
 			utils.HumanBytes(po.TrafficStats.Out * 8),
 			inRate,
 			outRate,
+			inP95,
+			outP95,
+			cast.ToString(po.TrafficStats.InPacketRate + po.TrafficStats.OutPacketRate),
+			cast.ToString(po.TrafficStats.NewConnRate),
 		}
 		//累加多进程级别的适配
 		in += po.TrafficStats.InRate
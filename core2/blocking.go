@@ -20,6 +20,11 @@ import (
 
 var nf netflow.Interface
 
+const (
+	servicePort      = 9080 // 文件服务监听的端口
+	serviceRankLimit = 100
+)
+
 func StartOut(c config.Config) {
 	var err error
 	// Initialize netflow instance with error handling
@@ -96,14 +101,29 @@ func processRanking(ctx context.Context, c config.Config, nf netflow.Interface,
 				log.Printf("GetProcessRank failed: %v", err)
 				continue
 			}
-			showTable(c, rank)
+			svcs, err := nf.GetServiceRank(serviceRankLimit, 60)
+			if err != nil {
+				log.Printf("GetServiceRank failed: %v", err)
+				continue
+			}
+			showTable(c, rank, findService(svcs, servicePort))
 			clear()
 		}
 	}
 }
 
+// findService 查找监听端口对应的服务流量
+func findService(svcs []*netflow.Service, port int) *netflow.Service {
+	for _, svc := range svcs {
+		if svc.Port == port {
+			return svc
+		}
+	}
+	return nil
+}
+
 // 渲染和遍历
-func showTable(c config.Config, ps []*netflow.Process) {
+func showTable(c config.Config, ps []*netflow.Process, svc *netflow.Service) {
 	table := tablewriter.NewWriter(os.Stdout)
 	table.SetHeader([]string{"pid", "name", "exe", "inodes", "sum_in", "sum_out", "in_rate", "out_rate"})
 	table.SetRowLine(true)
@@ -113,76 +133,60 @@ func showTable(c config.Config, ps []*netflow.Process) {
 		out   int64
 	)
 
-	monitor, err := utils.NewTrafficMonitor("", "9080") // 监控设备上的8080端口流量
-	if err != nil {
-		log.Fatalf("Error creating monitor: %v", err)
+	// 服务端口的上传流量，由 netflow 按监听端口统计
+	var uploadRate int64
+	if svc != nil {
+		uploadRate = svc.TrafficStats.OutRate
+		fmt.Printf("Upload traffic of port %d: %d bytes/s\n", servicePort, uploadRate)
 	}
-	defer monitor.Close()
-
-	// 每隔一秒获取一次上传流量
-	ticker := time.NewTicker(60 * time.Second)
-	defer ticker.Stop()
 
-	for range ticker.C {
-		// 获取上传流量
-		uploadTraffic := monitor.GetUploadTraffic()
-		fmt.Printf("Upload traffic: %d bytes\n", uploadTraffic)
-
-		// 清空前一秒的表格数据
-		items = [][]string{}
-		in, out = 0, 0 // 清空 in 和 out 的累积值
-		if len(ps) == 0 {
-			OutRate := uploadTraffic / 60
+	if len(ps) == 0 {
+		// 获取格式化的流量速率
+		inRate, outRate := formatRates(0, uploadRate)
+		items = append(items, // 生成表格行
+			[]string{
+				"0",
+				strconv.Itoa(servicePort),
+				"fileServer",
+				"1",
+				"0",
+				"0",
+				inRate,
+				outRate,
+			})
+		in = 0
+		out = uploadRate
+	} else {
+		for _, po := range ps {
+			// 设置当前进程的上传速率
+			po.TrafficStats.OutRate = uploadRate
 
 			// 获取格式化的流量速率
-			inRate, outRate := formatRates(0, OutRate)
-			items = append(items, // 生成表格行
-				[]string{
-					"0",
-					"9080",
-					"fileServer",
-					"1",
-					"0",
-					"0",
-					inRate,
-					outRate,
-				})
-			in = 0
-			out = OutRate
-		} else {
-			for _, po := range ps {
-				// 设置当前进程的上传速率
-				po.TrafficStats.OutRate = uploadTraffic / 60
-
-				// 获取格式化的流量速率
-				inRate, outRate := formatRates(po.TrafficStats.InRate, po.TrafficStats.OutRate)
-
-				// 生成表格行
-				item := []string{
-					po.Pid,
-					po.Name,
-					po.Exe,
-					cast.ToString(po.InodeCount),
-					utils.HumanBytes(po.TrafficStats.In * 8),
-					utils.HumanBytes(po.TrafficStats.Out * 8),
-					inRate,
-					outRate,
-				}
-
-				// 累加流量信息
-				in += po.TrafficStats.InRate
-				out += po.TrafficStats.OutRate
-				items = append(items, item)
+			inRate, outRate := formatRates(po.TrafficStats.InRate, po.TrafficStats.OutRate)
+
+			// 生成表格行
+			item := []string{
+				po.Pid,
+				po.Name,
+				po.Exe,
+				cast.ToString(po.InodeCount),
+				utils.HumanBytes(po.TrafficStats.In * 8),
+				utils.HumanBytes(po.TrafficStats.Out * 8),
+				inRate,
+				outRate,
 			}
-		}
-		// 输出流量汇总信息
-		reportHandler(in, out, c)
 
-		// 更新表格并渲染
-		table.ClearRows()
-		table.AppendBulk(items)
-		table.Render()
+			// 累加流量信息
+			in += po.TrafficStats.InRate
+			out += po.TrafficStats.OutRate
+			items = append(items, item)
+		}
 	}
+	// 输出流量汇总信息
+	reportHandler(in, out, c)
+
+	table.AppendBulk(items)
+	table.Render()
 }
 
 func reportHandler(in, out int64, c config.Config) {
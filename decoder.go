@@ -0,0 +1,482 @@
+package netflow
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+const (
+	protoTCP = uint8(layers.IPProtocolTCP)
+	protoUDP = uint8(layers.IPProtocolUDP)
+
+	pppProtoIPv4 = 0x0021
+	pppProtoIPv6 = 0x0057
+
+	// 802.1Q and QinQ
+	maxVlanDepth = 2
+)
+
+var (
+	errTruncated = errors.New("truncated packet")
+)
+
+// ipAddr is an ip address in 16 bytes form, ipv4 is stored as ipv4-mapped ipv6.
+type ipAddr [16]byte
+
+func newIPAddr(ip net.IP) ipAddr {
+	var addr ipAddr
+	copy(addr[:], ip.To16())
+	return addr
+}
+
+func (a ipAddr) IP() net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, a[:])
+	return ip
+}
+
+func (a ipAddr) String() string {
+	return a.IP().String()
+}
+
+// flowKey is the binary 5-tuple of packet, it's comparable and used as map key
+// to avoid formatting strings for each packet.
+type flowKey struct {
+	srcIP   ipAddr
+	dstIP   ipAddr
+	srcPort uint16
+	dstPort uint16
+	proto   uint8
+}
+
+func newFlowKey(sip net.IP, sport uint16, dip net.IP, dport uint16, proto uint8) flowKey {
+	return flowKey{
+		srcIP:   newIPAddr(sip),
+		dstIP:   newIPAddr(dip),
+		srcPort: sport,
+		dstPort: dport,
+		proto:   proto,
+	}
+}
+
+func (k flowKey) reverse() flowKey {
+	return flowKey{
+		srcIP:   k.dstIP,
+		dstIP:   k.srcIP,
+		srcPort: k.dstPort,
+		dstPort: k.srcPort,
+		proto:   k.proto,
+	}
+}
+
+// hash is symmetric, both directions of a flow get the same value.
+func (k flowKey) hash() uint32 {
+	h := hashEndpoint(k.srcIP, k.srcPort) ^ hashEndpoint(k.dstIP, k.dstPort)
+	h ^= uint32(k.proto)
+	// finalizer of murmur3, spread the bits before modulo.
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+// hashEndpoint is fnv-1a of ip and port.
+func hashEndpoint(ip ipAddr, port uint16) uint32 {
+	h := uint32(2166136261)
+	for _, b := range ip {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	h ^= uint32(port >> 8)
+	h *= 16777619
+	h ^= uint32(port & 0xff)
+	h *= 16777619
+	return h
+}
+
+// less compare the source endpoints, it orders the two directions of a flow.
+func (k flowKey) less(o flowKey) bool {
+	if c := bytes.Compare(k.srcIP[:], o.srcIP[:]); c != 0 {
+		return c < 0
+	}
+	return k.srcPort < o.srcPort
+}
+
+// local return the local endpoint of flow by the side of packet.
+func (k flowKey) local(side sideOption) (ipAddr, uint16) {
+	if side == inputSide {
+		return k.dstIP, k.dstPort
+	}
+	return k.srcIP, k.srcPort
+}
+
+// oriented return the key as local -> remote by the side of packet, it's the
+// tuple of the local socket.
+func (k flowKey) oriented(side sideOption) flowKey {
+	if side == inputSide {
+		return k.reverse()
+	}
+	return k
+}
+
+// String format as src_ip:src_port_dst_ip:dst_port, the same as ConnectionItem.Addr.
+func (k flowKey) String() string {
+	return k.srcIP.String() + ":" + strconv.Itoa(int(k.srcPort)) + "_" +
+		k.dstIP.String() + ":" + strconv.Itoa(int(k.dstPort))
+}
+
+func (k flowKey) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// packetMeta is all we need from a packet, it's passed by value to workers.
+type packetMeta struct {
+	key    flowKey
+	length int64
+	side   sideOption
+
+	// billed length of the outer packet, only set with WithTunnelOuterBytes.
+	outer int64
+
+	// packets represented by the meta, it's scaled up when sampling.
+	packets int64
+
+	// header of tcp packet, it's zero for udp.
+	tcp tcpHeader
+
+	// capture time in unix nano, handshake rtt is measured by it.
+	ts int64
+
+	// both ends are local sockets, the packet is counted as output of the
+	// sender and then as input of the receiver.
+	loopback bool
+}
+
+// opening return true when the tcp packet opens a connection, it's a SYN without ACK.
+func (m *packetMeta) opening() bool {
+	return m.tcp.flags&(tcpSYN|tcpACK) == tcpSYN
+}
+
+// control return true for the tcp segments opening or closing connections,
+// they're never skipped by sampling.
+func (m *packetMeta) control() bool {
+	return m.tcp.flags&(tcpSYN|tcpFIN|tcpRST) != 0
+}
+
+// packetDecoder decode packets with DecodingLayerParser, layers are reused
+// between packets, so it's not safe for concurrent use.
+type packetDecoder struct {
+	parser  *gopacket.DecodingLayerParser
+	decoded []gopacket.LayerType
+
+	eth   layers.Ethernet
+	sll   layers.LinuxSLL
+	dot1q vlanLayer
+	pppoe pppoeSession
+	ppp   pppLayer
+	ip4   ipv4Layer
+	ip6   ipv6Layer
+	tcp   layers.TCP
+	udp   layers.UDP
+
+	// decoders of encapsulated packets, nil in the inner decoders.
+	innerEth *packetDecoder
+	innerIP4 *packetDecoder
+	innerIP6 *packetDecoder
+	tunnel   tunnelInfo
+
+	// direction of the pcap handler, packets of both directions are read
+	// when it's pcap.DirectionInOut.
+	direction pcap.Direction
+}
+
+// newPacketDecoder create decoder for the link type of pcap handler.
+func newPacketDecoder(linkType layers.LinkType) *packetDecoder {
+	var first gopacket.LayerType
+	switch linkType {
+	case layers.LinkTypeLinuxSLL:
+		first = layers.LayerTypeLinuxSLL
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4:
+		first = layers.LayerTypeIPv4
+	case layers.LinkTypeIPv6:
+		first = layers.LayerTypeIPv6
+	case layers.LinkTypePPP:
+		first = layers.LayerTypePPP
+	default:
+		first = layers.LayerTypeEthernet
+	}
+
+	d := newLayerDecoder(first)
+	d.innerEth = newLayerDecoder(layers.LayerTypeEthernet)
+	d.innerIP4 = newLayerDecoder(layers.LayerTypeIPv4)
+	d.innerIP6 = newLayerDecoder(layers.LayerTypeIPv6)
+	return d
+}
+
+func newLayerDecoder(first gopacket.LayerType) *packetDecoder {
+	d := &packetDecoder{
+		decoded: make([]gopacket.LayerType, 0, 16),
+	}
+
+	d.parser = gopacket.NewDecodingLayerParser(first,
+		&d.eth, &d.sll, &d.dot1q, &d.pppoe, &d.ppp,
+		&d.ip4, &d.ip6, &d.tcp, &d.udp,
+	)
+	d.parser.IgnoreUnsupported = true
+	return d
+}
+
+// decode fill meta with the 5-tuple and length of packet, return false when
+// it's not a tcp or udp packet. the length is the total length in ip header,
+// so it's right when the packet is cut by snaplen, the captured length is only
+// used when the header has no length, eg: tso packets captured on the sender.
+func (d *packetDecoder) decode(data []byte, meta *packetMeta) bool {
+	d.dot1q.depth = 0
+	d.pppoe.SessionID = 0
+	d.tunnel = tunnelInfo{}
+	meta.tcp = tcpHeader{}
+
+	err := d.parser.DecodeLayers(data, &d.decoded)
+	if err != nil {
+		return false
+	}
+
+	var (
+		sip, dip     net.IP
+		ipHeaderLen  int
+		ipTotalLen   int // from ip header, the payload may be cut by snaplen
+		ipProto      uint8
+		ipPayload    []byte
+		hasIP, hasL4 bool
+	)
+
+	for _, typ := range d.decoded {
+		switch typ {
+		case layers.LayerTypeIPv4:
+			sip, dip = d.ip4.SrcIP, d.ip4.DstIP
+			ipHeaderLen = int(d.ip4.IHL) * 4 // IHL 以 32-bit 为单位, 需要乘以4转换为字节
+			ipTotalLen = int(d.ip4.Length)
+			ipProto, ipPayload = uint8(d.ip4.Protocol), d.ip4.Payload
+			hasIP = true
+
+		case layers.LayerTypeIPv6:
+			sip, dip = d.ip6.SrcIP, d.ip6.DstIP
+			ipHeaderLen = 40
+			ipTotalLen = 0
+			if d.ip6.Length != 0 { // 0 is jumbogram
+				ipTotalLen = ipHeaderLen + int(d.ip6.Length)
+			}
+			ipProto, ipPayload = uint8(d.ip6.NextHeader), d.ip6.Payload
+			hasIP = true
+
+		case layers.LayerTypeTCP:
+			if !hasIP {
+				return false
+			}
+
+			meta.key = newFlowKey(sip, uint16(d.tcp.SrcPort), dip, uint16(d.tcp.DstPort), protoTCP)
+			// ip header + tcp header + tcp payload
+			meta.length = int64(ipHeaderLen + int(d.tcp.DataOffset)*4 + len(d.tcp.Payload))
+			if ipTotalLen != 0 {
+				meta.length = int64(ipTotalLen)
+			}
+			meta.tcp = newTCPHeader(&d.tcp, int(meta.length)-ipHeaderLen)
+			hasL4 = true
+
+		case layers.LayerTypeUDP:
+			if !hasIP {
+				return false
+			}
+
+			meta.key = newFlowKey(sip, uint16(d.udp.SrcPort), dip, uint16(d.udp.DstPort), protoUDP)
+			meta.tcp = tcpHeader{}
+			meta.length = int64(ipHeaderLen + 8 + len(d.udp.Payload))
+			if ipTotalLen != 0 {
+				meta.length = int64(ipTotalLen)
+			}
+			hasL4 = true
+		}
+	}
+
+	// the outer packet of tunnel, account the inner flow instead.
+	var outer flowKey
+	switch {
+	case !hasIP || d.innerEth == nil:
+		return hasL4
+	case ipProto == protoUDP && hasL4:
+		outer = meta.key
+	case isTunnelProto(ipProto):
+		outer = newFlowKey(sip, 0, dip, 0, ipProto)
+	default:
+		return hasL4
+	}
+
+	outerLen := ipTotalLen
+	if outerLen == 0 {
+		outerLen = ipHeaderLen + len(ipPayload)
+	}
+	if d.decodeTunnel(meta, outer, outerLen, ipProto, ipPayload) {
+		return true
+	}
+	return hasL4
+}
+
+// packetType return the direction of packet recorded by linux cooked capture,
+// ok is false for other link types.
+func (d *packetDecoder) packetType() (layers.LinuxSLLPacketType, bool) {
+	for _, typ := range d.decoded {
+		if typ == layers.LayerTypeLinuxSLL {
+			return d.sll.PacketType, true
+		}
+	}
+	return 0, false
+}
+
+// linkInfo is the link layer info of the last decoded packet.
+type linkInfo struct {
+	srcMAC    [6]byte
+	dstMAC    [6]byte
+	hasMAC    bool
+	vlans     [maxVlanDepth]uint16 // outer first
+	vlanDepth int
+	session   uint16
+	pppoe     bool
+}
+
+// localMAC return the mac of this host by the side of packet.
+func (l *linkInfo) localMAC(side sideOption) [6]byte {
+	if side == inputSide {
+		return l.dstMAC
+	}
+	return l.srcMAC
+}
+
+// link fill the link layer info of the last decoded packet.
+func (d *packetDecoder) link(info *linkInfo) {
+	*info = linkInfo{}
+	for _, typ := range d.decoded {
+		switch typ {
+		case layers.LayerTypeEthernet:
+			copy(info.srcMAC[:], d.eth.SrcMAC)
+			copy(info.dstMAC[:], d.eth.DstMAC)
+			info.hasMAC = true
+		case layers.LayerTypePPPoE:
+			info.session = d.pppoe.SessionID
+			info.pppoe = true
+		}
+	}
+
+	info.vlanDepth = d.dot1q.depth
+	if info.vlanDepth > maxVlanDepth {
+		info.vlanDepth = maxVlanDepth
+	}
+	info.vlans = d.dot1q.ids
+}
+
+// vlanLayer record the ids of stacked vlan tags, the parser reuses one layer for all tags.
+type vlanLayer struct {
+	layers.Dot1Q
+	ids   [maxVlanDepth]uint16
+	depth int
+}
+
+func (v *vlanLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	err := v.Dot1Q.DecodeFromBytes(data, df)
+	if err != nil {
+		return err
+	}
+
+	if v.depth < maxVlanDepth {
+		v.ids[v.depth] = v.VLANIdentifier
+	}
+	v.depth++
+	return nil
+}
+
+// pppoeSession decode the pppoe session header and the ppp protocol following it.
+type pppoeSession struct {
+	layers.BaseLayer
+	SessionID uint16
+	Protocol  uint16
+}
+
+func (p *pppoeSession) LayerType() gopacket.LayerType {
+	return layers.LayerTypePPPoE
+}
+
+func (p *pppoeSession) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypePPPoE
+}
+
+func (p *pppoeSession) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	// ver/type(1) code(1) session(2) length(2) ppp protocol(2)
+	if len(data) < 8 {
+		df.SetTruncated()
+		return errTruncated
+	}
+
+	p.SessionID = binary.BigEndian.Uint16(data[2:4])
+	p.Protocol = 0
+	if data[1] == byte(layers.PPPoECodeSession) {
+		// discovery frames carry tags instead of ppp payload.
+		p.Protocol = binary.BigEndian.Uint16(data[6:8])
+	}
+	p.BaseLayer = layers.BaseLayer{Contents: data[:8], Payload: data[8:]}
+	return nil
+}
+
+func (p *pppoeSession) NextLayerType() gopacket.LayerType {
+	return pppNextLayerType(p.Protocol)
+}
+
+// pppLayer decode the ppp header of ppp devices, address and control fields are optional.
+type pppLayer struct {
+	layers.BaseLayer
+	Protocol uint16
+}
+
+func (p *pppLayer) LayerType() gopacket.LayerType {
+	return layers.LayerTypePPP
+}
+
+func (p *pppLayer) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypePPP
+}
+
+func (p *pppLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	offset := 0
+	if len(data) >= 2 && data[0] == 0xff && data[1] == 0x03 {
+		offset = 2
+	}
+	if len(data) < offset+2 {
+		df.SetTruncated()
+		return errTruncated
+	}
+
+	p.Protocol = binary.BigEndian.Uint16(data[offset : offset+2])
+	p.BaseLayer = layers.BaseLayer{Contents: data[:offset+2], Payload: data[offset+2:]}
+	return nil
+}
+
+func (p *pppLayer) NextLayerType() gopacket.LayerType {
+	return pppNextLayerType(p.Protocol)
+}
+
+func pppNextLayerType(proto uint16) gopacket.LayerType {
+	switch proto {
+	case pppProtoIPv4:
+		return layers.LayerTypeIPv4
+	case pppProtoIPv6:
+		return layers.LayerTypeIPv6
+	}
+	return gopacket.LayerTypePayload
+}
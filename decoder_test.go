@@ -0,0 +1,265 @@
+package netflow
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testSrcMAC = net.HardwareAddr{0x00, 0x16, 0x3e, 0x00, 0x00, 0x01}
+	testDstMAC = net.HardwareAddr{0x00, 0x16, 0x3e, 0x00, 0x00, 0x02}
+)
+
+func testIPAddr(ip string) ipAddr {
+	return newIPAddr(net.ParseIP(ip))
+}
+
+func testFlowKey(sip string, sport uint16, dip string, dport uint16) flowKey {
+	return newFlowKey(net.ParseIP(sip), sport, net.ParseIP(dip), dport, protoTCP)
+}
+
+// buildTestFrame serialize the layers from link layer to tcp/udp with payload.
+func buildTestFrame(t testing.TB, payload int, ls ...gopacket.SerializableLayer) []byte {
+	for _, l := range ls {
+		switch l4 := l.(type) {
+		case *layers.TCP:
+			l4.SetNetworkLayerForChecksum(ls[len(ls)-2].(gopacket.NetworkLayer))
+		case *layers.UDP:
+			l4.SetNetworkLayerForChecksum(ls[len(ls)-2].(gopacket.NetworkLayer))
+		}
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	ls = append(ls, gopacket.Payload(make([]byte, payload)))
+	err := gopacket.SerializeLayers(buf, opts, ls...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testIPv4(proto layers.IPProtocol) *layers.IPv4 {
+	return &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: proto,
+		SrcIP:    net.ParseIP("10.0.0.1").To4(),
+		DstIP:    net.ParseIP("10.0.0.2").To4(),
+	}
+}
+
+func testTCP() *layers.TCP {
+	return &layers.TCP{SrcPort: 9080, DstPort: 50000, ACK: true, Window: 1024}
+}
+
+func TestDecodeEthernetTCP(t *testing.T) {
+	data := buildTestFrame(t, 100,
+		&layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4},
+		testIPv4(layers.IPProtocolTCP),
+		testTCP(),
+	)
+
+	var meta packetMeta
+	d := newPacketDecoder(layers.LinkTypeEthernet)
+	assert.True(t, d.decode(data, &meta))
+	assert.Equal(t, testFlowKey("10.0.0.1", 9080, "10.0.0.2", 50000), meta.key)
+	assert.EqualValues(t, 20+20+100, meta.length)
+	assert.Equal(t, "10.0.0.1:9080_10.0.0.2:50000", meta.key.String())
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	data := buildTestFrame(t, 1400,
+		&layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4},
+		testIPv4(layers.IPProtocolTCP),
+		testTCP(),
+	)
+
+	// cut by the headers-only snaplen, the length comes from ip header.
+	var meta packetMeta
+	d := newPacketDecoder(layers.LinkTypeEthernet)
+	assert.True(t, d.decode(data[:defaultSnapLen], &meta))
+	assert.EqualValues(t, 20+20+1400, meta.length)
+	assert.EqualValues(t, 1400, meta.tcp.payload)
+
+	// tso packet has no total length.
+	data[14+2], data[14+3] = 0, 0
+	assert.True(t, d.decode(data, &meta))
+	assert.EqualValues(t, 20+20+1400, meta.length)
+}
+
+func TestDecodeSYN(t *testing.T) {
+	var (
+		meta packetMeta
+		d    = newPacketDecoder(layers.LinkTypeEthernet)
+		eth  = &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4}
+	)
+
+	syn := &layers.TCP{SrcPort: 50000, DstPort: 80, SYN: true, Window: 1024}
+	assert.True(t, d.decode(buildTestFrame(t, 0, eth, testIPv4(layers.IPProtocolTCP), syn), &meta))
+	assert.True(t, meta.opening())
+
+	// SYN-ACK and the later packets don't open connections.
+	synAck := &layers.TCP{SrcPort: 80, DstPort: 50000, SYN: true, ACK: true, Window: 1024}
+	assert.True(t, d.decode(buildTestFrame(t, 0, eth, testIPv4(layers.IPProtocolTCP), synAck), &meta))
+	assert.False(t, meta.opening())
+
+	assert.True(t, d.decode(buildTestFrame(t, 0, eth, testIPv4(layers.IPProtocolTCP), syn), &meta))
+	assert.True(t, d.decode(buildTestFrame(t, 10, eth, testIPv4(layers.IPProtocolTCP), testTCP()), &meta))
+	assert.False(t, meta.opening())
+}
+
+func TestDecodeVlanPPPoE(t *testing.T) {
+	data := buildTestFrame(t, 10,
+		&layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: 200, Type: layers.EthernetTypePPPoESession},
+		&layers.PPPoE{Version: 1, Type: 1, Code: layers.PPPoECodeSession, SessionId: 0x1234},
+		&layers.PPP{PPPType: layers.PPPTypeIPv4},
+		testIPv4(layers.IPProtocolTCP),
+		testTCP(),
+	)
+
+	var meta packetMeta
+	d := newPacketDecoder(layers.LinkTypeEthernet)
+	assert.True(t, d.decode(data, &meta))
+	assert.Equal(t, testFlowKey("10.0.0.1", 9080, "10.0.0.2", 50000), meta.key)
+	assert.EqualValues(t, 20+20+10, meta.length)
+	assert.EqualValues(t, 0x1234, d.pppoe.SessionID)
+}
+
+func TestDecodeIPv6UDP(t *testing.T) {
+	ip6 := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolUDP,
+		SrcIP:      net.ParseIP("fd00::1"),
+		DstIP:      net.ParseIP("fd00::2"),
+	}
+	data := buildTestFrame(t, 32,
+		&layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv6},
+		ip6,
+		&layers.UDP{SrcPort: 53, DstPort: 40000},
+	)
+
+	var meta packetMeta
+	d := newPacketDecoder(layers.LinkTypeEthernet)
+	assert.True(t, d.decode(data, &meta))
+	assert.Equal(t, protoUDP, meta.key.proto)
+	assert.Equal(t, testIPAddr("fd00::1"), meta.key.srcIP)
+	assert.EqualValues(t, 40000, meta.key.dstPort)
+	assert.EqualValues(t, 40+8+32, meta.length)
+}
+
+func TestDecodeNonIP(t *testing.T) {
+	arp := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   testSrcMAC,
+		SourceProtAddress: net.ParseIP("10.0.0.1").To4(),
+		DstHwAddress:      testDstMAC,
+		DstProtAddress:    net.ParseIP("10.0.0.2").To4(),
+	}
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeARP}, arp)
+	assert.Nil(t, err)
+
+	var meta packetMeta
+	d := newPacketDecoder(layers.LinkTypeEthernet)
+	assert.False(t, d.decode(buf.Bytes(), &meta))
+	assert.False(t, d.decode([]byte{0x01, 0x02}, &meta))
+}
+
+func TestFlowKeyMatchConnection(t *testing.T) {
+	line := "   1: 2E0010AC:E898 0100000A:0050 01 00000000:00000000 00:00000000 00000000     0        0 20114 1 0000000000000000 100 0 0 10 0"
+	conn := getConnectionItem(line)
+	assert.NotNil(t, conn)
+	assert.Equal(t, conn.Addr, conn.key.String())
+	assert.Equal(t, conn.ReverseAddr, conn.reverseKey.String())
+	assert.Equal(t, conn.key, conn.reverseKey.reverse())
+
+	ip, port := conn.key.local(outputSide)
+	assert.Equal(t, testIPAddr("172.16.0.46"), ip)
+	assert.EqualValues(t, 59544, port)
+
+	ip, port = conn.key.local(inputSide)
+	assert.Equal(t, testIPAddr("10.0.0.1"), ip)
+	assert.EqualValues(t, 80, port)
+}
+
+func TestHandlePacketSide(t *testing.T) {
+	nf := &Netflow{
+		bindAddrs: parseBindAddrs(map[string]nullObject{"10.0.0.1": {}}),
+	}
+	data := buildTestFrame(t, 0,
+		&layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4},
+		testIPv4(layers.IPProtocolTCP),
+		testTCP(),
+	)
+
+	var meta packetMeta
+	d := newPacketDecoder(layers.LinkTypeEthernet)
+	assert.True(t, nf.handlePacket(d, data, len(data), &meta, nil))
+	assert.Equal(t, outputSide, meta.side)
+
+	nf.bindAddrs = parseBindAddrs(map[string]nullObject{"10.0.0.2": {}})
+	assert.True(t, nf.handlePacket(d, data, len(data), &meta, nil))
+	assert.Equal(t, inputSide, meta.side)
+}
+
+func benchmarkFrame(b *testing.B) []byte {
+	return buildTestFrame(b, 1400,
+		&layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4},
+		testIPv4(layers.IPProtocolTCP),
+		testTCP(),
+	)
+}
+
+// BenchmarkDecodeFastPath is the capture path, it should be 0 allocs/op.
+func BenchmarkDecodeFastPath(b *testing.B) {
+	var (
+		data    = benchmarkFrame(b)
+		decoder = newPacketDecoder(layers.LinkTypeEthernet)
+		mapping = newConnMapping()
+		meta    packetMeta
+	)
+	mapping.add(testFlowKey("10.0.0.1", 9080, "10.0.0.2", 50000), "100")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !decoder.decode(data, &meta) {
+			b.Fatal("failed to decode")
+		}
+		mapping.get("", meta.key)
+	}
+}
+
+// BenchmarkDecodePacket is the old path, decode all layers and splice the key string.
+func BenchmarkDecodePacket(b *testing.B) {
+	var (
+		data    = benchmarkFrame(b)
+		mapping = make(map[string]string)
+	)
+	mapping["10.0.0.1:9080_10.0.0.2:50000"] = "100"
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+		ip, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		tcp, _ := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		addr := fmt.Sprintf("%s:%d_%s:%d", ip.SrcIP, tcp.SrcPort, ip.DstIP, tcp.DstPort)
+		_ = mapping[addr]
+	}
+}
@@ -0,0 +1,273 @@
+package netflow
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+const (
+	defaultDeviceWatchInterval = 5 * time.Second
+	deviceEventQueueSize       = 100
+)
+
+// the devices captured by default, matched by the prefix of name.
+//
+// wireguard can't be decrypted on the underlay, capture the plain packets on
+// its device, other tunnels are decapsulated on the underlay device.
+var captureDevicePrefixes = []string{"eth", "em", "enp", "eno", "ppp", "lo", "bond", "wg"}
+
+func isCaptureDevice(name string) bool {
+	for _, prefix := range captureDevicePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// DeviceEventType is the change of a capture device.
+type DeviceEventType string
+
+const (
+	// DeviceUp the capture of device is started.
+	DeviceUp DeviceEventType = "up"
+	// DeviceDown the capture of device is stopped, the device is removed or failed.
+	DeviceDown DeviceEventType = "down"
+	// DeviceAddrChanged the addresses of device are changed, eg: ppp redial.
+	DeviceAddrChanged DeviceEventType = "addr"
+)
+
+// DeviceEvent is emitted by the device watcher, see DeviceEvents.
+type DeviceEvent struct {
+	Type      DeviceEventType `json:"type"`
+	Device    string          `json:"device"`
+	Addrs     []string        `json:"addrs,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Timestamp int64           `json:"timestamp"`
+}
+
+func newDownEvent(dev string, err error) DeviceEvent {
+	ev := DeviceEvent{Type: DeviceDown, Device: dev}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	return ev
+}
+
+// WithDeviceWatchInterval set the interval to rescan devices and addresses.
+func WithDeviceWatchInterval(dur time.Duration) optionFunc {
+	return func(o *Netflow) error {
+		if dur <= 0 {
+			return errors.New("invalid device watch interval")
+		}
+
+		o.watchInterval = dur
+		return nil
+	}
+}
+
+// DeviceEvents return the events of devices, events are dropped when nobody reads them.
+func (nf *Netflow) DeviceEvents() <-chan DeviceEvent {
+	return nf.deviceEvents
+}
+
+func (nf *Netflow) emitDeviceEvent(ev DeviceEvent) {
+	ev.Timestamp = time.Now().Unix()
+	select {
+	case nf.deviceEvents <- ev:
+	default:
+		nf.logDebug("device event dropped ", ev.Type, " ", ev.Device)
+	}
+}
+
+// addrSet is the local addresses deciding the direction of packets, it's
+// replaced as a whole when addresses are changed, readers never lock.
+type addrSet struct {
+	v atomic.Value // map[ipAddr]nullObject
+}
+
+func newAddrSet(addrs map[ipAddr]nullObject) *addrSet {
+	s := &addrSet{}
+	s.store(addrs)
+	return s
+}
+
+func (s *addrSet) store(addrs map[ipAddr]nullObject) {
+	s.v.Store(addrs)
+}
+
+func (s *addrSet) contains(addr ipAddr) bool {
+	if s == nil {
+		return false
+	}
+
+	addrs, _ := s.v.Load().(map[ipAddr]nullObject)
+	_, ok := addrs[addr]
+	return ok
+}
+
+// deviceSnapshot is the devices found by pcap.
+type deviceSnapshot struct {
+	addrs map[string][]string // key -> device name, sorted addresses
+	ips   map[string]nullObject
+}
+
+func scanDevices(devs []pcap.Interface) deviceSnapshot {
+	snap := deviceSnapshot{
+		addrs: make(map[string][]string, len(devs)),
+		ips:   make(map[string]nullObject),
+	}
+
+	for _, dev := range devs {
+		addrs := make([]string, 0, len(dev.Addresses))
+		for _, addr := range dev.Addresses {
+			if addr.IP.IsMulticast() {
+				continue
+			}
+			addrs = append(addrs, addr.IP.String())
+			snap.ips[addr.IP.String()] = nullObject{}
+		}
+
+		sort.Strings(addrs)
+		snap.addrs[dev.Name] = addrs
+	}
+	return snap
+}
+
+// deviceCapture is the capture goroutine of a device.
+type deviceCapture struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (dc *deviceCapture) exited() bool {
+	select {
+	case <-dc.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// startCapture start the capture goroutine of device, the caller must hold deviceLock.
+func (nf *Netflow) startCapture(dev string) {
+	counter, ok := nf.devices[dev]
+	if !ok {
+		counter = newDeviceCounter(dev)
+		counter.series = newTrafficSeries(nf.retention)
+		nf.devices[dev] = counter
+	}
+
+	ctx, cancel := context.WithCancel(nf.ctx)
+	dc := &deviceCapture{cancel: cancel, done: make(chan struct{})}
+	nf.captures[dev] = dc
+
+	go func() {
+		defer close(dc.done)
+		nf.captureDevice(ctx, dev, counter)
+	}()
+}
+
+// stopCapture stop the capture goroutine of device, the caller must hold deviceLock.
+func (nf *Netflow) stopCapture(dev string) {
+	dc, ok := nf.captures[dev]
+	if !ok {
+		return
+	}
+
+	dc.cancel()
+	delete(nf.captures, dev)
+}
+
+// wantedDevices return the devices should be captured in the snapshot.
+func (nf *Netflow) wantedDevices(snap deviceSnapshot) map[string]nullObject {
+	wanted := make(map[string]nullObject)
+	for name := range snap.addrs {
+		if nf.staticDevices {
+			if _, ok := nf.bindDevices[name]; !ok {
+				continue
+			}
+		} else if !isCaptureDevice(name) {
+			continue
+		}
+		wanted[name] = nullObject{}
+	}
+	return wanted
+}
+
+// diffDevices return the devices to start and stop, the exited captures are restarted.
+func diffDevices(wanted map[string]nullObject, captures map[string]*deviceCapture) ([]string, []string) {
+	var start, stop []string
+	for name := range wanted {
+		dc, ok := captures[name]
+		if !ok || dc.exited() {
+			start = append(start, name)
+		}
+	}
+	for name := range captures {
+		if _, ok := wanted[name]; !ok {
+			stop = append(stop, name)
+		}
+	}
+
+	sort.Strings(start)
+	sort.Strings(stop)
+	return start, stop
+}
+
+// syncDevices apply the snapshot of devices, captures are started or stopped by
+// the diff, and the local addresses are replaced.
+func (nf *Netflow) syncDevices(snap deviceSnapshot) {
+	// keep the addresses when none is found, all packets would be inputs.
+	if !nf.staticIPs && len(snap.ips) != 0 {
+		nf.bindAddrs.store(parseAddrs(snap.ips))
+	}
+
+	nf.deviceLock.Lock()
+	defer nf.deviceLock.Unlock()
+
+	wanted := nf.wantedDevices(snap)
+	start, stop := diffDevices(wanted, nf.captures)
+	for _, dev := range stop {
+		nf.stopCapture(dev)
+	}
+	for _, dev := range start {
+		nf.startCapture(dev)
+	}
+
+	for name := range wanted {
+		addrs := strings.Join(snap.addrs[name], ",")
+		prev, ok := nf.deviceAddrs[name]
+		nf.deviceAddrs[name] = addrs
+		if ok && prev != addrs {
+			nf.emitDeviceEvent(DeviceEvent{Type: DeviceAddrChanged, Device: name, Addrs: snap.addrs[name]})
+		}
+	}
+}
+
+// watchDevices rescan devices periodically, netlink isn't used to keep it portable.
+func (nf *Netflow) watchDevices() {
+	ticker := time.NewTicker(nf.watchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-nf.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		devs, err := pcap.FindAllDevs()
+		if err != nil {
+			nf.logError("failed to find devices ", err)
+			continue
+		}
+		nf.syncDevices(scanDevices(devs))
+	}
+}
@@ -0,0 +1,135 @@
+package netflow
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/pcap"
+	"github.com/stretchr/testify/assert"
+)
+
+func testInterface(name string, ips ...string) pcap.Interface {
+	dev := pcap.Interface{Name: name}
+	for _, ip := range ips {
+		dev.Addresses = append(dev.Addresses, pcap.InterfaceAddress{IP: net.ParseIP(ip)})
+	}
+	return dev
+}
+
+func TestIsCaptureDevice(t *testing.T) {
+	for _, name := range []string{"eth0", "ens", "enp3s0", "ppp0", "lo", "bond0", "wg0"} {
+		assert.Equal(t, name != "ens", isCaptureDevice(name), name)
+	}
+	assert.False(t, isCaptureDevice("docker0"))
+	assert.False(t, isCaptureDevice("vxlan.calico"))
+}
+
+func TestScanDevices(t *testing.T) {
+	snap := scanDevices([]pcap.Interface{
+		testInterface("eth0", "10.0.0.2", "10.0.0.1", "224.0.0.1"),
+		testInterface("docker0"),
+	})
+
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, snap.addrs["eth0"])
+	assert.Equal(t, []string{}, snap.addrs["docker0"])
+	assert.Equal(t, map[string]nullObject{"10.0.0.1": {}, "10.0.0.2": {}}, snap.ips)
+}
+
+func TestAddrSet(t *testing.T) {
+	set := parseBindAddrs(map[string]nullObject{"10.0.0.1": {}, "invalid": {}})
+	assert.True(t, set.contains(testIPAddr("10.0.0.1")))
+	assert.False(t, set.contains(testIPAddr("10.0.0.2")))
+
+	set.store(parseAddrs(map[string]nullObject{"10.0.0.2": {}}))
+	assert.False(t, set.contains(testIPAddr("10.0.0.1")))
+	assert.True(t, set.contains(testIPAddr("10.0.0.2")))
+
+	var empty *addrSet
+	assert.False(t, empty.contains(testIPAddr("10.0.0.1")))
+}
+
+func TestDiffDevices(t *testing.T) {
+	exited := &deviceCapture{done: make(chan struct{})}
+	close(exited.done)
+
+	captures := map[string]*deviceCapture{
+		"eth0": {done: make(chan struct{})},
+		"ppp0": exited,
+		"ppp1": {done: make(chan struct{})},
+	}
+	wanted := map[string]nullObject{"eth0": {}, "ppp0": {}, "ppp2": {}}
+
+	start, stop := diffDevices(wanted, captures)
+	assert.Equal(t, []string{"ppp0", "ppp2"}, start)
+	assert.Equal(t, []string{"ppp1"}, stop)
+}
+
+func TestSyncDevices(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nf := &Netflow{
+		ctx:          ctx,
+		bindAddrs:    parseBindAddrs(map[string]nullObject{"100.64.0.1": {}}),
+		devices:      make(map[string]*deviceCounter),
+		captures:     make(map[string]*deviceCapture),
+		deviceAddrs:  make(map[string]string),
+		deviceEvents: make(chan DeviceEvent, deviceEventQueueSize),
+		capture:      newCaptureConfig(),
+	}
+	src := testIPAddr("100.64.0.1")
+	assert.True(t, nf.isBindAddr(src))
+
+	nf.syncDevices(scanDevices([]pcap.Interface{
+		testInterface("ppp-test0", "100.64.0.1"),
+		testInterface("docker0", "172.17.0.1"),
+	}))
+	assert.Contains(t, nf.devices, "ppp-test0")
+	assert.NotContains(t, nf.devices, "docker0")
+
+	// redial, the device is recreated with a new address.
+	nf.syncDevices(scanDevices([]pcap.Interface{
+		testInterface("ppp-test0", "100.64.0.2"),
+	}))
+	assert.False(t, nf.isBindAddr(src))
+	assert.True(t, nf.isBindAddr(testIPAddr("100.64.0.2")))
+
+	var addrEvents []DeviceEvent
+	for len(nf.deviceEvents) > 0 {
+		ev := <-nf.deviceEvents
+		if ev.Type == DeviceAddrChanged {
+			addrEvents = append(addrEvents, ev)
+		}
+	}
+	assert.Equal(t, 1, len(addrEvents))
+	assert.Equal(t, "ppp-test0", addrEvents[0].Device)
+	assert.Equal(t, []string{"100.64.0.2"}, addrEvents[0].Addrs)
+
+	// the device is gone.
+	nf.syncDevices(scanDevices(nil))
+	assert.Empty(t, nf.captures)
+	assert.Contains(t, nf.devices, "ppp-test0") // counters are kept
+
+	// the bind ips set by option are never refreshed.
+	nf.staticIPs = true
+	nf.syncDevices(scanDevices([]pcap.Interface{testInterface("eth-test0", "10.0.0.1")}))
+	assert.True(t, nf.isBindAddr(testIPAddr("100.64.0.2")))
+
+	nf.staticDevices = true
+	nf.bindDevices = map[string]nullObject{"eth-test1": {}}
+	nf.syncDevices(scanDevices([]pcap.Interface{testInterface("eth-test0"), testInterface("eth-test1")}))
+	assert.NotContains(t, nf.captures, "eth-test0")
+	assert.Contains(t, nf.captures, "eth-test1")
+}
+
+func TestDeviceEventsDropped(t *testing.T) {
+	nf := &Netflow{deviceEvents: make(chan DeviceEvent, 1)}
+	nf.emitDeviceEvent(DeviceEvent{Type: DeviceUp, Device: "eth0"})
+	nf.emitDeviceEvent(newDownEvent("eth0", errNotFound))
+
+	ev := <-nf.DeviceEvents()
+	assert.Equal(t, DeviceUp, ev.Type)
+	assert.NotZero(t, ev.Timestamp)
+	assert.Equal(t, 0, len(nf.deviceEvents))
+}
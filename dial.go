@@ -0,0 +1,209 @@
+package netflow
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rfyiamcool/go-netflow/rpc"
+)
+
+// DialStats is the traffic of a dial account, the session is the last pppoe
+// session seen of the account.
+type DialStats struct {
+	Account    string         `json:"account"`
+	PppoeName  string         `json:"pppoe_name"`
+	VLANID     string         `json:"vlan_id"`
+	MAC        string         `json:"mac"`
+	IP         string         `json:"ip"`
+	SessionID  uint16         `json:"session_id"`
+	Mode       AccountingMode `json:"mode"`
+	In         int64          `json:"in"`
+	Out        int64          `json:"out"`
+	InPackets  int64          `json:"in_packets"`
+	OutPackets int64          `json:"out_packets"`
+}
+
+type dialAccount struct {
+	info rpc.DialingInfo
+
+	// shared with the account of the same key after update.
+	counters *dialCounters
+}
+
+// dialCounters is accessed atomically.
+type dialCounters struct {
+	session    int64
+	in         int64
+	out        int64
+	inPackets  int64
+	outPackets int64
+}
+
+func (da *dialAccount) key() string {
+	return da.info.Account + "/" + da.info.PppoeName
+}
+
+func (da *dialAccount) increase(length int64, side sideOption, link *linkInfo) {
+	c := da.counters
+	if link.pppoe {
+		atomic.StoreInt64(&c.session, int64(link.session))
+	}
+
+	switch side {
+	case inputSide:
+		atomic.AddInt64(&c.in, length)
+		atomic.AddInt64(&c.inPackets, 1)
+	case outputSide:
+		atomic.AddInt64(&c.out, length)
+		atomic.AddInt64(&c.outPackets, 1)
+	}
+}
+
+func (da *dialAccount) stats(mode AccountingMode) DialStats {
+	c := da.counters
+	return DialStats{
+		Account:    da.info.Account,
+		PppoeName:  da.info.PppoeName,
+		VLANID:     da.info.VLANID,
+		MAC:        da.info.MAC,
+		IP:         da.info.IP,
+		SessionID:  uint16(atomic.LoadInt64(&c.session)),
+		Mode:       mode,
+		In:         atomic.LoadInt64(&c.in),
+		Out:        atomic.LoadInt64(&c.out),
+		InPackets:  atomic.LoadInt64(&c.inPackets),
+		OutPackets: atomic.LoadInt64(&c.outPackets),
+	}
+}
+
+// dialTable is read only after built, it's swapped when dialing info is updated.
+type dialTable struct {
+	accounts []*dialAccount
+
+	// the local mac of frame is the mac of dial, it's the most precise.
+	macs map[[6]byte]*dialAccount
+	// key -> "outer.inner" or "id" of vlan stack
+	vlans map[string]*dialAccount
+	// the local ip inside pppoe session
+	ips map[ipAddr]*dialAccount
+}
+
+// newDialTable index the dialing info of cards, counters of the same account are kept from prev.
+func newDialTable(cards []rpc.NetCardInfo, prev *dialTable) *dialTable {
+	dt := &dialTable{
+		macs:  make(map[[6]byte]*dialAccount),
+		vlans: make(map[string]*dialAccount),
+		ips:   make(map[ipAddr]*dialAccount),
+	}
+
+	olds := make(map[string]*dialAccount)
+	if prev != nil {
+		for _, da := range prev.accounts {
+			olds[da.key()] = da
+		}
+	}
+
+	for _, card := range cards {
+		for _, info := range card.DialingInfo {
+			da := &dialAccount{info: info, counters: new(dialCounters)}
+			if old, ok := olds[da.key()]; ok {
+				da.counters = old.counters
+			}
+			dt.accounts = append(dt.accounts, da)
+
+			if mac, err := net.ParseMAC(info.MAC); err == nil && len(mac) == 6 {
+				var key [6]byte
+				copy(key[:], mac)
+				dt.macs[key] = da
+			}
+			if vlan := strings.TrimSpace(info.VLANID); vlan != "" && vlan != "0" {
+				dt.vlans[vlan] = da
+			}
+			for _, ip := range []string{info.IP, info.V6IP} {
+				if parsed := net.ParseIP(ip); parsed != nil {
+					dt.ips[newIPAddr(parsed)] = da
+				}
+			}
+		}
+	}
+	return dt
+}
+
+// match find the dial account of packet by mac, vlan stack and local ip in order.
+func (dt *dialTable) match(link *linkInfo, meta *packetMeta) *dialAccount {
+	if link.hasMAC && len(dt.macs) != 0 {
+		if da, ok := dt.macs[link.localMAC(meta.side)]; ok {
+			return da
+		}
+	}
+
+	if link.vlanDepth != 0 && len(dt.vlans) != 0 {
+		inner := strconv.Itoa(int(link.vlans[link.vlanDepth-1]))
+		if link.vlanDepth > 1 {
+			stack := strconv.Itoa(int(link.vlans[0])) + "." + inner
+			if da, ok := dt.vlans[stack]; ok {
+				return da
+			}
+		}
+		if da, ok := dt.vlans[inner]; ok {
+			return da
+		}
+	}
+
+	ip, _ := meta.key.local(meta.side)
+	return dt.ips[ip]
+}
+
+// WithDialingInfo count the traffic of dial accounts, see UpdateDialingInfo.
+func WithDialingInfo(cards []rpc.NetCardInfo) optionFunc {
+	return func(o *Netflow) error {
+		o.UpdateDialingInfo(cards)
+		return nil
+	}
+}
+
+// UpdateDialingInfo replace the dial accounts, eg: the result of rpc GetDialingInfo,
+// packets are matched by the mac of dial, vlan id and the ip of dial.
+func (nf *Netflow) UpdateDialingInfo(cards []rpc.NetCardInfo) {
+	prev, _ := nf.dials.Load().(*dialTable)
+	nf.dials.Store(newDialTable(cards, prev))
+}
+
+// increaseDial count the packet into the dial account, the link info is only
+// decoded when dialing info is set.
+func (nf *Netflow) increaseDial(decoder *packetDecoder, meta *packetMeta) {
+	dt, _ := nf.dials.Load().(*dialTable)
+	if dt == nil || len(dt.accounts) == 0 {
+		return
+	}
+
+	var link linkInfo
+	decoder.link(&link)
+	if da := dt.match(&link, meta); da != nil {
+		da.increase(meta.length, meta.side, &link)
+	}
+}
+
+// GetDialStats return the traffic of dial accounts, sorted by account.
+func (nf *Netflow) GetDialStats() []DialStats {
+	dt, _ := nf.dials.Load().(*dialTable)
+	if dt == nil {
+		return nil
+	}
+
+	res := make([]DialStats, 0, len(dt.accounts))
+	for _, da := range dt.accounts {
+		res = append(res, da.stats(nf.accounting))
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Account == res[j].Account {
+			return res[i].PppoeName < res[j].PppoeName
+		}
+		return res[i].Account < res[j].Account
+	})
+	return res
+}
@@ -0,0 +1,147 @@
+package netflow
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/rfyiamcool/go-netflow/rpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func buildQinQPPPoEFrame(t *testing.T, srcMAC net.HardwareAddr, outer, inner uint16) []byte {
+	return buildTestFrame(t, 100,
+		&layers.Ethernet{SrcMAC: srcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeQinQ},
+		&layers.Dot1Q{VLANIdentifier: outer, Type: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: inner, Type: layers.EthernetTypePPPoESession},
+		&layers.PPPoE{Version: 1, Type: 1, Code: layers.PPPoECodeSession, SessionId: 0x0a0b},
+		&layers.PPP{PPPType: layers.PPPTypeIPv4},
+		testIPv4(layers.IPProtocolTCP),
+		testTCP(),
+	)
+}
+
+func TestDecodeLinkInfo(t *testing.T) {
+	var (
+		d    = newPacketDecoder(layers.LinkTypeEthernet)
+		meta packetMeta
+		link linkInfo
+	)
+
+	assert.True(t, d.decode(buildQinQPPPoEFrame(t, testSrcMAC, 100, 200), &meta))
+	d.link(&link)
+	assert.Equal(t, 2, link.vlanDepth)
+	assert.Equal(t, [maxVlanDepth]uint16{100, 200}, link.vlans)
+	assert.True(t, link.pppoe)
+	assert.EqualValues(t, 0x0a0b, link.session)
+	mac := link.localMAC(outputSide)
+	assert.Equal(t, testSrcMAC.String(), net.HardwareAddr(mac[:]).String())
+
+	// the state of last packet is reset.
+	data := buildTestFrame(t, 0,
+		&layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4},
+		testIPv4(layers.IPProtocolTCP),
+		testTCP(),
+	)
+	assert.True(t, d.decode(data, &meta))
+	d.link(&link)
+	assert.Equal(t, 0, link.vlanDepth)
+	assert.False(t, link.pppoe)
+
+	// discovery frames carry no ip packet.
+	disc := buildTestFrame(t, 0,
+		&layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypePPPoEDiscovery},
+		&layers.PPPoE{Version: 1, Type: 1, Code: layers.PPPoECodePADS, SessionId: 0x0a0b},
+	)
+	assert.False(t, d.decode(disc, &meta))
+}
+
+func TestDialAccounting(t *testing.T) {
+	macA := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x0a}
+	cards := []rpc.NetCardInfo{
+		{
+			Name: "eth0",
+			DialingInfo: []rpc.DialingInfo{
+				{Account: "a", PppoeName: "ppp0", MAC: macA.String()},
+				{Account: "b", PppoeName: "ppp1", VLANID: "100.200"},
+				{Account: "c", PppoeName: "ppp2", VLANID: "300"},
+				{Account: "d", PppoeName: "ppp3", IP: "10.0.0.1"},
+			},
+		},
+	}
+
+	nf := &Netflow{
+		accounting: AccountL3,
+		bindAddrs:  parseBindAddrs(map[string]nullObject{"10.0.0.1": {}}),
+	}
+	assert.Nil(t, WithDialingInfo(cards)(nf))
+
+	var (
+		d    = newPacketDecoder(layers.LinkTypeEthernet)
+		meta packetMeta
+	)
+	frames := [][]byte{
+		buildQinQPPPoEFrame(t, macA, 100, 200),       // a by mac
+		buildQinQPPPoEFrame(t, testSrcMAC, 100, 200), // b by vlan stack
+		buildQinQPPPoEFrame(t, testSrcMAC, 1, 300),   // c by inner vlan
+		buildQinQPPPoEFrame(t, testSrcMAC, 1, 2),     // d by ip
+	}
+	for _, frame := range frames {
+		assert.True(t, nf.handlePacket(d, frame, len(frame), &meta, nil))
+	}
+
+	stats := nf.GetDialStats()
+	assert.Equal(t, 4, len(stats))
+	for _, st := range stats {
+		assert.EqualValues(t, 20+20+100, st.Out, st.Account)
+		assert.EqualValues(t, 1, st.OutPackets, st.Account)
+		assert.EqualValues(t, 0x0a0b, st.SessionID, st.Account)
+	}
+
+	// counters are kept after update.
+	cards[0].DialingInfo = cards[0].DialingInfo[:1]
+	nf.UpdateDialingInfo(cards)
+	stats = nf.GetDialStats()
+	assert.Equal(t, 1, len(stats))
+	assert.Equal(t, "a", stats[0].Account)
+	assert.EqualValues(t, 1, stats[0].OutPackets)
+}
+
+func TestDialPcapFilter(t *testing.T) {
+	cards := []rpc.NetCardInfo{
+		{Name: "eth0", DialingInfo: []rpc.DialingInfo{{Account: "b", PppoeName: "ppp1", VLANID: "100.200"}}},
+	}
+	nf := &Netflow{
+		accounting: AccountL3,
+		bindAddrs:  parseBindAddrs(map[string]nullObject{"10.0.0.1": {}}),
+		forwards:   newFlowTable(),
+	}
+	assert.Nil(t, WithDialingInfo(cards)(nf))
+
+	bpf, err := pcap.NewBPF(layers.LinkTypeEthernet, defaultSnapLen, defaultPcapFilter)
+	assert.Nil(t, err)
+
+	var (
+		d     = newPacketDecoder(layers.LinkTypeEthernet)
+		meta  packetMeta
+		frame = buildQinQPPPoEFrame(t, testSrcMAC, 100, 200)
+		ci    = gopacket.CaptureInfo{CaptureLength: len(frame), Length: len(frame)}
+	)
+	assert.True(t, bpf.Matches(ci, frame))
+	assert.True(t, nf.handlePacket(d, frame, ci.Length, &meta, nil))
+
+	stats := nf.GetDialStats()
+	assert.Equal(t, 1, len(stats))
+	assert.EqualValues(t, 1, stats[0].OutPackets)
+
+	// broadcast frames are still dropped.
+	frame = buildTestFrame(t, 0,
+		&layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeIPv4},
+		testIPv4(layers.IPProtocolTCP),
+		testTCP(),
+	)
+	assert.False(t, bpf.Matches(gopacket.CaptureInfo{CaptureLength: len(frame), Length: len(frame)}, frame))
+}
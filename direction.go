@@ -0,0 +1,60 @@
+package netflow
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// captureDirection return the direction of packet, it's of the pcap handler
+// when it's opened with a direction, or of the linux cooked header, eg: the
+// any device. pcap.DirectionInOut means it's unknown.
+func captureDirection(decoder *packetDecoder) pcap.Direction {
+	if decoder.direction != pcap.DirectionInOut {
+		return decoder.direction
+	}
+
+	pktType, ok := decoder.packetType()
+	switch {
+	case !ok:
+		return pcap.DirectionInOut
+	case pktType == layers.LinuxSLLPacketTypeOutgoing:
+		return pcap.DirectionOut
+	default:
+		return pcap.DirectionIn
+	}
+}
+
+// classifySide decide the direction of packet by the local addresses, the
+// capture direction and conntrack, ok is false when the packet is a duplicate
+// which shouldn't be counted. loopback packets are output, the receiving
+// socket is counted by the worker, see packetMeta.loopback.
+func (nf *Netflow) classifySide(decoder *packetDecoder, key flowKey) (sideOption, bool) {
+	pktType, hasType := decoder.packetType()
+	if hasType && pktType == layers.LinuxSLLPacketTypeOtherhost {
+		// not sent to this host, eg: promisc mode on a mirrored port.
+		return forwardSide, true
+	}
+
+	srcLocal, dstLocal := nf.isBindAddr(key.srcIP), nf.isBindAddr(key.dstIP)
+	switch {
+	case srcLocal && dstLocal:
+		// libpcap may skip the sent copy of loopback, the received one is
+		// always delivered, so it's the copy counted.
+		if captureDirection(decoder) == pcap.DirectionOut {
+			return 0, false
+		}
+		return outputSide, true
+
+	case srcLocal:
+		return outputSide, true
+
+	case dstLocal:
+		return inputSide, true
+	}
+
+	// the local address is translated, eg: dnat to a local process.
+	if side, ok := nf.conntrack.side(key, nf.bindAddrs); ok {
+		return side, true
+	}
+	return forwardSide, true
+}
@@ -0,0 +1,219 @@
+package netflow
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/stretchr/testify/assert"
+)
+
+// buildSLLFrame prepend the linux cooked header to the ip packet.
+func buildSLLFrame(t *testing.T, pktType layers.LinuxSLLPacketType, sip, dip string) []byte {
+	ip := testIPv4(layers.IPProtocolTCP)
+	ip.SrcIP, ip.DstIP = net.ParseIP(sip).To4(), net.ParseIP(dip).To4()
+	packet := buildTestFrame(t, 100, ip, testTCP())
+
+	header := make([]byte, 16)
+	binary.BigEndian.PutUint16(header[0:2], uint16(pktType))
+	binary.BigEndian.PutUint16(header[2:4], 772) // loopback
+	binary.BigEndian.PutUint16(header[14:16], uint16(layers.EthernetTypeIPv4))
+	return append(header, packet...)
+}
+
+func newDirectionNetflow(locals ...string) *Netflow {
+	addrs := make(map[string]nullObject)
+	for _, ip := range locals {
+		addrs[ip] = nullObject{}
+	}
+
+	return &Netflow{
+		bindAddrs:  parseBindAddrs(addrs),
+		forwards:   newFlowTable(),
+		accounting: AccountL3,
+	}
+}
+
+func TestClassifySideLoopback(t *testing.T) {
+	var (
+		nf      = newDirectionNetflow("127.0.0.1")
+		counter = newDeviceCounter("any")
+		d       = newPacketDecoder(layers.LinkTypeLinuxSLL)
+		meta    packetMeta
+	)
+
+	// the any device may see the sent and the received copy of loopback
+	// packets, the received one is counted for both sockets.
+	sent := buildSLLFrame(t, layers.LinuxSLLPacketTypeOutgoing, "127.0.0.1", "127.0.0.1")
+	received := buildSLLFrame(t, layers.LinuxSLLPacketTypeHost, "127.0.0.1", "127.0.0.1")
+
+	assert.False(t, nf.handlePacket(d, sent, len(sent), &meta, counter))
+	assert.True(t, nf.handlePacket(d, received, len(received), &meta, counter))
+	assert.Equal(t, outputSide, meta.side)
+	assert.True(t, meta.loopback)
+
+	stats := counter.stats(AccountL3)
+	assert.EqualValues(t, 1, stats.OutPackets)
+	assert.EqualValues(t, 0, stats.InPackets)
+	assert.EqualValues(t, 0, stats.Ignored)
+
+	// not sent to this host, eg: mirrored traffic.
+	other := buildSLLFrame(t, layers.LinuxSLLPacketTypeOtherhost, "127.0.0.1", "10.0.0.2")
+	assert.True(t, nf.handlePacket(d, other, len(other), &meta, counter))
+	assert.Equal(t, forwardSide, meta.side)
+	assert.False(t, meta.loopback)
+}
+
+func TestCaptureDirection(t *testing.T) {
+	var (
+		nf   = newDirectionNetflow("127.0.0.1", "10.0.0.1")
+		meta packetMeta
+	)
+
+	// lo is ethernet, the direction is of the handler.
+	data := buildTestFrame(t, 100,
+		&layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4},
+		&layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IPv4(127, 0, 0, 1), DstIP: net.IPv4(127, 0, 0, 1)},
+		testTCP(),
+	)
+	out := newPacketDecoder(layers.LinkTypeEthernet)
+	out.direction = pcap.DirectionOut
+	assert.False(t, nf.handlePacket(out, data, len(data), &meta, nil))
+
+	in := newPacketDecoder(layers.LinkTypeEthernet)
+	in.direction = pcap.DirectionIn
+	assert.True(t, nf.handlePacket(in, data, len(data), &meta, nil))
+	assert.True(t, meta.loopback)
+
+	assert.Equal(t, pcap.DirectionInOut, captureDirection(newPacketDecoder(layers.LinkTypeEthernet)))
+	assert.Equal(t, pcap.DirectionIn, captureDirection(in))
+}
+
+func TestLoopbackBySocket(t *testing.T) {
+	nf := newDirectionNetflow("127.0.0.1")
+	nf.connInodeHash = newConnMapping()
+	nf.processHash = NewProcessController(context.Background())
+	nf.serviceHash = newServiceController()
+	nf.tcpSeries = newTrafficSeries(defaultRetention)
+	nf.sendQueues = newSendQueueTable()
+
+	client := &Process{Pid: "1", Name: "curl"}
+	server := &Process{Pid: "2", Name: "nginx"}
+	nf.processHash.Add("1", client)
+	nf.processHash.Add("2", server)
+	nf.processHash.inodePidMap["100"] = "1"
+	nf.processHash.inodePidMap["200"] = "2"
+
+	// both ends are in the socket table, the reversed tuple of one is the other.
+	var (
+		request = testFlowKey("127.0.0.1", 50000, "127.0.0.1", 80)
+		items   = []*ConnectionItem{
+			{Inode: "100", State: "ESTABLISHED", key: request, reverseKey: request.reverse()},
+			{Inode: "200", State: "ESTABLISHED", key: request.reverse(), reverseKey: request},
+		}
+	)
+	nf.addConns(time.Now().Unix(), items, newConnCounter(nf.processHash, true))
+
+	var (
+		w    = newPacketWorker(0, minWorkerQueueSize, 1)
+		meta = packetMeta{key: request, length: 100, packets: 1, side: outputSide, loopback: true}
+	)
+	nf.handleMeta(w, &meta)
+	meta.side = inputSide
+	nf.handleMeta(w, &meta)
+
+	flows := w.flows.snapshot(time.Now().Unix(), nil)
+	sort.Slice(flows, func(i, j int) bool { return flows[i].Pid < flows[j].Pid })
+	assert.Equal(t, 2, len(flows))
+
+	assert.Equal(t, "1", flows[0].Pid)
+	assert.Equal(t, "127.0.0.1:50000", flows[0].Local)
+	assert.EqualValues(t, 100, flows[0].Out)
+	assert.EqualValues(t, 0, flows[0].In)
+
+	assert.Equal(t, "2", flows[1].Pid)
+	assert.Equal(t, "127.0.0.1:80", flows[1].Local)
+	assert.EqualValues(t, 0, flows[1].Out)
+	assert.EqualValues(t, 100, flows[1].In)
+}
+
+func TestClassifySideForward(t *testing.T) {
+	var (
+		nf      = newDirectionNetflow("192.168.0.254")
+		counter = newDeviceCounter("eth0")
+		d       = newPacketDecoder(layers.LinkTypeEthernet)
+		meta    packetMeta
+	)
+	nf.workers = newPacketWorkers(4, 0, 0)
+
+	data := buildTestFrame(t, 100,
+		&layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4},
+		testIPv4(layers.IPProtocolTCP),
+		testTCP(),
+	)
+	assert.True(t, nf.handlePacket(d, data, len(data), &meta, counter))
+	assert.Equal(t, forwardSide, meta.side)
+	nf.enqueueForward(meta)
+
+	reply := testIPv4(layers.IPProtocolTCP)
+	reply.SrcIP, reply.DstIP = reply.DstIP, reply.SrcIP
+	data = buildTestFrame(t, 200,
+		&layers.Ethernet{SrcMAC: testDstMAC, DstMAC: testSrcMAC, EthernetType: layers.EthernetTypeIPv4},
+		reply,
+		&layers.TCP{SrcPort: 50000, DstPort: 9080, ACK: true, Window: 1024},
+	)
+	assert.True(t, nf.handlePacket(d, data, len(data), &meta, counter))
+	nf.enqueueForward(meta)
+
+	stats := counter.stats(AccountL3)
+	assert.EqualValues(t, 140+240, stats.Forwarded)
+	assert.EqualValues(t, 2, stats.ForwardedPackets)
+	assert.EqualValues(t, 0, stats.In+stats.Out)
+
+	// both directions are handled in order by the worker of the flow.
+	w := pickWorker(nf.workers, meta.key)
+	assert.Equal(t, 2, len(w.queue))
+	for len(w.queue) > 0 {
+		m := <-w.queue
+		nf.handleMeta(w, &m)
+	}
+
+	// both directions are one forwarded flow.
+	flows := nf.GetForwardRank(10)
+	assert.Equal(t, 1, len(flows))
+	assert.Equal(t, "10.0.0.1:9080", flows[0].Local)
+	assert.Equal(t, "10.0.0.2:50000", flows[0].Remote)
+	assert.EqualValues(t, 140, flows[0].Out)
+	assert.EqualValues(t, 240, flows[0].In)
+	assert.EqualValues(t, 1, flows[0].SampleRate)
+}
+
+func TestClassifySideConntrack(t *testing.T) {
+	var (
+		nf = newDirectionNetflow("10.0.0.2")
+		d  = newPacketDecoder(layers.LinkTypeEthernet)
+	)
+
+	// the vip 10.0.0.1:9080 is translated to the local 10.0.0.2:80.
+	ent, ok := parseConntrackLine("ipv4 2 tcp 6 300 ESTABLISHED src=10.0.0.3 dst=10.0.0.1 sport=50000 dport=9080 " +
+		"src=10.0.0.2 dst=10.0.0.3 sport=80 dport=50000 [ASSURED] mark=0 use=1")
+	assert.True(t, ok)
+
+	key := testFlowKey("10.0.0.3", 50000, "10.0.0.1", 9080)
+	side, ok := nf.classifySide(d, key)
+	assert.True(t, ok)
+	assert.Equal(t, forwardSide, side)
+
+	nf.conntrack = newConntrackTable(conntrackFile)
+	nf.conntrack.store([]*conntrackEntry{ent})
+
+	side, _ = nf.classifySide(d, key)
+	assert.Equal(t, inputSide, side)
+	side, _ = nf.classifySide(d, key.reverse())
+	assert.Equal(t, outputSide, side)
+}
@@ -0,0 +1,193 @@
+package netflow
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// flows idle longer than it are removed.
+	flowExpiration    = int64(maxRingSize)
+	flowSweepInterval = int64(10)
+)
+
+// Flow is the traffic of a connection since it's seen, Local is the endpoint on this host,
+// for forwarded flows Local is the smaller endpoint, In and Out are relative to it.
+type Flow struct {
+	Local      string         `json:"local"`
+	Remote     string         `json:"remote"`
+	Pid        string         `json:"pid"`
+	Name       string         `json:"name"`
+	In         int64          `json:"in"`
+	Out        int64          `json:"out"`
+	Packets    int64          `json:"packets"`
+	LastSeen   int64          `json:"last_seen"`
+	Mode       AccountingMode `json:"mode"`
+	SampleRate float64        `json:"sample_rate"`
+
+	// health of tcp flows since it's seen, nil for udp.
+	TCP *TCPHealth `json:"tcp,omitempty"`
+}
+
+type flowEntry struct {
+	in       int64
+	out      int64
+	packets  int64
+	lastSeen int64
+	pid      string
+	name     string
+
+	// created by the first tcp packet of flow.
+	tcp *tcpFlow
+}
+
+// flowTable is written by one worker, the lock is only contended by GetFlowRank.
+type flowTable struct {
+	sync.Mutex
+
+	// key is oriented as local -> remote
+	dict      map[flowKey]*flowEntry
+	lastSweep int64
+}
+
+func newFlowTable() *flowTable {
+	return &flowTable{
+		dict: make(map[flowKey]*flowEntry, 1000),
+	}
+}
+
+// increase count the packet into its flow, the tcp health counters of the
+// packet are returned.
+func (ft *flowTable) increase(meta *packetMeta, proc *Process) tcpCounters {
+	return ft.increaseAt(time.Now().Unix(), meta, proc)
+}
+
+func (ft *flowTable) increaseAt(now int64, meta *packetMeta, proc *Process) tcpCounters {
+	key, side := meta.key, meta.side
+	switch side {
+	case inputSide:
+		key = key.reverse()
+	case forwardSide:
+		// both directions of forwarded flow share the ordered key.
+		side = outputSide
+		if rkey := key.reverse(); rkey.less(key) {
+			key, side = rkey, inputSide
+		}
+	}
+
+	ft.Lock()
+	defer ft.Unlock()
+
+	if now-ft.lastSweep >= flowSweepInterval {
+		ft.sweep(now)
+		ft.lastSweep = now
+	}
+
+	ent, ok := ft.dict[key]
+	if !ok {
+		ent = &flowEntry{}
+		ft.dict[key] = ent
+	}
+
+	switch side {
+	case inputSide:
+		ent.in += meta.length
+	case outputSide:
+		ent.out += meta.length
+	}
+	ent.packets += meta.packets
+	ent.lastSeen = now
+
+	if proc != nil && ent.pid == "" {
+		ent.pid, ent.name = proc.Pid, proc.Name
+	}
+
+	if key.proto != protoTCP {
+		return tcpCounters{}
+	}
+	if ent.tcp == nil {
+		ent.tcp = new(tcpFlow)
+	}
+	dir := 0
+	if side == inputSide {
+		dir = 1
+	}
+	return ent.tcp.observe(dir, meta.side == outputSide, meta)
+}
+
+// sweep remove idle flows, the caller must hold the lock.
+func (ft *flowTable) sweep(now int64) {
+	for key, ent := range ft.dict {
+		if now-ent.lastSeen > flowExpiration {
+			delete(ft.dict, key)
+		}
+	}
+}
+
+func (ft *flowTable) snapshot(now int64, res []*Flow) []*Flow {
+	ft.Lock()
+	defer ft.Unlock()
+
+	for key, ent := range ft.dict {
+		if now-ent.lastSeen > flowExpiration {
+			continue
+		}
+
+		flow := &Flow{
+			Local:    key.srcIP.String() + ":" + strconv.Itoa(int(key.srcPort)),
+			Remote:   key.dstIP.String() + ":" + strconv.Itoa(int(key.dstPort)),
+			Pid:      ent.pid,
+			Name:     ent.name,
+			In:       ent.in,
+			Out:      ent.out,
+			Packets:  ent.packets,
+			LastSeen: ent.lastSeen,
+		}
+		if ent.tcp != nil {
+			health := ent.tcp.total.health()
+			flow.TCP = &health
+		}
+		res = append(res, flow)
+	}
+	return res
+}
+
+// GetFlowRank return the top active flows by bytes.
+func (nf *Netflow) GetFlowRank(limit int) []*Flow {
+	var (
+		now   = time.Now().Unix()
+		flows = make([]*Flow, 0, 100)
+	)
+
+	for _, w := range nf.workers {
+		flows = w.flows.snapshot(now, flows)
+	}
+	return nf.rankFlows(flows, limit, nf.sampleRate())
+}
+
+// GetForwardRank return the top flows routed by this host, they're counted
+// before sampling.
+func (nf *Netflow) GetForwardRank(limit int) []*Flow {
+	flows := nf.forwards.snapshot(time.Now().Unix(), make([]*Flow, 0, 100))
+	return nf.rankFlows(flows, limit, 1)
+}
+
+func (nf *Netflow) rankFlows(flows []*Flow, limit int, rate float64) []*Flow {
+	sort.Slice(flows, func(i, j int) bool {
+		return flows[i].In+flows[i].Out > flows[j].In+flows[j].Out
+	})
+	if len(flows) > limit {
+		flows = flows[:limit]
+	}
+
+	for _, flow := range flows {
+		flow.Mode = nf.accounting
+		flow.SampleRate = rate
+		if flow.TCP != nil {
+			flow.TCP.SampleRate = rate
+		}
+	}
+	return flows
+}
@@ -0,0 +1,58 @@
+package netflow
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlowTable(t *testing.T) {
+	var (
+		ft  = newFlowTable()
+		now = int64(1700000000)
+		po  = &Process{Pid: "100", Name: "Nginx"}
+		key = testFlowKey("10.0.0.1", 9080, "10.0.0.2", 50000)
+	)
+
+	// both directions are folded into one flow of local -> remote.
+	ft.increaseAt(now, &packetMeta{key: key, length: 300, side: outputSide, packets: 1}, nil)
+	ft.increaseAt(now, &packetMeta{key: key.reverse(), length: 100, side: inputSide, packets: 1}, po)
+
+	flows := ft.snapshot(now, nil)
+	assert.Equal(t, 1, len(flows))
+	assert.Equal(t, "10.0.0.1:9080", flows[0].Local)
+	assert.Equal(t, "10.0.0.2:50000", flows[0].Remote)
+	assert.EqualValues(t, 100, flows[0].In)
+	assert.EqualValues(t, 300, flows[0].Out)
+	assert.EqualValues(t, 2, flows[0].Packets)
+	assert.Equal(t, "100", flows[0].Pid)
+
+	// sampled packets are scaled up as the bytes.
+	ft.increaseAt(now, &packetMeta{key: key, length: 3000, side: outputSide, packets: 10}, nil)
+	flows = ft.snapshot(now, nil)
+	assert.EqualValues(t, 3300, flows[0].Out)
+	assert.EqualValues(t, 12, flows[0].Packets)
+
+	// idle flows are hidden, then removed by sweep.
+	later := now + flowExpiration + 1
+	assert.Equal(t, 0, len(ft.snapshot(later, nil)))
+	ft.increaseAt(later, &packetMeta{key: testFlowKey("10.0.0.1", 9080, "10.0.0.3", 50000), length: 1, side: outputSide}, nil)
+	assert.Equal(t, 1, len(ft.dict))
+}
+
+func TestGetFlowRank(t *testing.T) {
+	nf := &Netflow{accounting: AccountL2}
+	nf.workers = newPacketWorkers(2, 0, 0)
+
+	for port := uint16(1); port <= 10; port++ {
+		meta := packetMeta{key: testFlowKey("10.0.0.1", 9080, "10.0.0.2", 50000+port), length: int64(port), side: outputSide}
+		pickWorker(nf.workers, meta.key).flows.increase(&meta, nil)
+	}
+
+	flows := nf.GetFlowRank(3)
+	assert.Equal(t, 3, len(flows))
+	assert.EqualValues(t, 10, flows[0].Out)
+	assert.Equal(t, "10.0.0.2:50010", flows[0].Remote)
+	assert.Equal(t, AccountL2, flows[0].Mode)
+	assert.EqualValues(t, 1, flows[0].SampleRate)
+}
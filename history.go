@@ -0,0 +1,250 @@
+package netflow
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// 1s for a minute, 1m for an hour and 1h for a day.
+	defaultRetention = Retention{
+		Seconds: time.Minute,
+		Minutes: time.Hour,
+		Hours:   24 * time.Hour,
+	}
+
+	errInvalidWindow = errors.New("invalid window, it must be within retention")
+)
+
+// Retention is how long the traffic history is kept at 1s, 1m and 1h
+// resolution, a zero tier is disabled.
+type Retention struct {
+	Seconds time.Duration
+	Minutes time.Duration
+	Hours   time.Duration
+}
+
+func (r Retention) tiers() []*trafficRing {
+	var rings []*trafficRing
+	for _, tier := range []struct {
+		keep time.Duration
+		step time.Duration
+	}{
+		{r.Seconds, time.Second},
+		{r.Minutes, time.Minute},
+		{r.Hours, time.Hour},
+	} {
+		if tier.keep <= 0 {
+			continue
+		}
+		// one more bucket is being written.
+		size := int(tier.keep/tier.step) + 1
+		ring := newStepRing(int64(tier.step/time.Second), size)
+		if len(rings) > 0 {
+			rings[len(rings)-1].next = ring
+		}
+		rings = append(rings, ring)
+	}
+	return rings
+}
+
+// window return the longest window can be queried, it's 61 seconds by 1s
+// resolution only.
+func (r Retention) window() int {
+	var max int64
+	for _, tier := range r.tiers() {
+		if n := tier.span() + tier.step; n > max {
+			max = n
+		}
+	}
+	return int(max)
+}
+
+// WithRetention keep the traffic history of processes, services and devices
+// at multiple resolutions, the finer buckets are rolled up when they expire.
+func WithRetention(r Retention) optionFunc {
+	return func(o *Netflow) error {
+		if r.Seconds < time.Second {
+			return errors.New("the retention of 1s resolution must >= 1s")
+		}
+		if r.Minutes < 0 || r.Hours < 0 {
+			return errors.New("invalid retention")
+		}
+
+		o.retention = r
+		o.processHash.retention = r
+		o.serviceHash.retention = r
+		return nil
+	}
+}
+
+// trafficSeries is the traffic of a process, a service or a device kept in
+// tiers of rings, the traffic is counted into the finest tier and rolled up
+// into the coarser ones on rotation. the finest tier covering the window is
+// queried with the finer buckets not rolled up yet.
+type trafficSeries struct {
+	tiers []*trafficRing
+}
+
+func newTrafficSeries(r Retention) *trafficSeries {
+	return &trafficSeries{tiers: r.tiers()}
+}
+
+func (s *trafficSeries) increase(n int64, side sideOption) {
+	s.increaseAt(time.Now().Unix(), n, side)
+}
+
+func (s *trafficSeries) increaseAt(now int64, n int64, side sideOption) {
+	s.tiers[0].increaseAt(now, n, side)
+}
+
+func (s *trafficSeries) increaseOuter(n int64, side sideOption) {
+	s.tiers[0].increaseOuterAt(time.Now().Unix(), n, side)
+}
+
+func (s *trafficSeries) increasePackets(n int64, side sideOption) {
+	s.increasePacketsAt(time.Now().Unix(), n, side)
+}
+
+func (s *trafficSeries) increasePacketsAt(now int64, n int64, side sideOption) {
+	s.tiers[0].increasePacketsAt(now, n, side)
+}
+
+func (s *trafficSeries) increaseConns(n int64, side sideOption) {
+	s.tiers[0].increaseConnsAt(time.Now().Unix(), n, side)
+}
+
+func (s *trafficSeries) increaseTCP(c *tcpCounters) {
+	s.increaseTCPAt(time.Now().Unix(), c)
+}
+
+func (s *trafficSeries) increaseTCPAt(now int64, c *tcpCounters) {
+	s.tiers[0].increaseTCPAt(now, c)
+}
+
+func (s *trafficSeries) increaseBacklogAt(now int64, tx, rx int64) {
+	s.tiers[0].increaseBacklogAt(now, tx, rx)
+}
+
+func (s *trafficSeries) increaseSocketsAt(now int64, n int64) {
+	s.tiers[0].increaseSocketsAt(now, n)
+}
+
+// last return the bucket of the latest second.
+func (s *trafficSeries) last() *trafficEntry {
+	return s.tiers[0].last()
+}
+
+// entries return the buckets of 1s resolution.
+func (s *trafficSeries) entries() []*trafficEntry {
+	return s.tiers[0].entries()
+}
+
+// tier return the finest tier covering the seconds, the coarsest one is
+// returned when no tier covers it.
+func (s *trafficSeries) tier(sec int64) *trafficRing {
+	return s.tiers[s.tierIndex(sec)]
+}
+
+func (s *trafficSeries) tierIndex(sec int64) int {
+	for idx, tier := range s.tiers {
+		if tier.span()+tier.step >= sec {
+			return idx
+		}
+	}
+	return len(s.tiers) - 1
+}
+
+// analyse sum the recent seconds, the window is rounded to the resolution of tier.
+func (s *trafficSeries) analyse(sec int) *trafficStatsEntry {
+	return s.analyseAt(time.Now().Unix(), sec)
+}
+
+func (s *trafficSeries) analyseAt(now int64, sec int) *trafficStatsEntry {
+	idx := s.tierIndex(int64(sec))
+	return s.tiers[idx].analyseAt(now, sec, s.tiers[:idx]...)
+}
+
+// history return the buckets in [start, end] at the finest resolution
+// covering start.
+func (s *trafficSeries) history(start, end int64) []*trafficEntry {
+	return s.historyAt(time.Now().Unix(), start, end)
+}
+
+func (s *trafficSeries) historyAt(now, start, end int64) []*trafficEntry {
+	idx := s.tierIndex(now - start)
+	return s.tiers[idx].rangeAt(now, start, end, s.tiers[:idx]...)
+}
+
+// sumAt sum the buckets in [start, end).
+func (s *trafficSeries) sumAt(now, start, end int64) trafficEntry {
+	sum := trafficEntry{Timestamp: start}
+	for _, ent := range s.historyAt(now, start, end-1) {
+		sum.In += ent.In
+		sum.Out += ent.Out
+		sum.InPackets += ent.InPackets
+		sum.OutPackets += ent.OutPackets
+		sum.NewConnsIn += ent.NewConnsIn
+		sum.NewConnsOut += ent.NewConnsOut
+		sum.NewSockets += ent.NewSockets
+	}
+	return sum
+}
+
+// merge add the bucket of the same step, the queues are averaged by the scans.
+func (e *trafficEntry) merge(o *trafficEntry) {
+	e.In += o.In
+	e.Out += o.Out
+	e.OuterIn += o.OuterIn
+	e.OuterOut += o.OuterOut
+	e.InPackets += o.InPackets
+	e.OutPackets += o.OutPackets
+	e.NewConnsIn += o.NewConnsIn
+	e.NewConnsOut += o.NewConnsOut
+	e.NewSockets += o.NewSockets
+	e.tcp.add(&o.tcp)
+
+	if scans := e.queueScans + o.queueScans; scans > 0 {
+		e.TxQueue = (e.TxQueue*e.queueScans + o.TxQueue*o.queueScans) / scans
+		e.RxQueue = (e.RxQueue*e.queueScans + o.RxQueue*o.queueScans) / scans
+		e.queueScans = scans
+	}
+}
+
+// checkWindow validate the recent seconds of rank apis.
+func (nf *Netflow) checkWindow(sec int) error {
+	if sec <= 0 || sec > nf.retention.window() {
+		return fmt.Errorf("%w, max %d seconds", errInvalidWindow, nf.retention.window())
+	}
+	return nil
+}
+
+// GetProcessHistory return the traffic of process in [start, end] (unix
+// seconds), the resolution is 1s, 1m or 1h by how far start is.
+func (nf *Netflow) GetProcessHistory(pid string, start, end int64) ([]*trafficEntry, error) {
+	if start > end {
+		return nil, errInvalidWindow
+	}
+
+	po := nf.processHash.Get(pid)
+	if po == nil {
+		return nil, errNotFound
+	}
+	return po.getSeries().history(start, end), nil
+}
+
+// GetDeviceHistory return the traffic of capture device in [start, end].
+func (nf *Netflow) GetDeviceHistory(dev string, start, end int64) ([]*trafficEntry, error) {
+	if start > end {
+		return nil, errInvalidWindow
+	}
+
+	nf.deviceLock.Lock()
+	counter, ok := nf.devices[dev]
+	nf.deviceLock.Unlock()
+	if !ok {
+		return nil, errNotFound
+	}
+	return counter.series.history(start, end), nil
+}
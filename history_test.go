@@ -0,0 +1,135 @@
+package netflow
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetentionTiers(t *testing.T) {
+	tiers := defaultRetention.tiers()
+	assert.Equal(t, 3, len(tiers))
+	assert.EqualValues(t, 1, tiers[0].step)
+	assert.Equal(t, maxRingSize, len(tiers[0].buckets))
+	assert.EqualValues(t, 60, tiers[1].step)
+	assert.Equal(t, 61, len(tiers[1].buckets))
+	assert.EqualValues(t, 3600, tiers[2].step)
+	assert.Equal(t, 25, len(tiers[2].buckets))
+	assert.Equal(t, 25*3600, defaultRetention.window())
+
+	// the 1s resolution only.
+	assert.Equal(t, maxRingSize, Retention{Seconds: time.Minute}.window())
+}
+
+func TestTrafficSeries(t *testing.T) {
+	var (
+		series = newTrafficSeries(defaultRetention)
+		now    = int64(1700000000) // 22:13:20
+		hour   = now - now%3600
+	)
+
+	// 10 bytes per minute in the last 2 hours.
+	for ts := now - 7200; ts <= now; ts += 60 {
+		series.increaseAt(ts, 10, inputSide)
+	}
+	series.increaseAt(now, 5, outputSide)
+
+	// the 1s resolution.
+	stats := series.analyseAt(now, 30)
+	assert.EqualValues(t, 10, stats.In)
+	assert.EqualValues(t, 5, stats.Out)
+
+	// the 1m resolution, 5 buckets including the current one.
+	stats = series.analyseAt(now, 300)
+	assert.EqualValues(t, 50, stats.In)
+	assert.EqualValues(t, 0, stats.InRate)
+
+	// the 1h resolution, the current hour is not full.
+	stats = series.analyseAt(now, 3*3600)
+	assert.EqualValues(t, 1210, stats.In)
+
+	entries := series.historyAt(now, now-2*3600, now)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, hour-3600, entries[0].Timestamp)
+	assert.EqualValues(t, 600, entries[0].In)
+	assert.Equal(t, hour, entries[1].Timestamp)
+
+	entries = series.historyAt(now, now-600, now-300)
+	assert.Equal(t, 5, len(entries))
+	assert.Equal(t, now-600-now%60+60, entries[0].Timestamp)
+	for _, ent := range entries {
+		assert.EqualValues(t, 10, ent.In)
+	}
+}
+
+func TestTrafficSeriesRollUp(t *testing.T) {
+	var (
+		series = newTrafficSeries(defaultRetention)
+		now    = int64(1700000000)
+		minute = now - now%60
+	)
+
+	// only the 1s resolution is written by packets.
+	series.increaseAt(now, 10, inputSide)
+	series.increasePacketsAt(now, 1, inputSide)
+	_, ok := series.tiers[1].buckets[minute/60%61].load()
+	assert.False(t, ok)
+	assert.EqualValues(t, 10, series.analyseAt(now, 300).In)
+
+	// the bucket is rolled up when it's reused, it's counted once.
+	later := now + int64(maxRingSize)
+	series.increaseAt(later, 5, inputSide)
+	ent, ok := series.tiers[1].buckets[minute/60%61].load()
+	assert.True(t, ok)
+	assert.Equal(t, minute, ent.Timestamp)
+	assert.EqualValues(t, 10, ent.In)
+	assert.EqualValues(t, 1, ent.InPackets)
+
+	stats := series.analyseAt(later, 300)
+	assert.EqualValues(t, 15, stats.In)
+	assert.EqualValues(t, 1, stats.InPackets)
+	assert.EqualValues(t, 5, series.analyseAt(later, 30).In)
+	assert.EqualValues(t, 15, series.analyseAt(later, 3*3600).In)
+
+	// the bucket of the current minute merges the seconds not rolled up yet.
+	series.increaseAt(later-1, 7, inputSide)
+	entries := series.historyAt(later, later-600, later)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, minute, entries[0].Timestamp)
+	assert.EqualValues(t, 10, entries[0].In)
+	assert.EqualValues(t, 12, entries[1].In)
+}
+
+func TestWithRetention(t *testing.T) {
+	nf := &Netflow{
+		processHash: NewProcessController(context.Background()),
+		serviceHash: newServiceController(),
+		retention:   defaultRetention,
+	}
+	assert.Nil(t, nf.checkWindow(3600))
+	assert.NotNil(t, nf.checkWindow(30*3600))
+	assert.NotNil(t, nf.checkWindow(0))
+	assert.NotNil(t, nf.checkWindow(-5))
+
+	_, err := nf.GetProcessRank(10, -5)
+	assert.ErrorIs(t, err, errInvalidWindow)
+	_, err = nf.GetGroupRank(GroupByProcess, 10, -5)
+	assert.ErrorIs(t, err, errInvalidWindow)
+	_, err = nf.GetSelectedProcessRank(SelectName("curl"), 10, -5)
+	assert.ErrorIs(t, err, errInvalidWindow)
+
+	assert.NotNil(t, WithRetention(Retention{})(nf))
+	assert.NotNil(t, WithRetention(Retention{Seconds: time.Minute, Hours: -1})(nf))
+
+	r := Retention{Seconds: 5 * time.Minute, Hours: 7 * 24 * time.Hour}
+	assert.Nil(t, WithRetention(r)(nf))
+	assert.Equal(t, r, nf.processHash.retention)
+	assert.Nil(t, nf.checkWindow(300))
+	assert.Nil(t, nf.checkWindow(86400))
+
+	series := newTrafficSeries(r)
+	assert.Equal(t, 2, len(series.tiers))
+	assert.EqualValues(t, 3600, series.tier(600).step)
+}
@@ -0,0 +1,252 @@
+package netflow
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMappingSize = 200000
+	defaultMappingTTL  = 10 * time.Minute
+)
+
+// MappingStats is the size and the evictions of connection mapping.
+type MappingStats struct {
+	Size     int   `json:"size"`
+	Capacity int   `json:"capacity"`
+	Hits     int64 `json:"hits"`
+	Misses   int64 `json:"misses"`
+	Expired  int64 `json:"expired"` // not used longer than ttl
+	Evicted  int64 `json:"evicted"` // least recently used, when the mapping is full
+	Removed  int64 `json:"removed"` // socket is gone from the socket table
+}
+
+// connMapping map the tuples of sockets to inodes, it's bounded by capacity
+// with a lru list and by ttl. lookups move the entry to the front of the list,
+// so they hold the write lock as well.
+//
+// the tuples are scoped by the network namespace, containers may reuse the
+// tuples of host or of each other, eg: 127.0.0.1 and overlapping subnets.
+type connMapping struct {
+	sync.RWMutex
+	dict     map[connKey]*list.Element
+	lru      *list.List // front is the most recently used, the values are *entry
+	capacity int
+	ttl      time.Duration
+	scan     uint64
+
+	hits    int64
+	misses  int64
+	expired int64
+	evicted int64
+	removed int64
+}
+
+// connKey is the tuple of socket in its network namespace.
+type connKey struct {
+	netns string
+	tuple flowKey
+}
+
+type entry struct {
+	key    connKey
+	value  string
+	access int64  // unix nano of the last add, lookup or rescan
+	scan   uint64 // the last rescan which saw the socket
+}
+
+func newConnMapping() *connMapping {
+	return newBoundedConnMapping(defaultMappingSize, defaultMappingTTL)
+}
+
+// newBoundedConnMapping create the mapping holding at most capacity entries,
+// entries not used longer than ttl are removed by sweep.
+func newBoundedConnMapping(capacity int, ttl time.Duration) *connMapping {
+	if capacity <= 0 {
+		capacity = defaultMappingSize
+	}
+	if ttl <= 0 {
+		ttl = defaultMappingTTL
+	}
+
+	return &connMapping{
+		dict:     make(map[connKey]*list.Element, 1000),
+		lru:      list.New(),
+		capacity: capacity,
+		ttl:      ttl,
+	}
+}
+
+// WithConnCacheSize set the max number of tuples in the connection mapping.
+func WithConnCacheSize(size int) optionFunc {
+	return func(o *Netflow) error {
+		if size <= 0 {
+			return errors.New("invalid conn cache size")
+		}
+
+		o.connInodeHash.Lock()
+		o.connInodeHash.capacity = size
+		o.connInodeHash.Unlock()
+		return nil
+	}
+}
+
+// WithConnCacheTTL set the ttl of tuples not seen by packets and rescans.
+func WithConnCacheTTL(ttl time.Duration) optionFunc {
+	return func(o *Netflow) error {
+		if ttl <= 0 {
+			return errors.New("invalid conn cache ttl")
+		}
+
+		o.connInodeHash.Lock()
+		o.connInodeHash.ttl = ttl
+		o.connInodeHash.Unlock()
+		return nil
+	}
+}
+
+func (m *connMapping) length() int {
+	m.RLock()
+	defer m.RUnlock()
+	return len(m.dict)
+}
+
+// add 向 mapping 中添加键值对，并记录时间戳
+func (m *connMapping) add(key flowKey, value string) {
+	m.addWithNetns(key, value, "")
+}
+
+// addWithNetns 添加 socket 所在 network namespace 中的键值对
+func (m *connMapping) addWithNetns(tuple flowKey, value string, netns string) {
+	m.Lock()
+	defer m.Unlock()
+
+	key := connKey{netns: netns, tuple: tuple}
+	if elem, ok := m.dict[key]; ok {
+		ent := elem.Value.(*entry)
+		ent.value, ent.scan = value, m.scan
+		m.touch(elem)
+		return
+	}
+
+	if len(m.dict) >= m.capacity {
+		if elem := m.lru.Back(); elem != nil {
+			m.removeElement(elem)
+			m.evicted++
+		}
+	}
+	m.dict[key] = m.lru.PushFront(&entry{
+		key:    key,
+		value:  value,
+		access: time.Now().UnixNano(),
+		scan:   m.scan,
+	})
+}
+
+// touch refresh the entry and move it to the front, the caller holds the lock.
+func (m *connMapping) touch(elem *list.Element) {
+	elem.Value.(*entry).access = time.Now().UnixNano()
+	m.lru.MoveToFront(elem)
+}
+
+func (m *connMapping) removeElement(elem *list.Element) {
+	delete(m.dict, elem.Value.(*entry).key)
+	m.lru.Remove(elem)
+}
+
+// get return the inode of tuple in the netns, a hit refreshes the entry.
+func (m *connMapping) get(netns string, tuple flowKey) (string, bool) {
+	m.Lock()
+	defer m.Unlock()
+	elem, exists := m.dict[connKey{netns: netns, tuple: tuple}]
+	if !exists {
+		m.misses++
+		return "", false
+	}
+
+	m.hits++
+	m.touch(elem)
+	return elem.Value.(*entry).value, true
+}
+
+// beginScan start a rescan of socket tables, return its generation.
+func (m *connMapping) beginScan() uint64 {
+	m.Lock()
+	defer m.Unlock()
+
+	m.scan++
+	return m.scan
+}
+
+// keep mark the entry as seen by the current rescan, return false when it's
+// missing or the inode is changed. the socket is alive, so the entry is
+// refreshed as well, idle connections aren't expired by ttl.
+func (m *connMapping) keep(netns string, tuple flowKey, value string) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	elem, exists := m.dict[connKey{netns: netns, tuple: tuple}]
+	if !exists || elem.Value.(*entry).value != value {
+		return false
+	}
+	elem.Value.(*entry).scan = m.scan
+	m.touch(elem)
+	return true
+}
+
+// endScan remove the sockets gone from the socket tables and the expired
+// entries. the socket is removed when it's missing in two rescans, packets of
+// the closed connection may still wait in the delay queue. entries of
+// skipped namespaces are kept, their socket tables weren't read.
+func (m *connMapping) endScan(scan uint64, skipped map[string]bool) {
+	m.sweep(time.Now(), scan, skipped)
+}
+
+func (m *connMapping) sweep(now time.Time, scan uint64, skipped map[string]bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	// the list is ordered by access, the expired ones are at the back.
+	deadline := now.Add(-m.ttl).UnixNano()
+	for elem := m.lru.Back(); elem != nil && elem.Value.(*entry).access < deadline; elem = m.lru.Back() {
+		m.removeElement(elem)
+		m.expired++
+	}
+
+	for _, elem := range m.dict {
+		ent := elem.Value.(*entry)
+		if scan-ent.scan >= 2 && !skipped[ent.key.netns] {
+			m.removeElement(elem)
+			m.removed++
+		}
+	}
+}
+
+// stats return the size and the eviction counters.
+func (m *connMapping) stats() MappingStats {
+	m.RLock()
+	defer m.RUnlock()
+
+	return MappingStats{
+		Size:     len(m.dict),
+		Capacity: m.capacity,
+		Hits:     m.hits,
+		Misses:   m.misses,
+		Expired:  m.expired,
+		Evicted:  m.evicted,
+		Removed:  m.removed,
+	}
+}
+
+func (m *connMapping) String() string {
+	bs, _ := json.Marshal(m.stats())
+	return string(bs)
+}
+
+// GetConnCacheStats return the size and the evictions of the connection mapping.
+func (nf *Netflow) GetConnCacheStats() MappingStats {
+	return nf.connInodeHash.stats()
+}
@@ -0,0 +1,119 @@
+package netflow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMappingEvictLRU(t *testing.T) {
+	m := newBoundedConnMapping(32, time.Minute)
+	for i := 0; i < 32; i++ {
+		m.add(testFlowKey("10.0.0.1", uint16(1000+i), "10.0.0.2", 80), "1")
+	}
+
+	// the oldest entry is refreshed by the lookup.
+	first := testFlowKey("10.0.0.1", 1000, "10.0.0.2", 80)
+	_, ok := m.get("", first)
+	assert.True(t, ok)
+
+	m.add(testFlowKey("10.0.0.1", 2000, "10.0.0.2", 80), "2")
+	stats := m.stats()
+	assert.Equal(t, 32, stats.Size)
+	assert.Equal(t, 32, stats.Capacity)
+	assert.EqualValues(t, 1, stats.Evicted)
+	assert.EqualValues(t, 1, stats.Hits)
+
+	_, ok = m.get("", testFlowKey("10.0.0.1", 1001, "10.0.0.2", 80))
+	assert.False(t, ok)
+	_, ok = m.get("", first)
+	assert.True(t, ok)
+	_, ok = m.get("", testFlowKey("10.0.0.1", 1002, "10.0.0.2", 80))
+	assert.True(t, ok)
+	assert.EqualValues(t, 1, m.stats().Misses)
+
+	// 1003 is the least recently used now, updates refresh the entry.
+	m.add(testFlowKey("10.0.0.1", 1003, "10.0.0.2", 80), "3")
+	m.add(testFlowKey("10.0.0.1", 2001, "10.0.0.2", 80), "2")
+	inode, ok := m.get("", testFlowKey("10.0.0.1", 1003, "10.0.0.2", 80))
+	assert.True(t, ok)
+	assert.Equal(t, "3", inode)
+	_, ok = m.get("", testFlowKey("10.0.0.1", 1004, "10.0.0.2", 80))
+	assert.False(t, ok)
+	assert.Equal(t, 32, m.length())
+}
+
+func TestMappingScan(t *testing.T) {
+	var (
+		m      = newBoundedConnMapping(100, time.Minute)
+		alive  = testFlowKey("10.0.0.1", 1000, "10.0.0.2", 80)
+		closed = testFlowKey("10.0.0.1", 1001, "10.0.0.2", 80)
+		netns  = testFlowKey("172.17.0.2", 1002, "10.0.0.2", 80)
+	)
+
+	scan := m.beginScan()
+	m.addWithNetns(alive, "1", "host")
+	m.addWithNetns(closed, "2", "host")
+	m.addWithNetns(netns, "3", "container")
+	m.endScan(scan, nil)
+	assert.Equal(t, 3, m.length())
+
+	// the closed socket is kept for one more rescan.
+	for i := 0; i < 2; i++ {
+		scan = m.beginScan()
+		assert.True(t, m.keep("host", alive, "1"))
+		assert.False(t, m.keep("host", closed, "20"))
+		m.endScan(scan, map[string]bool{"container": true})
+	}
+
+	_, ok := m.get("host", alive)
+	assert.True(t, ok)
+	_, ok = m.get("host", closed)
+	assert.False(t, ok)
+	_, ok = m.get("container", netns)
+	assert.True(t, ok)
+	assert.EqualValues(t, 1, m.stats().Removed)
+
+	// not used longer than ttl.
+	m.sweep(time.Now().Add(2*time.Minute), scan, nil)
+	assert.Equal(t, 0, m.length())
+	assert.EqualValues(t, 2, m.stats().Expired)
+}
+
+func TestMappingIdleSocket(t *testing.T) {
+	var (
+		m      = newBoundedConnMapping(100, 50*time.Millisecond)
+		idle   = testFlowKey("10.0.0.1", 1000, "10.0.0.2", 80)
+		orphan = testFlowKey("172.17.0.2", 1001, "10.0.0.2", 80)
+	)
+
+	m.addWithNetns(idle, "1", "host")
+	m.addWithNetns(orphan, "2", "container")
+
+	// no packets of the connection longer than ttl, it's kept by rescans.
+	for i := 0; i < 4; i++ {
+		time.Sleep(20 * time.Millisecond)
+		scan := m.beginScan()
+		assert.True(t, m.keep("host", idle, "1"))
+		m.endScan(scan, map[string]bool{"container": true})
+	}
+
+	_, ok := m.get("host", idle)
+	assert.True(t, ok)
+	_, ok = m.get("container", orphan)
+	assert.False(t, ok)
+	assert.EqualValues(t, 1, m.stats().Expired)
+}
+
+func TestWithConnCache(t *testing.T) {
+	nf := &Netflow{connInodeHash: newConnMapping()}
+	assert.Nil(t, WithConnCacheSize(10)(nf))
+	assert.Nil(t, WithConnCacheTTL(time.Second)(nf))
+	assert.NotNil(t, WithConnCacheSize(0)(nf))
+	assert.NotNil(t, WithConnCacheTTL(0)(nf))
+
+	stats := nf.GetConnCacheStats()
+	assert.Equal(t, 10, stats.Capacity)
+	assert.Equal(t, time.Second, nf.connInodeHash.ttl)
+}
@@ -0,0 +1,177 @@
+package netflow
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// mappings idle longer than it are removed.
+	natExpiration = int64(600)
+
+	NATKindDNAT = "dnat"
+	NATKindSNAT = "snat"
+)
+
+// NATStats is the traffic of a nat mapping, External is the address before
+// nat, eg: the published port, Internal is the address after nat, eg: the
+// container. Orig is the direction of the first packet of connections.
+type NATStats struct {
+	Kind         string         `json:"kind"`
+	Proto        string         `json:"proto"`
+	External     string         `json:"external"`
+	Internal     string         `json:"internal"`
+	OrigBytes    int64          `json:"orig_bytes"`
+	ReplyBytes   int64          `json:"reply_bytes"`
+	OrigPackets  int64          `json:"orig_packets"`
+	ReplyPackets int64          `json:"reply_packets"`
+	LastSeen     int64          `json:"last_seen"`
+	Mode         AccountingMode `json:"mode"`
+}
+
+// natMapping fold the connections of the same translation, source ports of
+// snat are allocated per connection, so only ips are kept.
+type natMapping struct {
+	kind     string
+	proto    uint8
+	external ipAddr
+	internal ipAddr
+	extPort  uint16
+	intPort  uint16
+}
+
+func newNATMapping(ent *conntrackEntry) natMapping {
+	orig, reply := ent.orig, ent.reply
+	if orig.dstIP != reply.srcIP || orig.dstPort != reply.srcPort {
+		return natMapping{
+			kind:     NATKindDNAT,
+			proto:    orig.proto,
+			external: orig.dstIP,
+			extPort:  orig.dstPort,
+			internal: reply.srcIP,
+			intPort:  reply.srcPort,
+		}
+	}
+
+	return natMapping{
+		kind:     NATKindSNAT,
+		proto:    orig.proto,
+		external: reply.dstIP,
+		internal: orig.srcIP,
+	}
+}
+
+type natCounters struct {
+	origBytes    int64
+	replyBytes   int64
+	origPackets  int64
+	replyPackets int64
+	lastSeen     int64
+}
+
+// natTable is updated by capture goroutines of all devices.
+type natTable struct {
+	sync.Mutex
+
+	dict      map[natMapping]*natCounters
+	lastSweep int64
+}
+
+func newNATTable() *natTable {
+	return &natTable{
+		dict: make(map[natMapping]*natCounters),
+	}
+}
+
+// increase count the packet into its nat mapping, the packet may be seen
+// before or after nat.
+func (nt *natTable) increase(ct *conntrackTable, meta *packetMeta) {
+	nt.increaseAt(time.Now().Unix(), ct, meta)
+}
+
+func (nt *natTable) increaseAt(now int64, ct *conntrackTable, meta *packetMeta) {
+	if nt == nil {
+		return
+	}
+
+	ref, ok := ct.lookup(meta.key)
+	if !ok {
+		return
+	}
+	mapping := newNATMapping(ref.entry)
+
+	nt.Lock()
+	defer nt.Unlock()
+
+	if now-nt.lastSweep >= flowSweepInterval {
+		for key, nc := range nt.dict {
+			if now-nc.lastSeen > natExpiration {
+				delete(nt.dict, key)
+			}
+		}
+		nt.lastSweep = now
+	}
+
+	nc, ok := nt.dict[mapping]
+	if !ok {
+		nc = &natCounters{}
+		nt.dict[mapping] = nc
+	}
+
+	if ref.reply {
+		nc.replyBytes += meta.length
+		nc.replyPackets++
+	} else {
+		nc.origBytes += meta.length
+		nc.origPackets++
+	}
+	nc.lastSeen = now
+}
+
+func (nt *natTable) snapshot(mode AccountingMode) []NATStats {
+	nt.Lock()
+	defer nt.Unlock()
+
+	res := make([]NATStats, 0, len(nt.dict))
+	for key, nc := range nt.dict {
+		proto := "tcp"
+		if key.proto == protoUDP {
+			proto = "udp"
+		}
+
+		res = append(res, NATStats{
+			Kind:         key.kind,
+			Proto:        proto,
+			External:     natEndpoint(key.external, key.extPort),
+			Internal:     natEndpoint(key.internal, key.intPort),
+			OrigBytes:    nc.origBytes,
+			ReplyBytes:   nc.replyBytes,
+			OrigPackets:  nc.origPackets,
+			ReplyPackets: nc.replyPackets,
+			LastSeen:     nc.lastSeen,
+			Mode:         mode,
+		})
+	}
+	return res
+}
+
+func natEndpoint(ip ipAddr, port uint16) string {
+	if port == 0 {
+		return ip.String()
+	}
+	return ip.String() + ":" + strconv.Itoa(int(port))
+}
+
+// GetNATStats return the top nat mappings by bytes, packets are counted before sampling.
+func (nf *Netflow) GetNATStats(limit int) []NATStats {
+	res := nf.nats.snapshot(nf.accounting)
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].OrigBytes+res[i].ReplyBytes > res[j].OrigBytes+res[j].ReplyBytes
+	})
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return res
+}
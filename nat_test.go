@@ -0,0 +1,165 @@
+package netflow
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+)
+
+// 1.1.1.1:55000 -> 10.0.0.1:8080 is published to the container 172.17.0.2:80.
+const testDNAT = "ipv4 2 tcp 6 431999 ESTABLISHED src=1.1.1.1 dst=10.0.0.1 sport=55000 dport=8080 " +
+	"src=172.17.0.2 dst=1.1.1.1 sport=80 dport=55000 [ASSURED] mark=0 use=2"
+
+func testConntrackTable(t *testing.T, lines ...string) *conntrackTable {
+	var entries []*conntrackEntry
+	for _, line := range lines {
+		ent, ok := parseConntrackLine(line)
+		assert.True(t, ok)
+		entries = append(entries, ent)
+	}
+
+	ct := newConntrackTable(conntrackFile)
+	ct.store(entries)
+	return ct
+}
+
+func TestNATMapping(t *testing.T) {
+	dnat, _ := parseConntrackLine(testDNAT)
+	assert.Equal(t, natMapping{
+		kind:     NATKindDNAT,
+		proto:    protoTCP,
+		external: testIPAddr("10.0.0.1"),
+		extPort:  8080,
+		internal: testIPAddr("172.17.0.2"),
+		intPort:  80,
+	}, newNATMapping(dnat))
+
+	snat, _ := parseConntrackLine("ipv4 2 tcp 6 300 ESTABLISHED src=192.168.1.10 dst=8.8.8.8 sport=40000 dport=443 " +
+		"src=8.8.8.8 dst=100.64.0.1 sport=443 dport=61000 [ASSURED] mark=0 use=1")
+	assert.Equal(t, natMapping{
+		kind:     NATKindSNAT,
+		proto:    protoTCP,
+		external: testIPAddr("100.64.0.1"),
+		internal: testIPAddr("192.168.1.10"),
+	}, newNATMapping(snat))
+}
+
+func TestConntrackTranslate(t *testing.T) {
+	ct := testConntrackTable(t, testDNAT)
+
+	cases := []struct {
+		key        flowKey
+		translated flowKey
+		reply      bool
+	}{
+		{
+			key:        testFlowKey("1.1.1.1", 55000, "10.0.0.1", 8080),
+			translated: testFlowKey("1.1.1.1", 55000, "172.17.0.2", 80),
+		},
+		{
+			key:        testFlowKey("10.0.0.1", 8080, "1.1.1.1", 55000),
+			translated: testFlowKey("172.17.0.2", 80, "1.1.1.1", 55000),
+			reply:      true,
+		},
+		{
+			key:        testFlowKey("1.1.1.1", 55000, "172.17.0.2", 80),
+			translated: testFlowKey("1.1.1.1", 55000, "10.0.0.1", 8080),
+		},
+		{
+			key:        testFlowKey("172.17.0.2", 80, "1.1.1.1", 55000),
+			translated: testFlowKey("10.0.0.1", 8080, "1.1.1.1", 55000),
+			reply:      true,
+		},
+	}
+	for _, c := range cases {
+		ref, ok := ct.lookup(c.key)
+		assert.True(t, ok, c.key.String())
+		assert.Equal(t, c.translated, ref.translated, c.key.String())
+		assert.Equal(t, c.reply, ref.reply, c.key.String())
+	}
+}
+
+func TestProcessByTranslatedAddr(t *testing.T) {
+	nf := &Netflow{
+		connInodeHash: newConnMapping(),
+		processHash:   NewProcessController(context.Background()),
+		serviceHash:   newServiceController(),
+	}
+
+	// the socket in the container netns.
+	proc := &Process{Pid: "42", Name: "nginx"}
+	nf.processHash.Add("42", proc)
+	nf.processHash.inodePidMap["1000"] = "42"
+	socket := testFlowKey("172.17.0.2", 80, "1.1.1.1", 55000)
+	nf.connInodeHash.add(socket, "1000")
+	nf.connInodeHash.add(socket.reverse(), "1000")
+
+	key := testFlowKey("1.1.1.1", 55000, "10.0.0.1", 8080)
+	_, err := nf.getProcessByAddr(key, inputSide)
+	assert.Equal(t, errNotFound, err)
+
+	nf.conntrack = testConntrackTable(t, testDNAT)
+	found, err := nf.getProcessByAddr(key, inputSide)
+	assert.Nil(t, err)
+	assert.Equal(t, proc, found)
+
+	found, err = nf.getProcessByAddr(key.reverse(), outputSide)
+	assert.Nil(t, err)
+	assert.Equal(t, proc, found)
+}
+
+func TestNATAccounting(t *testing.T) {
+	var (
+		nf      = newDirectionNetflow("10.0.0.1")
+		counter = newDeviceCounter("eth0")
+		d       = newPacketDecoder(layers.LinkTypeEthernet)
+		meta    packetMeta
+	)
+	nf.conntrack = testConntrackTable(t, testDNAT)
+	nf.nats = newNATTable()
+
+	build := func(sip string, sport uint16, dip string, dport uint16, payload int) []byte {
+		ip := testIPv4(layers.IPProtocolTCP)
+		ip.SrcIP, ip.DstIP = net.ParseIP(sip).To4(), net.ParseIP(dip).To4()
+		return buildTestFrame(t, payload,
+			&layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4},
+			ip,
+			&layers.TCP{SrcPort: layers.TCPPort(sport), DstPort: layers.TCPPort(dport), ACK: true, Window: 1024},
+		)
+	}
+
+	request := build("1.1.1.1", 55000, "10.0.0.1", 8080, 100)
+	assert.True(t, nf.handlePacket(d, request, len(request), &meta, counter))
+	assert.Equal(t, inputSide, meta.side)
+
+	response := build("10.0.0.1", 8080, "1.1.1.1", 55000, 1000)
+	assert.True(t, nf.handlePacket(d, response, len(response), &meta, counter))
+	assert.Equal(t, outputSide, meta.side)
+
+	// not translated
+	other := build("1.1.1.1", 55001, "10.0.0.1", 22, 100)
+	assert.True(t, nf.handlePacket(d, other, len(other), &meta, counter))
+
+	stats := nf.GetNATStats(10)
+	assert.Equal(t, 1, len(stats))
+	assert.Equal(t, NATKindDNAT, stats[0].Kind)
+	assert.Equal(t, "tcp", stats[0].Proto)
+	assert.Equal(t, "10.0.0.1:8080", stats[0].External)
+	assert.Equal(t, "172.17.0.2:80", stats[0].Internal)
+	assert.EqualValues(t, 140, stats[0].OrigBytes)
+	assert.EqualValues(t, 1040, stats[0].ReplyBytes)
+	assert.EqualValues(t, 1, stats[0].OrigPackets)
+	assert.EqualValues(t, 1, stats[0].ReplyPackets)
+	assert.Equal(t, AccountL3, stats[0].Mode)
+
+	// idle mappings are removed, the mapping is counted from zero.
+	assert.True(t, nf.handlePacket(d, request, len(request), &meta, counter))
+	nf.nats.increaseAt(stats[0].LastSeen+natExpiration+1, nf.conntrack, &meta)
+	stats = nf.GetNATStats(10)
+	assert.Equal(t, 1, len(stats))
+	assert.EqualValues(t, 140, stats[0].OrigBytes)
+	assert.EqualValues(t, 0, stats[0].ReplyBytes)
+}
@@ -4,9 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -14,6 +16,7 @@ import (
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/pcapgo"
+	"github.com/rfyiamcool/go-netflow/rpc"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -26,31 +29,64 @@ type sideOption int
 const (
 	inputSide sideOption = iota
 	outputSide
+	// neither end is local, the packet is routed by this host or mirrored to it.
+	forwardSide
 )
 
 type Netflow struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 
-	connInodeHash *Mapping
+	connInodeHash *connMapping
 	processHash   *processController
+	serviceHash   *serviceController
 	workerNum     int
 	qsize         int
 
 	// for update action
-	delayQueue  chan *delayEntry
-	packetQueue chan gopacket.Packet
-
-	bindIPs        map[string]nullObject // read only
+	delayQueue chan *delayEntry
+	workers    []*packetWorker
+	sampling   samplingConfig
+	capture    captureConfig
+	accounting AccountingMode
+
+	// key -> device name, counters are kept when the device is recreated.
+	devices       map[string]*deviceCounter
+	captures      map[string]*deviceCapture
+	deviceAddrs   map[string]string
+	deviceLock    sync.Mutex
+	deviceEvents  chan DeviceEvent
+	watchInterval time.Duration
+	// *dialTable
+	dials atomic.Value
+
+	tunnels     *tunnelTable
+	tunnelOuter bool // count outer bytes of tunnels into processes
+
+	// flows routed by this host, written by capture goroutines.
+	forwards  *flowTable
+	conntrack *conntrackTable // nil when conntrack is disabled
+	nats      *natTable
+
+	bindIPs        map[string]nullObject // read only, the addresses found in New
+	bindAddrs      *addrSet              // binary form of bindIPs, refreshed by the device watcher
 	bindDevices    map[string]nullObject // read only
+	staticIPs      bool                  // set by WithBindIPs, not refreshed
+	staticDevices  bool                  // set by WithBindDevices, only these devices are captured
+	hostNetns      string
 	counter        int64
 	captureTimeout time.Duration
 	syncInterval   time.Duration
+	retention      Retention      // history of processes, services and devices
+	tcpSeries      *trafficSeries // tcp health of all flows
+	sendQueues     *sendQueueTable
+	store          *Store // samples are persisted when it's set
 	pcapFilter     string // for pcap filter
 
 	pcapFileName string
 	pcapFile     *os.File
 	pcapWriter   *pcapgo.Writer
+	pcapLock     sync.Mutex // writer is shared by capture goroutines
 
 	// for debug
 	debugMode bool
@@ -128,10 +164,36 @@ func WithCaptureTimeout(dur time.Duration) optionFunc {
 func WithName(pname string) optionFunc {
 	// capture name
 	return func(o *Netflow) error {
-		o.processHash.filterPName = pname
+		if pname == "" {
+			return nil
+		}
+
+		o.addSelector(SelectName(pname))
+		return nil
+	}
+}
+
+// WithSelector only capture the processes matching the selector,
+// multiple selectors (include WithName) are combined with And.
+func WithSelector(sel Selector) optionFunc {
+	return func(o *Netflow) error {
+		if sel == nil {
+			return errors.New("invalid selector")
+		}
+
+		o.addSelector(sel)
 		return nil
 	}
 }
+
+func (nf *Netflow) addSelector(sel Selector) {
+	if nf.processHash.selector == nil {
+		nf.processHash.selector = sel
+		return
+	}
+	nf.processHash.selector = And(nf.processHash.selector, sel)
+}
+
 func WithSyncInterval(dur time.Duration) optionFunc {
 	return func(o *Netflow) error {
 		if dur <= 0 {
@@ -143,6 +205,7 @@ func WithSyncInterval(dur time.Duration) optionFunc {
 	}
 }
 
+// WithWorkerNum set the number of packet workers, packets are dispatched by the hash of flow.
 func WithWorkerNum(num int) optionFunc {
 	if num <= 0 {
 		num = defaultWorkerNum // default
@@ -175,6 +238,7 @@ func WithBindIPs(ips []string) optionFunc {
 		}
 
 		o.bindIPs = mm
+		o.staticIPs = true
 		return nil
 	}
 }
@@ -191,10 +255,12 @@ func WithBindDevices(devs []string) optionFunc {
 		}
 
 		o.bindDevices = mm
+		o.staticDevices = true
 		return nil
 	}
 }
 
+// WithQueueSize set the total size of worker queues, it's split evenly to workers.
 func WithQueueSize(size int) optionFunc {
 	if size < 1000 {
 		size = defaultQueueSize
@@ -207,8 +273,8 @@ func WithQueueSize(size int) optionFunc {
 }
 
 const (
-	defaultQueueSize      = 2000000 // 2w
-	defaultWorkerNum      = 1       // usually one worker is enough.
+	defaultQueueSize      = 200000 // 20w
+	defaultWorkerNum      = 1      // usually one worker is enough.
 	defaultSyncInterval   = time.Duration(1 * time.Second)
 	defaultCaptureTimeout = 12 * 30 * 24 * 60 * 60 * time.Second
 )
@@ -228,8 +294,87 @@ type Interface interface {
 
 	// GetProcessRank
 	// param limit, size of data returned.
-	// param recentSeconds, the average of the last few seconds' value.
+	// param recentSeconds, the average of the last few seconds' value, it must be within retention.
 	GetProcessRank(limit int, recentSeconds int) ([]*Process, error)
+
+	// GetProcessRankWithOptions
+	// param opts, window, sort key, order, limit and filters of rank, the
+	// returned processes are snapshots, they're never changed after returned.
+	GetProcessRankWithOptions(opts RankOptions) ([]*Process, error)
+
+	// GetGroupRank
+	// param kind, fold processes by container, pod, systemd unit, pid or service rollup.
+	// param limit, size of data returned.
+	// param recentSeconds, the average of the last few seconds' value, it must be within retention.
+	GetGroupRank(kind GroupKind, limit int, recentSeconds int) ([]*ProcessGroup, error)
+
+	// GetSelectedProcessRank
+	// param sel, only rank the processes matching the selector.
+	// param limit, size of data returned.
+	// param recentSeconds, the average of the last few seconds' value, it must be within retention.
+	GetSelectedProcessRank(sel Selector, limit int, recentSeconds int) ([]*Process, error)
+
+	// GetServiceRank
+	// param limit, size of data returned.
+	// param recentSeconds, the average of the last few seconds' value, it must be within retention.
+	GetServiceRank(limit int, recentSeconds int) ([]*Service, error)
+
+	// GetWorkerStats
+	// return queue length, drops and processed packets of each worker.
+	GetWorkerStats() []WorkerStats
+
+	// GetDeviceStats
+	// return the total traffic of each capture device.
+	GetDeviceStats() []DeviceStats
+
+	// GetFlowRank
+	// param limit, size of active flows returned.
+	GetFlowRank(limit int) []*Flow
+
+	// GetDialStats
+	// return the traffic of dial accounts set by WithDialingInfo or UpdateDialingInfo.
+	GetDialStats() []DialStats
+
+	// UpdateDialingInfo
+	// replace the dial accounts, eg: the result of rpc GetDialingInfo.
+	UpdateDialingInfo(cards []rpc.NetCardInfo)
+
+	// GetTunnelStats
+	// return the inner and outer traffic of gre, ipip, vxlan, geneve and wireguard endpoints.
+	GetTunnelStats() []TunnelStats
+
+	// DeviceEvents
+	// notify the capture devices are up, down or their addresses are changed.
+	DeviceEvents() <-chan DeviceEvent
+
+	// GetForwardRank
+	// param limit, size of flows routed by this host returned, they're not counted into processes.
+	GetForwardRank(limit int) []*Flow
+
+	// GetNATStats
+	// param limit, size of nat mappings returned, only counted with WithConntrack.
+	GetNATStats(limit int) []NATStats
+
+	// GetConnCacheStats
+	// return the size, hits and evictions of the mapping from sockets to inodes.
+	GetConnCacheStats() MappingStats
+
+	// GetProcessHistory
+	// param start and end, unix seconds, the resolution is 1s, 1m or 1h by how far start is.
+	GetProcessHistory(pid string, start, end int64) ([]*trafficEntry, error)
+
+	// GetDeviceHistory
+	// param start and end, unix seconds, the resolution is 1s, 1m or 1h by how far start is.
+	GetDeviceHistory(dev string, start, end int64) ([]*trafficEntry, error)
+
+	// GetTCPHealth
+	// param recentSeconds, it must be within retention.
+	// return retransmissions, out of order, dup acks, zero windows and handshake rtt of all tcp flows.
+	GetTCPHealth(recentSeconds int) (TCPHealth, error)
+
+	// GetGrowingSendQueues
+	// param limit, size of sockets returned, their send queues grow in 3 rescans without being drained.
+	GetGrowingSendQueues(limit int) []*SocketBacklog
 }
 
 func New(opts ...optionFunc) (Interface, error) {
@@ -243,33 +388,43 @@ func New(opts ...optionFunc) (Interface, error) {
 		cancel:         cancel,
 		bindIPs:        ips,
 		bindDevices:    devs,
+		hostNetns:      getProcessNetns(hostNetnsPid),
 		qsize:          defaultQueueSize,
 		workerNum:      defaultWorkerNum,
 		captureTimeout: defaultCaptureTimeout,
+		capture:        newCaptureConfig(),
+		accounting:     AccountL3,
+		devices:        make(map[string]*deviceCounter),
+		captures:       make(map[string]*deviceCapture),
+		deviceAddrs:    make(map[string]string),
+		deviceEvents:   make(chan DeviceEvent, deviceEventQueueSize),
+		watchInterval:  defaultDeviceWatchInterval,
 		syncInterval:   defaultSyncInterval,
+		retention:      defaultRetention,
 		debugMode:      false,
 		logger:         &logger{},
 	}
 
 	nf.processHash = NewProcessController(nf.ctx)
-	nf.packetQueue = make(chan gopacket.Packet, nf.qsize)
-	nf.delayQueue = make(chan *delayEntry, nf.qsize)
-
-	nf.connInodeHash = NewMapping()
+	nf.serviceHash = newServiceController()
+	nf.connInodeHash = newConnMapping()
+	nf.tunnels = newTunnelTable()
+	nf.forwards = newFlowTable()
+	nf.nats = newNATTable()
+	nf.sendQueues = newSendQueueTable()
 	for _, opt := range opts {
 		err := opt(nf)
 		if err != nil {
 			return nil, err
 		}
 	}
+
+	// queues are created after options, WithQueueSize changes the size.
+	nf.workers = newPacketWorkers(nf.workerNum, nf.qsize, nf.sampling.adaptiveMax)
+	nf.delayQueue = make(chan *delayEntry, nf.qsize)
+	nf.tcpSeries = newTrafficSeries(nf.retention)
+	nf.bindAddrs = parseBindAddrs(nf.bindIPs)
 	fmt.Printf("nf.qsize: %v", nf.qsize)
-	//定期清理过期条目
-	go func() {
-		for {
-			time.Sleep(2 * time.Minute)               // 每10分钟清理一次
-			nf.connInodeHash.Cleanup(2 * time.Minute) // 清理10分钟之前的条目
-		}
-	}()
 	return nf, nil
 }
 
@@ -278,15 +433,60 @@ func (nf *Netflow) Done() <-chan struct{} {
 }
 
 func (nf *Netflow) GetProcessRank(limit int, recentSeconds int) ([]*Process, error) {
-	if recentSeconds > maxRingSize {
-		return nil, errors.New("windows interval must <= 60")
+	if err := nf.checkWindow(recentSeconds); err != nil {
+		return nil, err
 	}
 
 	nf.processHash.Sort(recentSeconds)
 	prank := nf.processHash.GetRank(limit)
+	for _, po := range prank {
+		nf.markSampleRate(po.TrafficStats)
+	}
+	return prank, nil
+}
+
+func (nf *Netflow) GetSelectedProcessRank(sel Selector, limit int, recentSeconds int) ([]*Process, error) {
+	if err := nf.checkWindow(recentSeconds); err != nil {
+		return nil, err
+	}
+
+	nf.processHash.Sort(recentSeconds)
+	prank := nf.processHash.GetSelectedRank(sel, limit)
+	for _, po := range prank {
+		nf.markSampleRate(po.TrafficStats)
+	}
 	return prank, nil
 }
 
+func (nf *Netflow) GetServiceRank(limit int, recentSeconds int) ([]*Service, error) {
+	if err := nf.checkWindow(recentSeconds); err != nil {
+		return nil, err
+	}
+
+	nf.serviceHash.Sort(recentSeconds, nf.processHash)
+	svcs := nf.serviceHash.GetRank(limit)
+	for _, svc := range svcs {
+		nf.markSampleRate(svc.TrafficStats)
+	}
+	return svcs, nil
+}
+
+func (nf *Netflow) GetGroupRank(kind GroupKind, limit int, recentSeconds int) ([]*ProcessGroup, error) {
+	if err := nf.checkWindow(recentSeconds); err != nil {
+		return nil, err
+	}
+	if !isValidGroupKind(kind) {
+		return nil, errInvalidGroupKind
+	}
+
+	nf.processHash.Sort(recentSeconds)
+	groups := nf.processHash.GetGroupRank(kind, limit)
+	for _, group := range groups {
+		nf.markSampleRate(group.TrafficStats)
+	}
+	return groups, nil
+}
+
 func (nf *Netflow) incrCounter() {
 	atomic.AddInt64(&nf.counter, 1)
 }
@@ -323,7 +523,7 @@ func (nf *Netflow) configurePersist() error {
 
 	nf.pcapFile = f
 	nf.pcapWriter = pcapgo.NewWriter(f)
-	nf.pcapWriter.WriteFileHeader(102400, layers.LinkTypeEthernet)
+	nf.pcapWriter.WriteFileHeader(uint32(nf.capture.snapLen), layers.LinkTypeEthernet)
 	return nil
 }
 
@@ -344,6 +544,9 @@ func (nf *Netflow) Start() error {
 	//1.扫描赋值 要检测的进程 map 2.扫描网络流量
 	go nf.startResourceSyncer()
 	go nf.startNetworkSniffer()
+	if nf.store != nil {
+		go nf.startStoreFlusher()
+	}
 
 	return nil
 }
@@ -416,6 +619,11 @@ func (nf *Netflow) rescanResouce() error {
 	wg.Go(func() error {
 		return nf.rescanProcessInodes()
 	})
+	if nf.conntrack != nil {
+		wg.Go(func() error {
+			return nf.rescanConntrack()
+		})
+	}
 
 	return wg.Wait()
 }
@@ -424,298 +632,370 @@ func (nf *Netflow) rescanProcessInodes() error {
 	return nf.processHash.Rescan()
 }
 
-//
-//func (nf *Netflow) rescanConns() error {
-//	conns, err := netstat("tcp")
-//	if err != nil {
-//		return err
-//	}
-//
-//	for _, conn := range conns {
-//		nf.connInodeHash.Add(conn.Addr, conn.Inode)
-//		nf.connInodeHash.Add(conn.ReverseAddr, conn.Inode)
-//	}
-//
-//	return nil
-//}
-
 func (nf *Netflow) rescanConns() error {
-	err := parseNetworkLines("tcp", func(line string) {
-		conn := getConnectionItem(line)
-		if conn != nil {
-			if !nf.connInodeHash.Exists(conn.Addr, conn.Inode) {
-				nf.connInodeHash.Add(conn.Addr, conn.Inode)
-			}
-			if !nf.connInodeHash.Exists(conn.ReverseAddr, conn.Inode) {
-				nf.connInodeHash.Add(conn.ReverseAddr, conn.Inode)
-			}
-		}
-	})
+	namespaces, err := listNetNamespaces()
 	if err != nil {
 		return err
 	}
 
-	// 打印 connInodeHash 的长度
-	//fmt.Printf("Current length of connInodeHash: %d\n", nf.connInodeHash.String())
+	var (
+		listens = newListenTable(nf.hostNetns)
+		scan    = nf.connInodeHash.beginScan()
+		skipped = make(map[string]bool)
+		conns   = newConnCounter(nf.processHash, scan == 1)
+		now     = time.Now().Unix()
+	)
+	nf.sendQueues.begin()
+
+	// host namespace goes first, so it owns the local ips shared with containers, eg: 127.0.0.1.
+	for idx, ns := range namespaces {
+		// the routes of host may be a full table, its ips are the default.
+		if idx > 0 {
+			for _, ip := range getNetnsAddrs(ns.pid) {
+				listens.learn(ip, ns.netns)
+			}
+		}
+
+		var items []*ConnectionItem
+		err := parseNetworkFile(procNetFile(ns.pid, "tcp"), func(line string) {
+			if item := getListenItem(line); item != nil {
+				item.Netns = ns.netns
+				listens.add(item, protoTCP)
+				conns.add(item, false)
+				return
+			}
+
+			conn := getConnectionItem(line)
+			if conn == nil {
+				return
+			}
+
+			conn.Netns = ns.netns
+			listens.learn(conn.key.srcIP, conn.Netns)
+			items = append(items, conn)
+		})
+		if err != nil && idx == 0 {
+			return err
+		}
+
+		if err != nil {
+			// the process may exit during scanning.
+			nf.logDebug("failed to read socket table of netns ", ns.netns, err)
+			skipped[ns.netns] = true
+			continue
+		}
+		nf.addConns(now, items, conns)
+
+		// only the listeners of tcp6 are read, eg: [::]:80 accepts ipv4 as well.
+		parseNetworkFile(procNetFile(ns.pid, "tcp6"), func(line string) {
+			if item := getListenItem(line); item != nil {
+				item.Netns = ns.netns
+				listens.add(item, protoTCP)
+				conns.add(item, false)
+			}
+		})
+	}
+	nf.serviceHash.updateListens(listens)
+	nf.connInodeHash.endScan(scan, skipped)
+	conns.commit(now, skipped)
+	nf.sendQueues.end(skipped)
 
 	return nil
 }
 
-//func (nf *Netflow) rescanConns() error {
-//	conns, err := netstat("tcp")
-//	if err != nil {
-//		return err
-//	}
-//
-//	for _, conn := range conns {
-//		// 仅在不存在的情况下添加
-//		if !nf.connInodeHash.Exists(conn.Addr, conn.Inode) {
-//			nf.connInodeHash.Add(conn.Addr, conn.Inode)
-//		}
-//		if !nf.connInodeHash.Exists(conn.ReverseAddr, conn.Inode) {
-//			nf.connInodeHash.Add(conn.ReverseAddr, conn.Inode)
-//		}
-//	}
-//	fmt.Printf("connectMap长度:%d", nf.connInodeHash.Length())
-//	return nil
-//}
-
-func (nf *Netflow) captureDevice(dev string) {
-	handler, err := buildPcapHandler(dev, nf.captureTimeout, nf.pcapFilter)
+// addConns map the tuples of sockets in a namespace, the reversed tuples
+// don't replace the tuples of sockets, both ends of loopback are local
+// sockets. orphaned sockets have no inode, eg: TIME_WAIT, they're only
+// tracked by the send queues.
+func (nf *Netflow) addConns(now int64, items []*ConnectionItem, conns *connCounter) {
+	tuples := make(map[flowKey]bool, len(items))
+	for _, conn := range items {
+		nf.sendQueues.observe(now, conn)
+		if conn.orphaned() {
+			continue
+		}
+		tuples[conn.key] = true
+		conns.add(conn, nf.addConn(conn.key, conn))
+	}
+	for _, conn := range items {
+		if !conn.orphaned() && !tuples[conn.reverseKey] {
+			nf.addConn(conn.reverseKey, conn)
+		}
+	}
+}
+
+// addConn map the tuple to the socket, return true when the socket is new
+// since the last rescan.
+func (nf *Netflow) addConn(key flowKey, conn *ConnectionItem) bool {
+	if nf.connInodeHash.keep(conn.Netns, key, conn.Inode) {
+		return false
+	}
+
+	nf.connInodeHash.addWithNetns(key, conn.Inode, conn.Netns)
+	return true
+}
+
+// captureDevice read packets until ctx is done or the device is gone, the
+// device watcher restarts it when the device is back. each direction is read
+// by its own handler when the device supports it.
+func (nf *Netflow) captureDevice(ctx context.Context, dev string, counter *deviceCounter) {
+	handlers, err := openPcapHandlers(dev, &nf.capture, nf.pcapFilter)
 	if err != nil {
-		fmt.Printf("Error building pcap handler: %v\n", err)
+		nf.logError("failed to build pcap handler of ", dev, err)
 		return
 	}
 
-	defer func() {
-		handler.Close()
-	}()
-
-	packetSource := gopacket.NewPacketSource(handler, handler.LinkType())
-	packetChan := make(chan gopacket.Packet, 10000000) // 缓冲通道
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(handlers))
+	)
+	nf.emitDeviceEvent(DeviceEvent{Type: DeviceUp, Device: dev})
+
+	// the device is gone when any handler fails, the others are stopped.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for i, handler := range handlers {
+		wg.Add(1)
+		go func(i int, handler *directedHandle) {
+			defer wg.Done()
+			defer cancel()
+			errs[i] = nf.readPackets(ctx, dev, handler, counter)
+		}(i, handler)
+	}
+	wg.Wait()
 
-	go func() {
-		for pkt := range packetChan {
-			nf.enqueue(pkt)
+	var exitErr error
+	for i, handler := range handlers {
+		handler.Close()
+		if exitErr == nil {
+			exitErr = errs[i]
 		}
-	}()
+	}
+	if nf.ctx.Err() == nil {
+		nf.emitDeviceEvent(newDownEvent(dev, exitErr))
+	}
+}
+
+// readPackets read packets of the handler until ctx is done, the error is
+// returned when the device is down.
+func (nf *Netflow) readPackets(ctx context.Context, dev string, handler *directedHandle, counter *deviceCounter) error {
+	var (
+		// the decoder and meta are reused, nothing is allocated per packet.
+		decoder = newPacketDecoder(handler.LinkType())
+		sampler = newPacketSampler(&nf.sampling, newSamplerSeed())
+		meta    packetMeta
+	)
+	decoder.direction = handler.direction
 
 	for {
 		select {
-		case <-nf.ctx.Done():
-			close(packetChan) // 确保在退出时关闭通道
-			return
-		case pkt := <-packetSource.Packets():
-			select {
-			case packetChan <- pkt:
-				// 成功放入通道
-			default:
-				// 通道满了，丢弃包或者记录日志
-				fmt.Println("Packet dropped due to full buffer")
-			}
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		// data is only valid until the next read.
+		data, ci, err := handler.ZeroCopyReadPacketData()
+		switch err {
+		case nil:
+		case pcap.NextErrorTimeoutExpired:
+			continue
+		case io.EOF, pcap.NextErrorNoMorePackets, pcap.NextErrorNotActivated:
+			return nil
+		default:
+			// the device is down or removed, eg: ppp redial.
+			nf.logError("failed to read packet from ", dev, err)
+			return err
+		}
+
+		meta.ts = ci.Timestamp.UnixNano()
+		if !nf.handlePacket(decoder, data, ci.Length, &meta, counter) {
+			continue
+		}
+		if meta.side == forwardSide {
+			nf.enqueueForward(meta)
+			continue
+		}
+		if !sampler.sample(&meta) {
+			continue
 		}
+
+		nf.writePcap(ci, data)
+		nf.enqueue(meta)
 	}
 }
 
-//func (nf *Netflow) captureDevice(dev string) {
-//	handler, err := buildPcapHandler(dev, nf.captureTimeout, nf.pcapFilter)
-//	if err != nil {
-//		return
-//	}
-//
-//	defer func() {
-//		handler.Close()
-//	}()
-//
-//	packetSource := gopacket.NewPacketSource(
-//		handler,
-//		handler.LinkType(),
-//	)
-//
-//	for {
-//		select {
-//		case <-nf.ctx.Done():
-//			return
-//
-//		case pkt := <-packetSource.Packets():
-//			nf.enqueue(pkt)
-//		}
-//	}
-//}
-
-func (nf *Netflow) enqueue(pkt gopacket.Packet) {
-	select {
-	case nf.packetQueue <- pkt:
-		nf.incrCounter()
-		return
-	default:
-		nf.logError("queue overflow, current size: ", len(nf.packetQueue))
+// handlePacket decode the packet into meta and count it into the device,
+// return false when it's not dispatched to workers.
+func (nf *Netflow) handlePacket(decoder *packetDecoder, data []byte, wireLen int, meta *packetMeta, counter *deviceCounter) bool {
+	if !decoder.decode(data, meta) {
+		counter.ignore()
+		return false
 	}
-}
 
-func (nf *Netflow) dequeue() gopacket.Packet {
-	select {
-	case pkt := <-nf.packetQueue:
-		return pkt
-	case <-nf.ctx.Done():
-		return nil
+	// the outer packet decides the direction of tunnels.
+	key := meta.key
+	if decoder.tunnel.kind != "" {
+		key = decoder.tunnel.outer
+	}
+	side, ok := nf.classifySide(decoder, key)
+	if !ok {
+		return false
 	}
-}
 
-// 1.阻塞 线程nf 中是否存在 packetQueue数据包
-// 2.有处理包
-func (nf *Netflow) loopHandlePacket() {
-	for {
-		pkt := nf.dequeue()
-		if pkt == nil {
-			return // ctx.Done
+	meta.loopback = false
+	if decoder.tunnel.kind != "" {
+		nf.handleTunnel(decoder, side, wireLen, meta, counter)
+	} else {
+		meta.length = packetLength(nf.accounting, meta.length, wireLen)
+		meta.side = side
+		// only the output of loopback has a local destination.
+		meta.loopback = side == outputSide && nf.isBindAddr(key.dstIP)
+		meta.outer = 0
+		if nf.tunnelOuter {
+			meta.outer = meta.length // plain packets are billed as is
+		}
+		counter.increase(meta.length, meta.side)
+		if side != forwardSide {
+			nf.increaseDial(decoder, meta)
 		}
+	}
+
+	meta.packets = 1
+	nf.nats.increase(nf.conntrack, meta)
 
-		nf.handlePacket(pkt)
+	// forwarded packets aren't of local processes, they're counted separately.
+	if meta.side == forwardSide {
+		return true
 	}
+
+	// only tcp sockets are scanned, udp can't be mapped to process yet.
+	return meta.key.proto == protoTCP
 }
 
-func (nf *Netflow) handlePacket(packet gopacket.Packet) {
-	// 获取 IPv4 层
-	ipLayer, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
-	if !ok {
+// handleTunnel count the outer packet into the device and the tunnel, the
+// direction is decided by the outer ip, the inner ips may be of containers.
+func (nf *Netflow) handleTunnel(decoder *packetDecoder, side sideOption, wireLen int, meta *packetMeta, counter *deviceCounter) {
+	tunnel := &decoder.tunnel
+	inner, outer := tunnelLength(nf.accounting, tunnel, meta.length, wireLen)
+
+	outerMeta := packetMeta{key: tunnel.outer, length: outer, side: side}
+	counter.increase(outer, side)
+	if side != forwardSide {
+		nf.increaseDial(decoder, &outerMeta)
+	}
+	nf.tunnels.increase(tunnel, side, inner, outer)
+
+	if !tunnel.decap {
+		*meta = outerMeta
+		inner = outer
+	}
+
+	meta.length, meta.side = inner, side
+	meta.outer = 0
+	if nf.tunnelOuter {
+		meta.outer = outer
+	}
+}
+
+func (nf *Netflow) writePcap(ci gopacket.CaptureInfo, data []byte) {
+	if nf.pcapWriter == nil {
 		return
 	}
-	// 获取 TCP 层
-	tcpLayer, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
-	if !ok {
+
+	nf.pcapLock.Lock()
+	defer nf.pcapLock.Unlock()
+
+	nf.pcapWriter.WritePacket(ci, data)
+}
+
+// enqueue dispatch the packet to the worker of its flow, both directions of
+// a connection go to the same worker.
+func (nf *Netflow) enqueue(meta packetMeta) {
+	w := pickWorker(nf.workers, meta.key)
+	if !w.sample(&meta) {
 		return
 	}
-	// 定义本地和远程的 IP 和端口
-	localIP, localPort := ipLayer.SrcIP, tcpLayer.SrcPort
-	remoteIP, remotePort := ipLayer.DstIP, tcpLayer.DstPort
-
-	// 确定数据包的方向
-	side := nf.determineSide(ipLayer.SrcIP.String())
-	// 计算 TCP 负载长度（仅负载部分）
-	payloadLength := len(tcpLayer.Payload)
-
-	// 计算 IP 头部和 TCP 头部的长度
-	ipHeaderLength := int(ipLayer.IHL) * 4          // IHL (Internet Header Length) 以 32-bit 为单位, 需要乘以4转换为字节
-	tcpHeaderLength := int(tcpLayer.DataOffset) * 4 // TCP DataOffset 以 32-bit 为单位, 也需要乘以4
-
-	// 计算整个 TCP 数据包的长度，包括 IP 头部、TCP 头部以及负载部分
-	totalLength := ipHeaderLength + tcpHeaderLength + payloadLength
-
-	// 生成地址字符串
-	addr := spliceAddr(localIP, localPort, remoteIP, remotePort)
-
-	// 增加流量统计 (包括头部和负载的总长度)
-	nf.increaseTraffic(addr, int64(totalLength), side)
-
-	// 如果启用了 pcap 文件记录，则写入数据包
-	//if nf.pcapFile != nil {
-	//	nf.pcapWriter.WritePacket(packet.Metadata().CaptureInfo, packet.Data())
-	//}
-}
-
-//func (nf *Netflow) handlePacket(packet gopacket.Packet) {
-//	// 获取 IPv4 层
-//	ipLayer, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
-//	if !ok {
-//		return
-//	}
-//	// 获取 TCP 层
-//	tcpLayer, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
-//	if !ok {
-//		return
-//	}
-//	// 定义本地和远程的 IP 和端口
-//	localIP, localPort := ipLayer.SrcIP, tcpLayer.SrcPort
-//	remoteIP, remotePort := ipLayer.DstIP, tcpLayer.DstPort
-//
-//	// 确定数据包的方向
-//	side := nf.determineSide(ipLayer.SrcIP.String())
-//
-//	// 计算 TCP 负载长度
-//	length := len(tcpLayer.Payload)
-//	//println("length1", length)
-//	// 生成地址字符串
-//	addr := spliceAddr(localIP, localPort, remoteIP, remotePort)
-//
-//	// 增加流量统计
-//	nf.increaseTraffic(addr, int64(length), side)
-//
-//	// 如果启用了 pcap 文件记录，则写入数据包
-//	if nf.pcapFile != nil {
-//		nf.pcapWriter.WritePacket(packet.Metadata().CaptureInfo, packet.Data())
-//	}
-//}
-
-// determineSide 根据 IP 判断数据包的方向
-func (nf *Netflow) determineSide(srcIP string) sideOption {
-	if nf.isBindIPs(srcIP) {
-		return outputSide
-	}
-	return inputSide
-}
-
-func (nf *Netflow) handlePacket1(packet gopacket.Packet) {
-	// var (
-	// 	ethLayer layers.Ethernet
-	// 	ipLayer  layers.IPv4
-	// 	tcpLayer layers.TCP
-
-	// 	layerTypes = []gopacket.LayerType{}
-	// )
-
-	// parser := gopacket.NewDecodingLayerParser(
-	// 	layers.LayerTypeEthernet,
-	// 	&ethLayer,
-	// 	&ipLayer,
-	// 	&tcpLayer,
-	// )
-
-	// err := parser.DecodeLayers(packet.Data(), &layerTypes)
-	// if err != nil {
-	// 	continue
-	// }
-
-	// get ipLayer
-	_ipLayer := packet.Layer(layers.LayerTypeIPv4)
-	if _ipLayer == nil {
+	if !w.push(meta) {
+		nf.logError("queue overflow, worker: ", w.id, ", current size: ", len(w.queue))
 		return
 	}
-	ipLayer, _ := _ipLayer.(*layers.IPv4)
+	nf.incrCounter()
+}
 
-	// get tcpLayer
-	_tcpLayer := packet.Layer(layers.LayerTypeTCP)
-	if _tcpLayer == nil {
-		return
+// enqueueForward dispatch the forwarded packet to the worker of its flow by
+// the same hash, each direction may be read by its own handler, the worker
+// keeps the tcp state of both directions in order. forwarded flows are
+// counted before sampling.
+func (nf *Netflow) enqueueForward(meta packetMeta) {
+	w := pickWorker(nf.workers, meta.key)
+	if !w.push(meta) {
+		nf.logError("queue overflow, worker: ", w.id, ", current size: ", len(w.queue))
 	}
-	tcpLayer, _ := _tcpLayer.(*layers.TCP)
+}
 
-	var (
-		side sideOption
+func (nf *Netflow) dequeue(w *packetWorker) (packetMeta, bool) {
+	select {
+	case meta := <-w.queue:
+		return meta, true
+	case <-nf.ctx.Done():
+		return packetMeta{}, false
+	}
+}
 
-		localIP   = ipLayer.SrcIP
-		localPort = tcpLayer.SrcPort
+// 1.阻塞 线程nf 中是否存在 worker 队列数据包
+// 2.有处理包
+func (nf *Netflow) loopHandlePacket(w *packetWorker) {
+	for {
+		meta, ok := nf.dequeue(w)
+		if !ok {
+			return // ctx.Done
+		}
 
-		remoteIP   = ipLayer.DstIP
-		remotePort = tcpLayer.DstPort
-	)
+		nf.handleMeta(w, &meta)
+		if meta.loopback {
+			// the receiving socket is counted by the same packet.
+			meta.side = inputSide
+			nf.handleMeta(w, &meta)
+		}
+		atomic.AddInt64(&w.processed, 1)
+	}
+}
 
-	if nf.isBindIPs(ipLayer.SrcIP.String()) {
-		side = outputSide
-	} else {
-		side = inputSide
+// handleMeta count the packet into the process and the flow of its socket,
+// forwarded packets are only counted into their flows.
+func (nf *Netflow) handleMeta(w *packetWorker, meta *packetMeta) {
+	if meta.side == forwardSide {
+		nf.forwards.increase(meta, nil)
+		return
 	}
 
-	// length := len(packet.Data()) // ip header + tcp header + tcp payload
-	length := len(tcpLayer.Payload)
-	addr := spliceAddr(localIP, localPort, remoteIP, remotePort)
-	nf.increaseTraffic(addr, int64(length), side)
+	proc, _ := nf.increaseTraffic(w.cache, meta)
+	health := w.flows.increase(meta, proc)
+	if !health.isZero() {
+		nf.increaseTCPHealth(proc, &health)
+	}
+}
 
-	if nf.pcapFile != nil {
-		nf.pcapWriter.WritePacket(packet.Metadata().CaptureInfo, packet.Data())
+// increaseTCPHealth count the health into the host and the process, the process
+// is nil when it's unknown yet.
+func (nf *Netflow) increaseTCPHealth(proc *Process, health *tcpCounters) {
+	nf.tcpSeries.increaseTCP(health)
+	if proc != nil {
+		proc.increaseTCP(health)
 	}
+}
 
-	//fmt.Println(">>>>", addr, len(packet.Data()), len(tcpLayer.Payload), side)
+// GetWorkerStats return the queue and counters of each packet worker.
+func (nf *Netflow) GetWorkerStats() []WorkerStats {
+	res := make([]WorkerStats, 0, len(nf.workers))
+	scale := nf.sampling.scale()
+	for _, w := range nf.workers {
+		stats := w.stats()
+		stats.SampleRate *= scale
+		res = append(res, stats)
+	}
+	return res
 }
 
 func (nf *Netflow) logDebug(msg ...interface{}) {
@@ -739,15 +1019,22 @@ func (nf *Netflow) isBindIPs(ipa string) bool {
 	return ok
 }
 
+func (nf *Netflow) isBindAddr(addr ipAddr) bool {
+	return nf.bindAddrs.contains(addr)
+}
+
 // 1.网卡筛选
 // 2.子线程执行抓包 核心
 func (nf *Netflow) startNetworkSniffer() {
+	nf.deviceLock.Lock()
 	for dev := range nf.bindDevices {
-		go nf.captureDevice(dev)
+		nf.startCapture(dev)
 	}
+	nf.deviceLock.Unlock()
+	go nf.watchDevices()
 
-	for i := 0; i < nf.workerNum; i++ {
-		go nf.loopHandlePacket()
+	for _, w := range nf.workers {
+		go nf.loopHandlePacket(w)
 	}
 
 	nf.timer = time.AfterFunc(nf.captureTimeout,
@@ -763,9 +1050,7 @@ type delayEntry struct {
 	times     int
 
 	// data
-	addr   string
-	length int64
-	side   sideOption
+	meta packetMeta
 }
 
 func (nf *Netflow) pushDelayQueue(de *delayEntry) {
@@ -791,59 +1076,118 @@ func (nf *Netflow) consumeDelayQueue() *delayEntry {
 }
 
 func (nf *Netflow) handleDelayEntry(entry *delayEntry) error {
-	proc, err := nf.getProcessByAddr(entry.addr)
+	proc, err := nf.getProcessByAddr(entry.meta.key, entry.meta.side)
 	if err != nil {
 		return err
 	}
 
-	nf.increaseProcessTraffic(proc, entry.length, entry.side)
+	nf.increaseProcessTraffic(proc, &entry.meta)
 	return nil
 }
 
-func (nf *Netflow) getProcessByAddr(addr string) (*Process, error) {
-	inode, _ := nf.connInodeHash.Get(addr)
+func (nf *Netflow) getProcessByAddr(key flowKey, side sideOption) (*Process, error) {
+	inode := nf.getInode(key, side)
+	if len(inode) == 0 {
+		// the socket tuple differs from the wire after nat, eg: docker port publishing.
+		inode = nf.getTranslatedInode(key, side)
+	}
+	if len(inode) == 0 {
+		// the accepted socket may be missed, attribute to the listening socket.
+		inode = nf.getListenInode(key, side)
+	}
 	if len(inode) == 0 {
 		// not found, to rescan
-		nf.logDebug("not found inode ", addr)
+		nf.logDebug("not found inode ", key)
 		return nil, errNotFound
 	}
 
 	proc := nf.processHash.GetProcessByInode(inode)
 	if proc == nil {
 		// not found, to rescan
-		nf.logDebug("not found proc ", addr)
+		nf.logDebug("not found proc ", key)
 		return nil, errNotFound
 	}
 
 	return proc, nil
 }
 
-func (nf *Netflow) increaseProcessTraffic(proc *Process, length int64, side sideOption) error {
-	switch side {
+func (nf *Netflow) getTranslatedInode(key flowKey, side sideOption) string {
+	tkey, ok := nf.conntrack.translate(key)
+	if !ok {
+		return ""
+	}
+
+	inode := nf.getInode(tkey, side)
+	if len(inode) == 0 {
+		inode = nf.getListenInode(tkey, side)
+	}
+	return inode
+}
+
+// getInode return the inode of the socket in the netns of local ip, the tuple
+// may be reused by sockets of other namespaces.
+func (nf *Netflow) getInode(key flowKey, side sideOption) string {
+	local := key.oriented(side)
+	inode, _ := nf.connInodeHash.get(nf.serviceHash.localNetns(local.srcIP), local)
+	return inode
+}
+
+func (nf *Netflow) getListenInode(key flowKey, side sideOption) string {
+	return nf.serviceHash.lookupInode(key, side)
+}
+
+func (nf *Netflow) increaseProcessTraffic(proc *Process, meta *packetMeta) error {
+	switch meta.side {
 	case inputSide:
-		proc.IncreaseInput(length)
+		proc.IncreaseInput(meta.length)
 	case outputSide:
-		proc.IncreaseOutput(length)
+		proc.IncreaseOutput(meta.length)
+	}
+	proc.increasePackets(meta.packets, meta.side)
+	if meta.outer != 0 {
+		proc.increaseOuter(meta.outer, meta.side)
+	}
+	if meta.opening() {
+		// inbound SYNs are accepted by the listener, outbound ones are initiated.
+		proc.increaseConns(meta.packets, meta.side)
 	}
 	return nil
 }
 
-func (nf *Netflow) increaseTraffic(addr string, length int64, side sideOption) error {
-	proc, err := nf.getProcessByAddr(addr)
+// lookupProcess find the process of flow in the cache of worker first.
+func (nf *Netflow) lookupProcess(cache *flowCache, key flowKey, side sideOption) (*Process, error) {
+	// the ends of loopback are different sockets, so the cache is of the local tuple.
+	revision, local := nf.processHash.getRevision(), key.oriented(side)
+	if proc := cache.get(local, revision); proc != nil {
+		return proc, nil
+	}
+
+	proc, err := nf.getProcessByAddr(key, side)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.add(local, proc)
+	return proc, nil
+}
+
+// increaseTraffic count the packet into the service and the process, the process is nil when it's unknown yet.
+func (nf *Netflow) increaseTraffic(cache *flowCache, meta *packetMeta) (*Process, error) {
+	nf.serviceHash.increase(meta.key, meta.length, meta.side)
+
+	proc, err := nf.lookupProcess(cache, meta.key, meta.side)
 	if err != nil {
 		den := &delayEntry{
 			timestamp: time.Now(),
 			times:     0,
-			addr:      addr,
-			length:    length,
-			side:      side,
+			meta:      *meta,
 		}
 		nf.pushDelayQueue(den)
-		return err
+		return nil, err
 	}
 
-	nf.increaseProcessTraffic(proc, length, side)
-	return nil
+	nf.increaseProcessTraffic(proc, meta)
+	return proc, nil
 }
 
 type nullObject = struct{}
@@ -854,87 +1198,64 @@ func parseIpaddrsAndDevices() (map[string]nullObject, map[string]nullObject) {
 		return nil, nil
 	}
 
-	var (
-		bindIPs  = map[string]nullObject{}
-		devNames = map[string]nullObject{}
-	)
-
-	for _, dev := range devs {
-		for _, addr := range dev.Addresses {
-			if addr.IP.IsMulticast() {
-				continue
-			}
-			bindIPs[addr.IP.String()] = struct{}{}
-		}
-
-		if strings.HasPrefix(dev.Name, "eth") {
-			devNames[dev.Name] = nullObject{}
-			continue
-		}
-
-		if strings.HasPrefix(dev.Name, "em") {
-			devNames[dev.Name] = nullObject{}
-			continue
-		}
-
-		if strings.HasPrefix(dev.Name, "enp") {
-			devNames[dev.Name] = nullObject{}
-			continue
+	snap := scanDevices(devs)
+	devNames := map[string]nullObject{}
+	for name := range snap.addrs {
+		if isCaptureDevice(name) {
+			devNames[name] = nullObject{}
 		}
+	}
+	return snap.ips, devNames
+}
 
-		if strings.HasPrefix(dev.Name, "eno") {
-			devNames[dev.Name] = nullObject{}
-			continue
-		}
-		if strings.HasPrefix(dev.Name, "ppp") {
-			devNames[dev.Name] = nullObject{}
-			continue
-		}
-		if strings.HasPrefix(dev.Name, "lo") {
-			devNames[dev.Name] = nullObject{}
-			continue
-		}
+// parseBindAddrs convert bind ips to the binary form used by the packet path.
+func parseBindAddrs(ips map[string]nullObject) *addrSet {
+	return newAddrSet(parseAddrs(ips))
+}
 
-		if strings.HasPrefix(dev.Name, "bond") {
-			devNames[dev.Name] = nullObject{}
+func parseAddrs(ips map[string]nullObject) map[ipAddr]nullObject {
+	addrs := make(map[ipAddr]nullObject, len(ips))
+	for ip := range ips {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
 			continue
 		}
+		addrs[newIPAddr(parsed)] = nullObject{}
 	}
-	return bindIPs, devNames
+	return addrs
 }
 
-func buildPcapHandler(device string, timeout time.Duration, pfilter string) (*pcap.Handle, error) {
-	var (
-		snapshotLen int32 = 655350000
-		//promisc     bool  = true
-	)
-
-	// if packet captured size >= snapshotLength or 1 second's timer is expired, call user layer.
-	handler, err := pcap.OpenLive(device, snapshotLen, false, pcap.BlockForever)
+func buildPcapHandler(device string, cfg *captureConfig, pfilter string, direction pcap.Direction) (*pcap.Handle, error) {
+	inactive, err := newInactiveHandle(device, cfg)
 	if err != nil {
 		return nil, err
 	}
-	stats, err := handler.Stats()
+	defer inactive.CleanUp()
+
+	// packets are delivered when the buffer is full or the read timeout is expired.
+	handler, err := inactive.Activate()
 	if err != nil {
-		fmt.Printf("Error getting stats: %v", err)
-	} else {
-		fmt.Printf("device:%s,Packets received: %d, 丢失的包数量: %d, 缓冲区不足而丢失的包数量: %d", device, stats.PacketsReceived, stats.PacketsDropped, stats.PacketsIfDropped)
+		return nil, err
 	}
-	var filter = "tcp and (not broadcast and not multicast)"
+
+	if direction != pcap.DirectionInOut {
+		err = handler.SetDirection(direction)
+		if err != nil {
+			handler.Close()
+			return nil, err
+		}
+	}
+
+	var filter = defaultPcapFilter
 	if len(pfilter) != 0 {
-		//filter = fmt.Sprintf("%s and %s", filter, pfilter)
-		//filter = fmt.Sprintf("%s and %s", filter, pfilter)
 		filter = pfilter
 	}
 	println("filter:", filter)
 	err = handler.SetBPFFilter(filter)
 	if err != nil {
+		handler.Close()
 		return nil, err
 	}
 
 	return handler, nil
 }
-
-func spliceAddr(sip net.IP, sport layers.TCPPort, dip net.IP, dport layers.TCPPort) string {
-	return fmt.Sprintf("%s:%d_%s:%d", sip, sport, dip, dport)
-}
@@ -0,0 +1,143 @@
+package netflow
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	hostNetnsPid = "self"
+)
+
+// getProcessNetns return the inode of network namespace, eg: net:[4026531992] -> 4026531992.
+func getProcessNetns(pid string) string {
+	link, err := os.Readlink(fmt.Sprintf("/proc/%s/ns/net", pid))
+	if err != nil {
+		return ""
+	}
+	return parseNetnsLink(link)
+}
+
+func parseNetnsLink(link string) string {
+	if !strings.HasPrefix(link, "net:[") || !strings.HasSuffix(link, "]") {
+		return ""
+	}
+	return link[len("net:[") : len(link)-1]
+}
+
+type netnsEntry struct {
+	netns string
+	pid   string // any pid living in the namespace, used to read its socket table
+}
+
+// listNetNamespaces enumerate distinct network namespaces of all processes,
+// the host namespace is always the first entry.
+func listNetNamespaces() ([]netnsEntry, error) {
+	procDirs, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		host = getProcessNetns(hostNetnsPid)
+		seen = map[string]string{}
+	)
+
+	for _, procDir := range procDirs {
+		pid := filepath.Base(procDir)
+		ns := getProcessNetns(pid)
+		if ns == "" || ns == host {
+			continue
+		}
+		if _, ok := seen[ns]; ok {
+			continue
+		}
+		seen[ns] = pid
+	}
+
+	entries := make([]netnsEntry, 0, len(seen)+1)
+	entries = append(entries, netnsEntry{netns: host, pid: hostNetnsPid})
+
+	others := make([]string, 0, len(seen))
+	for ns := range seen {
+		others = append(others, ns)
+	}
+	sort.Strings(others)
+	for _, ns := range others {
+		entries = append(entries, netnsEntry{netns: ns, pid: seen[ns]})
+	}
+	return entries, nil
+}
+
+// procNetFile return the socket table of the namespace which the pid lives in.
+func procNetFile(pid string, tp string) string {
+	return filepath.Join("/proc", pid, "net", tp)
+}
+
+// getNetnsAddrs return the local ips of the namespace which the pid lives in,
+// loopback and link local ips are skipped, every namespace has them.
+func getNetnsAddrs(pid string) []ipAddr {
+	var addrs []ipAddr
+	if f, err := os.Open(procNetFile(pid, "fib_trie")); err == nil {
+		addrs = append(addrs, parseFibTrie(f)...)
+		f.Close()
+	}
+	if f, err := os.Open(procNetFile(pid, "if_inet6")); err == nil {
+		addrs = append(addrs, parseIfInet6(f)...)
+		f.Close()
+	}
+	return addrs
+}
+
+// parseFibTrie return the ipv4 of "/32 host LOCAL" routes, the ip is in the
+// leaf line before, eg: "|-- 172.17.0.2".
+func parseFibTrie(r io.Reader) []ipAddr {
+	var (
+		addrs   []ipAddr
+		leaf    net.IP
+		scanner = bufio.NewScanner(r)
+	)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "|-- "):
+			leaf = net.ParseIP(line[len("|-- "):])
+		case strings.HasPrefix(line, "/32 host LOCAL") && isNetnsAddr(leaf):
+			addrs = append(addrs, newIPAddr(leaf))
+		}
+	}
+	return addrs
+}
+
+// parseIfInet6 return the ipv6 of interfaces, eg: "fd000000000000000000000000000002 04 40 00 82 eth0".
+func parseIfInet6(r io.Reader) []ipAddr {
+	var (
+		addrs   []ipAddr
+		scanner = bufio.NewScanner(r)
+	)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		bs, err := hex.DecodeString(fields[0])
+		if err != nil || len(bs) != net.IPv6len {
+			continue
+		}
+		if ip := net.IP(bs); isNetnsAddr(ip) {
+			addrs = append(addrs, newIPAddr(ip))
+		}
+	}
+	return addrs
+}
+
+func isNetnsAddr(ip net.IP) bool {
+	return ip != nil && !ip.IsLoopback() && !ip.IsLinkLocalUnicast()
+}
@@ -0,0 +1,93 @@
+package netflow
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNetnsLink(t *testing.T) {
+	assert.Equal(t, "4026531992", parseNetnsLink("net:[4026531992]"))
+	assert.Equal(t, "", parseNetnsLink("mnt:[4026531992]"))
+	assert.Equal(t, "", parseNetnsLink(""))
+}
+
+func TestListNetNamespaces(t *testing.T) {
+	namespaces, err := listNetNamespaces()
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, 0, len(namespaces))
+
+	// host namespace is always the first one.
+	assert.Equal(t, hostNetnsPid, namespaces[0].pid)
+	assert.Equal(t, getProcessNetns(hostNetnsPid), namespaces[0].netns)
+
+	seen := map[string]bool{}
+	for _, ns := range namespaces {
+		assert.False(t, seen[ns.netns])
+		seen[ns.netns] = true
+	}
+}
+
+func TestAddConnSharedTuple(t *testing.T) {
+	nf := &Netflow{
+		connInodeHash: newConnMapping(),
+		serviceHash:   newServiceController(),
+		hostNetns:     "1",
+	}
+
+	// the containers of two bridges with the same subnet.
+	addr := testFlowKey("172.18.0.2", 80, "10.0.0.2", 5555)
+	assert.True(t, nf.addConn(addr, &ConnectionItem{Inode: "100", Netns: "2"}))
+	assert.True(t, nf.addConn(addr, &ConnectionItem{Inode: "200", Netns: "3"}))
+	assert.False(t, nf.addConn(addr, &ConnectionItem{Inode: "100", Netns: "2"}))
+	assert.Equal(t, 2, nf.connInodeHash.length())
+
+	inode, _ := nf.connInodeHash.get("2", addr)
+	assert.Equal(t, "100", inode)
+	inode, _ = nf.connInodeHash.get("3", addr)
+	assert.Equal(t, "200", inode)
+
+	// packets are looked up in the netns of the local ip.
+	listens := newListenTable(nf.hostNetns)
+	listens.learn(addr.srcIP, "3")
+	nf.serviceHash.updateListens(listens)
+	assert.Equal(t, "200", nf.getInode(addr, outputSide))
+	assert.Equal(t, "200", nf.getInode(addr.reverse(), inputSide))
+
+	// the ips not seen in containers are of the host.
+	addr = testFlowKey("127.0.0.1", 80, "127.0.0.1", 5555)
+	nf.addConn(addr, &ConnectionItem{Inode: "300", Netns: "1"})
+	nf.addConn(addr, &ConnectionItem{Inode: "400", Netns: "2"})
+	assert.Equal(t, "300", nf.getInode(addr, outputSide))
+}
+
+func TestParseNetnsAddrs(t *testing.T) {
+	fib := `Main:
+  +-- 0.0.0.0/0 3 0 5
+     |-- 0.0.0.0
+        /0 universe UNICAST
+     +-- 127.0.0.0/8 2 0 2
+        +-- 127.0.0.0/31 1 0 0
+           |-- 127.0.0.0
+              /8 host LOCAL
+           |-- 127.0.0.1
+              /32 host LOCAL
+        |-- 127.255.255.255
+           /32 link BROADCAST
+     +-- 192.0.2.0/24 2 0 2
+        |-- 192.0.2.0
+           /24 link UNICAST
+        |-- 192.0.2.2
+           /32 host LOCAL
+        |-- 192.0.2.255
+           /32 link BROADCAST
+`
+	assert.Equal(t, []ipAddr{testIPAddr("192.0.2.2")}, parseFibTrie(strings.NewReader(fib)))
+
+	inet6 := `00000000000000000000000000000001 01 80 10 80       lo
+fe800000000000000000000000000002 02 40 20 80     eth0
+fd000000000000000000000000000002 02 40 00 80     eth0
+`
+	assert.Equal(t, []ipAddr{testIPAddr("fd00::2")}, parseIfInet6(strings.NewReader(inet6)))
+}
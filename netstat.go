@@ -2,7 +2,9 @@ package netflow
 
 import (
 	"bufio"
+	"encoding/hex"
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -17,8 +19,28 @@ const (
 
 	EstablishedSymbol = "01"
 	ListenSymbol      = "0A"
+
+	// USER_HZ of the timer columns of socket tables.
+	userHZ = 100
+)
+
+// timers of the tr column of socket tables.
+const (
+	TimerOff int8 = iota
+	TimerRetransmit
+	TimerKeepalive
+	TimerTimeWait
+	TimerZeroWindowProbe
 )
 
+var timerNames = map[int8]string{
+	TimerOff:             "off",
+	TimerRetransmit:      "retransmit",
+	TimerKeepalive:       "keepalive",
+	TimerTimeWait:        "timewait",
+	TimerZeroWindowProbe: "probe",
+}
+
 type ConnectionItem struct {
 	Addr        string `json:"addr" valid:"-"`
 	ReverseAddr string `json:"reverse_addr" valid:"-"`
@@ -31,19 +53,33 @@ type ConnectionItem struct {
 	TxQueue       int64         `json:"tx_queue" valid:"-"`
 	RxQueue       int64         `json:"rx_queue" valid:"-"`
 	Timer         int8          `json:"timer" valid:"-"`
-	TimerDuration time.Duration `json:"timer_duration" valid:"-"`
+	TimerDuration time.Duration `json:"timer_duration" valid:"-"` // until the timer expires
+	Retransmits   int64         `json:"retransmits" valid:"-"`    // unrecovered rto timeouts
 	Rto           time.Duration // retransmission timeout
+	Cwnd          int64         `json:"cwnd" valid:"-"`
+	Ssthresh      int64         `json:"ssthresh" valid:"-"` // -1 before the first loss
 	Uid           int
 	Uname         string
 	Timeout       time.Duration
 	Inode         string `json:"inode"`
+	Netns         string `json:"netns"`
 	Raw           string `json:"raw"`
+
+	// binary form of Addr and ReverseAddr
+	key        flowKey
+	reverseKey flowKey
 }
 
 func (ci *ConnectionItem) GetAddr() string {
 	return ci.Addr
 }
 
+// orphaned return true when the socket isn't owned by any process, eg:
+// TIME_WAIT, or FIN_WAIT1 after close().
+func (ci *ConnectionItem) orphaned() bool {
+	return ci.Inode == "0"
+}
+
 func parseNetworkLines(tp string, processLine func(string)) error {
 	var pf string
 
@@ -60,6 +96,11 @@ func parseNetworkLines(tp string, processLine func(string)) error {
 		pf = procTCPFile
 	}
 
+	return parseNetworkFile(pf, processLine)
+}
+
+// parseNetworkFile read socket table of any namespace, eg: /proc/<pid>/net/tcp
+func parseNetworkFile(pf string, processLine func(string)) error {
 	file, err := os.Open(pf)
 	if err != nil {
 		return err
@@ -117,6 +158,9 @@ func hex2dec(hexstr string) string {
 
 func hex2ip(hexstr string) (string, string) {
 	var ip string
+	if len(hexstr) == 32 {
+		return hex2ip6(hexstr)
+	}
 	if len(hexstr) != 8 {
 		err := "parse error"
 		return ip, err
@@ -131,6 +175,20 @@ func hex2ip(hexstr string) (string, string) {
 	return ip, ""
 }
 
+// hex2ip6 parse the ipv6 of tcp6, it's 4 words of host byte order, eg: "0000000000000000FFFF00000100007F".
+func hex2ip6(hexstr string) (string, string) {
+	bs, err := hex.DecodeString(hexstr)
+	if err != nil {
+		return "", "parse error"
+	}
+
+	ip := make(net.IP, net.IPv6len)
+	for i := 0; i < net.IPv6len; i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = bs[i+3], bs[i+2], bs[i+1], bs[i]
+	}
+	return ip.String(), ""
+}
+
 func parseAddr(str string) (string, string) {
 	l := strings.Split(str, ":")
 	if len(l) != 2 {
@@ -195,9 +253,7 @@ type filterFunc func()
 func getConnectionItem(line string) *ConnectionItem {
 	// local ip and port
 	source := removeEmpty(strings.Split(strings.TrimSpace(line), " "))
-
-	// only notice ESTAB and listen state
-	if source[3] != EstablishedSymbol && source[3] != ListenSymbol {
+	if len(source) < 10 {
 		return nil
 	}
 
@@ -242,7 +298,13 @@ func getConnectionItem(line string) *ConnectionItem {
 	addr := ip + ":" + port + "_" + destIP + ":" + destPort
 	raddr := destIP + ":" + destPort + "_" + ip + ":" + port
 
+	sport, _ := strconv.Atoi(port)
+	dport, _ := strconv.Atoi(destPort)
+	key := newFlowKey(net.ParseIP(ip), uint16(sport), net.ParseIP(destIP), uint16(dport), protoTCP)
+
 	cc := &ConnectionItem{
+		key:         key,
+		reverseKey:  key.reverse(),
 		Addr:        addr,
 		ReverseAddr: raddr,
 		State:       state,
@@ -257,9 +319,83 @@ func getConnectionItem(line string) *ConnectionItem {
 		Uname:       uname,
 		Raw:         line,
 	}
+	parseSocketTimer(cc, source)
 	return cc
 }
 
+// parseSocketTimer parse the timer, retransmits, rto, cwnd and ssthresh
+// columns, durations are in USER_HZ ticks.
+//
+//	tr:tm->when retrnsmt uid timeout inode ref pointer rto ato qack cwnd ssthresh
+//	02:00000334 00000000   0        0 54227 2   ...     20  4   0    18   -1
+func parseSocketTimer(cc *ConnectionItem, source []string) {
+	if timer := strings.Split(source[5], ":"); len(timer) == 2 {
+		tr, _ := strconv.ParseInt(timer[0], 16, 8)
+		when, _ := strconv.ParseInt(timer[1], 16, 64)
+		cc.Timer = int8(tr)
+		cc.TimerDuration = ticksToDuration(when)
+	}
+	cc.Retransmits, _ = strconv.ParseInt(source[6], 16, 64)
+
+	if len(source) < 17 {
+		return
+	}
+	rto, _ := strconv.ParseInt(source[12], 10, 64)
+	cc.Rto = ticksToDuration(rto)
+	cc.Cwnd, _ = strconv.ParseInt(source[15], 10, 64)
+	cc.Ssthresh, _ = strconv.ParseInt(source[16], 10, 64)
+}
+
+func ticksToDuration(ticks int64) time.Duration {
+	return time.Duration(ticks) * time.Second / userHZ
+}
+
+// getListenItem parse the listening socket of line, nil if it's not listening.
+func getListenItem(line string) *ConnectionItem {
+	source := removeEmpty(strings.Split(strings.TrimSpace(line), " "))
+	if len(source) < 10 || source[3] != ListenSymbol {
+		return nil
+	}
+
+	ip, port := parseAddr(source[1])
+	return &ConnectionItem{
+		Addr:    ip + ":" + port,
+		State:   StateMapping[ListenSymbol],
+		SrcIP:   ip,
+		SrcPort: port,
+		Inode:   source[9],
+		Raw:     line,
+	}
+}
+
+// getListenSockets return inode -> port of listening sockets in all network namespaces.
+func getListenSockets() map[string]int {
+	listens := make(map[string]int, 100)
+
+	namespaces, err := listNetNamespaces()
+	if err != nil {
+		return listens
+	}
+
+	for _, ns := range namespaces {
+		for _, file := range []string{"tcp", "tcp6"} {
+			parseNetworkFile(procNetFile(ns.pid, file), func(line string) {
+				item := getListenItem(line)
+				if item == nil {
+					return
+				}
+
+				port, err := strconv.Atoi(item.SrcPort)
+				if err != nil {
+					return
+				}
+				listens[item.Inode] = port
+			})
+		}
+	}
+	return listens
+}
+
 // Tcp func Get a slice of Process type with TCP data
 //func Tcp() []*ConnectionItem {
 //	data, _ := netstat("tcp")
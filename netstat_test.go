@@ -1,10 +1,12 @@
 package netflow
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -38,6 +40,30 @@ func TestParseAddr(t *testing.T) {
 	assert.Equal(t, port, "59544")
 }
 
+func TestParseSocketTimer(t *testing.T) {
+	line := "   2: 0100007F:D5F0 0100007F:BC8F 01 00001000:00000020 01:0000012C 00000002     0        0 54227 2 00000000f0bbb7a6 60 4 0 18 7"
+	conn := getConnectionItem(line)
+	assert.NotNil(t, conn)
+	assert.EqualValues(t, 4096, conn.TxQueue)
+	assert.EqualValues(t, 32, conn.RxQueue)
+	assert.Equal(t, TimerRetransmit, conn.Timer)
+	assert.Equal(t, 3*time.Second, conn.TimerDuration)
+	assert.EqualValues(t, 2, conn.Retransmits)
+	assert.Equal(t, 600*time.Millisecond, conn.Rto)
+	assert.EqualValues(t, 18, conn.Cwnd)
+	assert.EqualValues(t, 7, conn.Ssthresh)
+
+	// sockets in other states are parsed, the orphaned ones as well.
+	conn = getConnectionItem("   3: 0100007F:D5F0 0100007F:BC8F 08 00000000:00000000 00:00000000 00000000     0        0 54228 1 0000000000000000 20 4 0 10 -1")
+	assert.Equal(t, "CLOSE_WAIT", conn.State)
+	assert.EqualValues(t, -1, conn.Ssthresh)
+	assert.False(t, conn.orphaned())
+	conn = getConnectionItem("   4: 0100007F:D5F0 0100007F:BC8F 06 00000000:00000000 03:00001770 00000000     0        0 0 3 0000000000000000")
+	assert.Equal(t, TimerTimeWait, conn.Timer)
+	assert.True(t, conn.orphaned())
+	assert.Nil(t, getConnectionItem("   5: 0100007F:D5F0"))
+}
+
 func TestHandleFile(t *testing.T) {
 	for _, fdn := range []string{"0", "1", "2", "3", "4"} {
 		name := "/proc/994998/fd/" + fdn
@@ -142,3 +168,39 @@ func (self Kind) String() string {
 	// FIXME: bound check?
 	return names[self]
 }
+
+func TestAddConnsState(t *testing.T) {
+	nf := &Netflow{
+		connInodeHash: newConnMapping(),
+		processHash:   NewProcessController(context.Background()),
+		sendQueues:    newSendQueueTable(),
+	}
+	nf.processHash.Add("100", &Process{Pid: "100"})
+	nf.processHash.inodePidMap["54227"] = "100"
+	nf.processHash.inodePidMap["54228"] = "100"
+
+	var (
+		established = getConnectionItem("   2: 0100007F:D5F0 0200007F:0050 01 00000000:00000000 00:00000000 00000000     0        0 54227 1 0000000000000000 20 4 0 10 -1")
+		closing     = getConnectionItem("   3: 0100007F:D5F1 0200007F:0050 08 00001000:00000000 01:0000012C 00000000     0        0 54228 1 0000000000000000 20 4 0 10 -1")
+		orphan1     = getConnectionItem("   4: 0100007F:D5F2 0200007F:0050 04 00000800:00000000 01:0000012C 00000000     0        0 0 1 0000000000000000 20 4 0 10 -1")
+		orphan2     = getConnectionItem("   5: 0100007F:D5F3 0200007F:0050 09 00000400:00000000 01:0000012C 00000000     0        0 0 1 0000000000000000 20 4 0 10 -1")
+		conns       = newConnCounter(nf.processHash, true)
+	)
+	nf.sendQueues.begin()
+	nf.addConns(1700000000, []*ConnectionItem{established, closing, orphan1, orphan2}, conns)
+
+	// sockets of any state are mapped and counted into processes, the
+	// orphaned ones aren't.
+	assert.Equal(t, 4, nf.connInodeHash.length())
+	inode, _ := nf.connInodeHash.get("", closing.reverseKey)
+	assert.Equal(t, "54228", inode)
+	_, ok := nf.connInodeHash.get("", orphan1.key)
+	assert.False(t, ok)
+	assert.Equal(t, map[string]int{"ESTABLISHED": 1, "CLOSE_WAIT": 1}, conns.states["100"])
+	assert.EqualValues(t, [2]int64{4096, 0}, conns.queues["100"])
+
+	// the unsent bytes of each orphaned socket are tracked apart.
+	assert.Equal(t, 3, len(nf.sendQueues.dict))
+	assert.EqualValues(t, 2048, nf.sendQueues.dict[queueKey{key: orphan1.key}].conn.TxQueue)
+	assert.EqualValues(t, 1024, nf.sendQueues.dict[queueKey{key: orphan2.key}].conn.TxQueue)
+}
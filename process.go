@@ -1,6 +1,7 @@
 package netflow
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -8,135 +9,135 @@ import (
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var (
-	maxRingSize = 61
-)
-
 type Process struct {
 	Name         string             `json:"name"`
 	Pid          string             `json:"pid"`
 	Exe          string             `json:"exe"`
+	Uid          int                `json:"uid"`
 	State        string             `json:"state"`
 	InodeCount   int                `json:"inode_count"`
 	TrafficStats *trafficStatsEntry `json:"traffic_stats"`
 
-	// todo: use ringbuffer array to reduce gc cost.
-	Ring []*trafficEntry `json:"ring"`
+	// process tree, resolved from /proc/<pid>/stat and /proc/<pid>/cmdline
+	PPid      string `json:"ppid"`
+	Pgid      string `json:"pgid"`
+	StartTime int64  `json:"start_time"`
+	Cmdline   string `json:"cmdline"`
 
-	inodes   []string
-	revision int
-}
+	// ports of listening sockets owned by the process
+	ListenPorts []int `json:"listen_ports"`
 
-func (p *Process) getLastTrafficEntry() *trafficEntry {
-	if len(p.Ring) == 0 {
-		return nil
-	}
-	return p.Ring[len(p.Ring)-1]
-}
+	// tcp sockets by state, eg: ESTABLISHED -> 10, it's replaced by rescans.
+	Connections map[string]int `json:"connections"`
 
-func (p *Process) analyseStats(sec int) {
-	var (
-		stats = new(trafficStatsEntry)
-		thold = time.Now().Add(-time.Duration(sec) * time.Second).Unix()
-	)
+	// container attribution, resolved from /proc/<pid>/cgroup
+	Cgroup      string `json:"cgroup"`
+	ContainerID string `json:"container_id"`
+	Runtime     string `json:"runtime"`
+	PodUID      string `json:"pod_uid"`
+	Unit        string `json:"unit"`
 
-	// avoid x / 0 to raise exception
-	if sec == 0 {
-		return
-	}
+	// inode of network namespace, the socket table is read from it.
+	Netns string `json:"netns"`
 
-	for _, item := range p.Ring {
-		if item.Timestamp < thold {
-			continue
-		}
-		stats.In += item.In
-		stats.Out += item.Out
-	}
+	// snapshot of ring, only filled in the copies returned by rank apis.
+	Ring []*trafficEntry `json:"ring"`
 
-	stats.InRate = stats.In / int64(sec)
-	stats.OutRate = stats.Out / int64(sec)
-	p.TrafficStats = stats
-}
+	// traffic history, it's increased by workers concurrently.
+	series *trafficSeries
 
-func (po *Process) shrink() {
-	if len(po.Ring) >= maxRingSize {
-		po.Ring = po.Ring[1:] // reduce size
-	}
+	inodes     []string
+	revision   int
+	startTicks int64 // from /proc/<pid>/stat, it tells the reuse of pid
 }
 
-func (po *Process) IncreaseInput(n int64) {
-	now := time.Now().Unix()
-	if len(po.Ring) == 0 {
-		item := &trafficEntry{
-			Timestamp: now,
-			In:        n,
-		}
-		po.Ring = append(po.Ring, item)
-		return
+// getSeries return the series created by the controller, the lazy creation
+// is only for zero Process used in a single goroutine.
+func (p *Process) getSeries() *trafficSeries {
+	if p.series == nil {
+		p.series = newTrafficSeries(defaultRetention)
 	}
+	return p.series
+}
 
-	po.shrink()
+func (p *Process) getLastTrafficEntry() *trafficEntry {
+	return p.getSeries().last()
+}
 
-	item := po.Ring[len(po.Ring)-1]
-	if item.Timestamp == now {
-		item.In += n
+func (p *Process) analyseStats(sec int) {
+	// avoid x / 0 to raise exception
+	if sec <= 0 {
 		return
 	}
 
-	item = &trafficEntry{
-		Timestamp: now,
-		In:        n,
-	}
-	po.Ring = append(po.Ring, item)
+	p.TrafficStats = p.getSeries().analyse(sec)
+}
+
+// IncreaseInput is safe for concurrent use.
+func (po *Process) IncreaseInput(n int64) {
+	po.getSeries().increase(n, inputSide)
 }
 
-// IncreaseOutput
+// IncreaseOutput is safe for concurrent use.
 func (po *Process) IncreaseOutput(n int64) {
-	// todo: format code
-	now := time.Now().Unix()
-	if len(po.Ring) == 0 {
-		item := &trafficEntry{
-			Timestamp: now,
-			Out:       n,
-		}
-		po.Ring = append(po.Ring, item)
-		return
-	}
+	po.getSeries().increase(n, outputSide)
+}
 
-	po.shrink()
+// increasePackets count the packets of process.
+func (po *Process) increasePackets(n int64, side sideOption) {
+	po.getSeries().increasePackets(n, side)
+}
 
-	item := po.Ring[len(po.Ring)-1]
-	if item.Timestamp == now {
-		item.Out += n
-		return
-	}
+// increaseConns count the connections opened by SYNs.
+func (po *Process) increaseConns(n int64, side sideOption) {
+	po.getSeries().increaseConns(n, side)
+}
 
-	item = &trafficEntry{
-		Timestamp: now,
-		Out:       n,
-	}
-	po.Ring = append(po.Ring, item)
+// increaseTCP count the tcp health of the flows of process.
+func (po *Process) increaseTCP(c *tcpCounters) {
+	po.getSeries().increaseTCP(c)
+}
+
+// increaseOuter count the billed bytes of tunnel packets.
+func (po *Process) increaseOuter(n int64, side sideOption) {
+	po.getSeries().increaseOuter(n, side)
 }
 
 func (p *Process) copy() *Process {
+	return p.snapshot(p.TrafficStats)
+}
+
+// snapshot return the copy of process with stats, nothing is shared with the
+// live process, so it's safe to serialize concurrently.
+func (p *Process) snapshot(stats *trafficStatsEntry) *Process {
 	return &Process{
-		Name:       p.Name,
-		Pid:        p.Pid,
-		Exe:        p.Exe,
-		State:      p.State,
-		InodeCount: p.InodeCount,
-		TrafficStats: &trafficStatsEntry{
-			In:      p.TrafficStats.In,
-			Out:     p.TrafficStats.Out,
-			InRate:  p.TrafficStats.InRate,
-			OutRate: p.TrafficStats.OutRate,
-		},
-		Ring: p.Ring,
+		Name:         p.Name,
+		Pid:          p.Pid,
+		Exe:          p.Exe,
+		Uid:          p.Uid,
+		State:        p.State,
+		InodeCount:   p.InodeCount,
+		Cgroup:       p.Cgroup,
+		ContainerID:  p.ContainerID,
+		Runtime:      p.Runtime,
+		PodUID:       p.PodUID,
+		Unit:         p.Unit,
+		Netns:        p.Netns,
+		PPid:         p.PPid,
+		Pgid:         p.Pgid,
+		StartTime:    p.StartTime,
+		Cmdline:      p.Cmdline,
+		ListenPorts:  append([]int(nil), p.ListenPorts...),
+		Connections:  copyStates(p.Connections),
+		TrafficStats: stats.copyStats(),
+		Ring:         p.getSeries().entries(),
 	}
 }
 
@@ -144,6 +145,22 @@ type trafficEntry struct {
 	Timestamp int64 `json:"timestamp"`
 	In        int64 `json:"in"`
 	Out       int64 `json:"out"`
+	OuterIn   int64 `json:"outer_in,omitempty"`
+	OuterOut  int64 `json:"outer_out,omitempty"`
+
+	InPackets  int64 `json:"in_packets,omitempty"`
+	OutPackets int64 `json:"out_packets,omitempty"`
+
+	NewConnsIn  int64 `json:"new_conns_in,omitempty"`
+	NewConnsOut int64 `json:"new_conns_out,omitempty"`
+	NewSockets  int64 `json:"new_sockets,omitempty"`
+
+	// average bytes in the socket queues of rescans.
+	TxQueue int64 `json:"tx_queue,omitempty"`
+	RxQueue int64 `json:"rx_queue,omitempty"`
+
+	tcp        tcpCounters
+	queueScans int64
 }
 
 type trafficStatsEntry struct {
@@ -153,71 +170,245 @@ type trafficStatsEntry struct {
 	OutRate    int64 `json:"out_rate"`
 	InputEWMA  int64 `json:"input_ewma" valid:"-"`
 	OutputEWMA int64 `json:"output_ewma" valid:"-"`
+
+	// billed bytes of tunnel packets, only counted with WithTunnelOuterBytes.
+	OuterIn  int64 `json:"outer_in,omitempty"`
+	OuterOut int64 `json:"outer_out,omitempty"`
+
+	// packets in the window, they're estimated as bytes when sampling.
+	InPackets     int64 `json:"in_packets"`
+	OutPackets    int64 `json:"out_packets"`
+	InPacketRate  int64 `json:"in_packet_rate"`
+	OutPacketRate int64 `json:"out_packet_rate"`
+
+	// connections opened in the window, SYNs are accepted (in) or initiated
+	// (out), new sockets are the diffs of socket tables between rescans.
+	NewConnsIn  int64 `json:"new_conns_in"`
+	NewConnsOut int64 `json:"new_conns_out"`
+	NewSockets  int64 `json:"new_sockets"`
+	NewConnRate int64 `json:"new_conn_rate"`
+
+	// health of the tcp flows, it's counted from the packets of known processes.
+	TCP TCPHealth `json:"tcp"`
+
+	// bytes in the socket queues of the process, sampled by rescans.
+	Backlog BacklogStats `json:"backlog"`
+
+	// bytes are estimated from 1 of SampleRate packets, 1 means no sampling.
+	SampleRate float64 `json:"sample_rate"`
+
+	// distribution of rates in the window, bursts are the max average rate
+	// of BurstWindow seconds.
+	InRates     RateStats `json:"in_rates"`
+	OutRates    RateStats `json:"out_rates"`
+	BurstWindow int64     `json:"burst_window"`
+
+	// rates of buckets ordered by time, groups fold them.
+	inRates  []int64
+	outRates []int64
+	step     int64
+}
+
+// copyStats return the exported fields of stats.
+func (stats *trafficStatsEntry) copyStats() *trafficStatsEntry {
+	return &trafficStatsEntry{
+		In:            stats.In,
+		Out:           stats.Out,
+		InRate:        stats.InRate,
+		OutRate:       stats.OutRate,
+		InputEWMA:     stats.InputEWMA,
+		OutputEWMA:    stats.OutputEWMA,
+		OuterIn:       stats.OuterIn,
+		OuterOut:      stats.OuterOut,
+		InPackets:     stats.InPackets,
+		OutPackets:    stats.OutPackets,
+		InPacketRate:  stats.InPacketRate,
+		OutPacketRate: stats.OutPacketRate,
+		NewConnsIn:    stats.NewConnsIn,
+		NewConnsOut:   stats.NewConnsOut,
+		NewSockets:    stats.NewSockets,
+		NewConnRate:   stats.NewConnRate,
+		TCP:           stats.TCP,
+		Backlog:       stats.Backlog,
+		SampleRate:    stats.SampleRate,
+		InRates:       stats.InRates,
+		OutRates:      stats.OutRates,
+		BurstWindow:   stats.BurstWindow,
+	}
 }
 
 func GetProcesses(nameFilter string) (map[string]*Process, error) {
+	var sel Selector
+	if nameFilter != "" {
+		sel = SelectName(nameFilter)
+	}
+	return GetSelectedProcesses(sel)
+}
+
+// GetSelectedProcesses scan processes owning sockets and matching the selector, nil selector matches all.
+func GetSelectedProcesses(sel Selector) (map[string]*Process, error) {
+	return scanProcesses(sel, nil)
+}
+
+// scanProcesses scan processes like GetSelectedProcesses, the meta of known
+// processes is reused, so rescans don't read all of /proc/<pid> again.
+func scanProcesses(sel Selector, known map[string]*Process) (map[string]*Process, error) {
 	ppm := make(map[string]*Process, 10000)
-	label := "socket:["
 
-	// 获取与 nameFilter 匹配的进程 PID 列表
-	pidList, err := getMatchingPIDs(nameFilter)
+	// 获取与 selector 匹配的进程 PID 列表
+	candidates, err := getMatchingPIDs(sel, known)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, pid := range pidList {
-		fdPath := fmt.Sprintf("/proc/%s/fd", pid)
-		files, err := filepath.Glob(filepath.Join(fdPath, "[0-9]*"))
-		if err != nil {
-			continue // 如果出错，跳过这个进程
+	var listens map[string]int
+	if selectorNeedSockets(sel) {
+		listens = getListenSockets()
+	}
+
+	for pid, po := range candidates {
+		inodes := getProcessInodes(pid)
+		if len(inodes) == 0 {
+			continue
 		}
 
-		for _, fpath := range files {
-			name, err := os.Readlink(fpath)
-			if err != nil || !strings.HasPrefix(name, label) {
-				continue
-			}
+		if po == nil {
+			po = loadProcess(pid, known[pid])
+		}
+		po.inodes = inodes
+		po.InodeCount = len(inodes)
 
-			inode := name[len(label) : len(name)-1]
-
-			po, exists := ppm[pid]
-			if exists {
-				po.inodes = append(po.inodes, inode)
-				po.InodeCount++
-			} else {
-				exe := getProcessExe(pid)
-				ppm[pid] = &Process{
-					Pid:          pid,
-					inodes:       []string{inode},
-					InodeCount:   1,
-					Name:         nameFilter,
-					Exe:          exe,
-					TrafficStats: new(trafficStatsEntry),
-				}
+		for _, inode := range inodes {
+			port, ok := listens[inode]
+			if ok {
+				po.ListenPorts = append(po.ListenPorts, port)
 			}
 		}
+
+		if sel != nil && !sel.Match(po) {
+			continue
+		}
+		ppm[pid] = po
 	}
 
 	return ppm, nil
 }
 
-// 获取与 nameFilter 匹配的所有 PID
-func getMatchingPIDs(nameFilter string) ([]string, error) {
-	pids := []string{}
+// getProcessInodes return inodes of sockets opened by the process.
+func getProcessInodes(pid string) []string {
+	label := "socket:["
+	fdPath := fmt.Sprintf("/proc/%s/fd", pid)
+	files, err := filepath.Glob(filepath.Join(fdPath, "[0-9]*"))
+	if err != nil {
+		return nil // 如果出错，跳过这个进程
+	}
+
+	var inodes []string
+	for _, fpath := range files {
+		name, err := os.Readlink(fpath)
+		if err != nil || !strings.HasPrefix(name, label) {
+			continue
+		}
+
+		inodes = append(inodes, name[len(label):len(name)-1])
+	}
+	return inodes
+}
+
+// newProcess load meta of process from /proc/<pid>
+func newProcess(pid string) *Process {
+	exe := getProcessExe(pid)
+	cg := getProcessCgroup(pid)
+	po := &Process{
+		Pid:          pid,
+		Name:         getProcessName(exe),
+		Exe:          exe,
+		Uid:          getProcessUid(pid),
+		TrafficStats: new(trafficStatsEntry),
+		Cgroup:       cg.Path,
+		ContainerID:  cg.ContainerID,
+		Runtime:      cg.Runtime,
+		PodUID:       cg.PodUID,
+		Unit:         cg.Unit,
+		Netns:        getProcessNetns(pid),
+		Cmdline:      getProcessCmdline(pid),
+	}
+	if stat, err := readProcStat(pid); err == nil {
+		po.State = stat.State
+		po.PPid = stat.PPid
+		po.Pgid = stat.Pgid
+		po.StartTime = stat.StartTime
+		po.startTicks = stat.startTicks
+	}
+	return po
+}
+
+// refresh update the meta changed while the process runs, the caller holds
+// the lock of controller.
+func (p *Process) refresh(po *Process) {
+	p.inodes = po.inodes
+	p.InodeCount = po.InodeCount
+	p.ListenPorts = po.ListenPorts
+	p.State = po.State
+	p.Uid = po.Uid
+	p.PPid = po.PPid
+	p.Pgid = po.Pgid
+	p.Cmdline = po.Cmdline
+}
+
+// loadProcess return the process of pid, the exe, cgroup and netns are copied
+// from the known process when it's the same one by the start time, as pids
+// are reused. the state, parent, user and cmdline are always read again.
+func loadProcess(pid string, known *Process) *Process {
+	if known == nil {
+		return newProcess(pid)
+	}
+
+	stat, err := readProcStat(pid)
+	if err != nil || stat.startTicks != known.startTicks {
+		return newProcess(pid)
+	}
+
+	return &Process{
+		Pid:          pid,
+		Name:         known.Name,
+		Exe:          known.Exe,
+		Uid:          getProcessUid(pid),
+		State:        stat.State,
+		TrafficStats: new(trafficStatsEntry),
+		PPid:         stat.PPid,
+		Pgid:         stat.Pgid,
+		StartTime:    stat.StartTime,
+		Cmdline:      getProcessCmdline(pid),
+		Cgroup:       known.Cgroup,
+		ContainerID:  known.ContainerID,
+		Runtime:      known.Runtime,
+		PodUID:       known.PodUID,
+		Unit:         known.Unit,
+		Netns:        known.Netns,
+		startTicks:   known.startTicks,
+	}
+}
+
+// 获取与 selector 匹配的所有 PID, the value is the process loaded for matching,
+// nil means it's not loaded yet.
+func getMatchingPIDs(sel Selector, known map[string]*Process) (map[string]*Process, error) {
 	procDirs, err := filepath.Glob("/proc/[0-9]*")
 	if err != nil {
 		return nil, err
 	}
+
+	pids := make(map[string]*Process, len(procDirs))
 	for _, procDir := range procDirs {
 		pid := filepath.Base(procDir)
-		exe := getProcessExe(pid)
-		pname := getProcessName(exe)
-		if nameFilter != "" {
-			if pname == nameFilter {
-				pids = append(pids, pid)
-			}
-		} else {
-			pids = append(pids, pid)
+		if sel == nil {
+			pids[pid] = nil
+			continue
+		}
+
+		po := loadProcess(pid, known[pid])
+		if preMatch(sel, po) {
+			pids[pid] = po
 		}
 	}
 
@@ -271,6 +462,7 @@ func GetProcesses1(nameFilter string) (map[string]*Process, error) {
 			Name:         pname,
 			Exe:          exe,
 			TrafficStats: new(trafficStatsEntry),
+			series:       newTrafficSeries(defaultRetention),
 		}
 	}
 
@@ -285,14 +477,15 @@ type processController struct {
 
 	// key -> pid, val -> process
 	dict     map[string]*Process
-	revision int
+	revision int64 // atomic, increased on every rescan
 
 	// key -> inode_num, val -> pid_num
 	inodePidMap map[string]string
 
 	// cache
 	sortedProcesses sortedProcesses
-	filterPName     string
+	selector        Selector
+	retention       Retention
 }
 
 func NewProcessController(ctx context.Context) *processController {
@@ -306,6 +499,7 @@ func NewProcessController(ctx context.Context) *processController {
 		cancel:      cancel,
 		dict:        make(map[string]*Process, size),
 		inodePidMap: make(map[string]string, size),
+		retention:   defaultRetention,
 	}
 }
 
@@ -319,17 +513,60 @@ func (pm *processController) GetRank(limit int) []*Process {
 	}
 
 	// copy object
-	res := []*Process{}
+	res := make([]*Process, 0, len(src))
 	for _, item := range src {
 		res = append(res, item.copy())
 	}
-	return src
+	return res
 }
 
-func (pm *processController) Sort(sec int) []*Process {
+// GetSelectedRank return copies of the top processes matching the selector.
+func (pm *processController) GetSelectedRank(sel Selector, limit int) []*Process {
+	pm.RLock()
+	defer pm.RUnlock()
+
+	src := FilterProcesses(pm.sortedProcesses, sel)
+	if len(src) > limit {
+		src = src[:limit]
+	}
+
+	res := make([]*Process, 0, len(src))
+	for _, item := range src {
+		res = append(res, item.copy())
+	}
+	return res
+}
+
+// GetGroupRank fold the sorted processes by kind and return the top groups,
+// parents are read from /proc, so processes are folded out of the lock.
+func (pm *processController) GetGroupRank(kind GroupKind, limit int) []*ProcessGroup {
+	groups := groupProcesses(pm.sortedSnapshot(), kind)
+	if len(groups) > limit {
+		groups = groups[:limit]
+	}
+	return groups
+}
+
+// sortedSnapshot return the shallow copies of sorted processes, stats, ports
+// and connections of processes are replaced rather than changed, so they're
+// shared with the copies.
+func (pm *processController) sortedSnapshot() []*Process {
 	pm.RLock()
 	defer pm.RUnlock()
 
+	res := make([]*Process, 0, len(pm.sortedProcesses))
+	for _, po := range pm.sortedProcesses {
+		cp := *po
+		res = append(res, &cp)
+	}
+	return res
+}
+
+// Sort analyse the stats of processes, it takes the write lock as stats are replaced.
+func (pm *processController) Sort(sec int) []*Process {
+	pm.Lock()
+	defer pm.Unlock()
+
 	pos := sortedProcesses{}
 	for _, po := range pm.dict {
 		po.analyseStats(sec)
@@ -368,6 +605,11 @@ func (pm *processController) GetProcessByInode(inode string) *Process {
 	return pm.dict[pid]
 }
 
+// getRevision return the revision of rescan, caches of processes are invalid after it changes.
+func (pm *processController) getRevision() int64 {
+	return atomic.LoadInt64(&pm.revision)
+}
+
 func (pm *processController) delete(pid string) {
 	pm.Lock()
 	defer pm.Unlock()
@@ -394,11 +636,10 @@ func (pm *processController) anyIterator(fn func(*Process)) {
 }
 
 func (pm *processController) copy() map[string]*Process {
-	ndict := make(map[string]*Process, len(pm.dict))
-
 	pm.RLock()
 	defer pm.RUnlock()
 
+	ndict := make(map[string]*Process, len(pm.dict))
 	for k, v := range pm.dict {
 		ndict[k] = v
 	}
@@ -449,7 +690,7 @@ func (pm *processController) analyse() error {
 }
 
 func (pm *processController) Rescan() error {
-	ps, err := GetProcesses(pm.filterPName)
+	ps, err := scanProcesses(pm.selector, pm.copy())
 	if err != nil {
 		return err
 	}
@@ -457,16 +698,17 @@ func (pm *processController) Rescan() error {
 	pm.Lock()
 	defer pm.Unlock()
 
-	pm.revision++
+	atomic.AddInt64(&pm.revision, 1)
 
-	// add new pid
+	// add new pid, a reused pid is a new process.
 	for pid, po := range ps {
 		pp, ok := pm.dict[pid]
-		if ok {
-			pp.inodes = po.inodes
+		if ok && pp.startTicks == po.startTicks {
+			pp.refresh(po)
 			continue // alread exist
 		}
 
+		po.series = newTrafficSeries(pm.retention)
 		pm.dict[pid] = po
 	}
 
@@ -504,6 +746,34 @@ func getProcessExe(pid string) string {
 	return path
 }
 
+// getProcessUid return the real uid of process, -1 means unknown.
+func getProcessUid(pid string) int {
+	f, err := os.Open(fmt.Sprintf("/proc/%s/status", pid))
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Uid:") {
+			continue
+		}
+
+		fields := strings.Fields(line[len("Uid:"):])
+		if len(fields) == 0 {
+			return -1
+		}
+		uid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return -1
+		}
+		return uid
+	}
+	return -1
+}
+
 // getProcessName
 func getProcessName(exe string) string {
 	n := strings.Split(exe, "/")
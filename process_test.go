@@ -4,7 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
+	"os"
 	"sort"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -154,3 +158,80 @@ func TestSortedProcesses(t *testing.T) {
 		assert.Equal(t, link[idx].Pid, pps[idx].Pid)
 	}
 }
+
+func TestLoadKnownProcess(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	po := newProcess(pid)
+	assert.NotZero(t, po.startTicks)
+
+	// the meta of the same process is reused, the cmdline is read again.
+	known := &Process{Pid: pid, Exe: "/known/exe", Name: "known", Cmdline: "old", startTicks: po.startTicks}
+	loaded := loadProcess(pid, known)
+	assert.Equal(t, "/known/exe", loaded.Exe)
+	assert.Equal(t, "known", loaded.Name)
+	assert.Equal(t, po.Cmdline, loaded.Cmdline)
+	assert.Equal(t, po.PPid, loaded.PPid)
+
+	// the pid is reused by another process.
+	known.startTicks++
+	loaded = loadProcess(pid, known)
+	assert.Equal(t, po.Exe, loaded.Exe)
+	assert.Equal(t, po.startTicks, loaded.startTicks)
+
+	// processes owning sockets are scanned.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+
+	ps, err := scanProcesses(nil, map[string]*Process{pid: {Pid: pid, Exe: "/known/exe", startTicks: po.startTicks}})
+	assert.Nil(t, err)
+	assert.Equal(t, "/known/exe", ps[pid].Exe)
+	assert.NotZero(t, ps[pid].InodeCount)
+}
+
+func TestRescanRefresh(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+
+	var (
+		pm   = NewProcessController(context.Background())
+		pid  = strconv.Itoa(os.Getpid())
+		self = newProcess(pid)
+	)
+
+	// the meta changed while running is refreshed, the entry is kept.
+	live := &Process{Pid: pid, Exe: "/known/exe", Cmdline: "old", PPid: "0", startTicks: self.startTicks}
+	pm.Add(pid, live)
+	assert.Nil(t, pm.Rescan())
+	assert.True(t, live == pm.Get(pid))
+	assert.Equal(t, "/known/exe", live.Exe)
+	assert.Equal(t, self.Cmdline, live.Cmdline)
+	assert.Equal(t, self.PPid, live.PPid)
+	assert.NotZero(t, live.InodeCount)
+
+	// the pid is reused, the entry is recreated.
+	stale := &Process{Pid: pid, Exe: "/known/exe", startTicks: self.startTicks + 1}
+	pm.Add(pid, stale)
+	assert.Nil(t, pm.Rescan())
+	assert.False(t, stale == pm.Get(pid))
+	assert.Equal(t, self.Exe, pm.Get(pid).Exe)
+
+	// parents are resolved while rescans hold the lock.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 3; i++ {
+			pm.Rescan()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 3; i++ {
+			pm.Sort(1)
+			pm.GetGroupRank(GroupByParent, 10)
+		}
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,178 @@
+package netflow
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// USER_HZ, it's 100 on almost all linux platforms.
+	clockTicks = 100
+)
+
+var (
+	errInvalidStat = errors.New("invalid /proc/<pid>/stat")
+
+	bootTimeOnce sync.Once
+	bootTime     int64
+)
+
+// procStat is the part of /proc/<pid>/stat used to build the process tree.
+type procStat struct {
+	State     string
+	PPid      string
+	Pgid      string
+	StartTime int64 // unix seconds
+
+	// start time in clock ticks since boot, a reused pid has another one.
+	startTicks int64
+}
+
+// readProcStat parse /proc/<pid>/stat
+func readProcStat(pid string) (*procStat, error) {
+	bs, err := os.ReadFile(fmt.Sprintf("/proc/%s/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	return parseProcStat(string(bs))
+}
+
+func parseProcStat(line string) (*procStat, error) {
+	// comm may contain spaces and brackets, so cut at the last ')'.
+	idx := strings.LastIndexByte(line, ')')
+	if idx < 0 || idx+2 > len(line) {
+		return nil, errInvalidStat
+	}
+
+	// fields after comm start from the 3rd field: state ppid pgrp session ...
+	fields := strings.Fields(line[idx+2:])
+	if len(fields) < 20 {
+		return nil, errInvalidStat
+	}
+
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return nil, errInvalidStat
+	}
+
+	return &procStat{
+		State:      fields[0],
+		PPid:       fields[1],
+		Pgid:       fields[2],
+		StartTime:  getBootTime() + ticks/clockTicks,
+		startTicks: ticks,
+	}, nil
+}
+
+// getBootTime read btime of /proc/stat once.
+func getBootTime() int64 {
+	bootTimeOnce.Do(func() {
+		f, err := os.Open("/proc/stat")
+		if err != nil {
+			return
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "btime ") {
+				continue
+			}
+			bootTime, _ = strconv.ParseInt(strings.TrimSpace(line[len("btime "):]), 10, 64)
+			return
+		}
+	})
+	return bootTime
+}
+
+// getProcessCmdline read /proc/<pid>/cmdline, the args are joined by space.
+func getProcessCmdline(pid string) string {
+	bs, err := os.ReadFile(fmt.Sprintf("/proc/%s/cmdline", pid))
+	if err != nil {
+		return ""
+	}
+	return parseCmdline(bs)
+}
+
+func parseCmdline(bs []byte) string {
+	bs = bytes.TrimRight(bs, "\x00")
+	return string(bytes.ReplaceAll(bs, []byte{0}, []byte{' '}))
+}
+
+// processTree resolve the ancestor of process, processes outside of the
+// rank are loaded from /proc lazily and cached for one query.
+type processTree struct {
+	nodes map[string]*treeNode
+}
+
+type treeNode struct {
+	pid  string
+	ppid string
+	exe  string
+}
+
+func newProcessTree(pos []*Process) *processTree {
+	tree := &processTree{
+		nodes: make(map[string]*treeNode, len(pos)),
+	}
+	for _, po := range pos {
+		tree.nodes[po.Pid] = &treeNode{
+			pid:  po.Pid,
+			ppid: po.PPid,
+			exe:  po.Exe,
+		}
+	}
+	return tree
+}
+
+func (t *processTree) get(pid string) *treeNode {
+	node, ok := t.nodes[pid]
+	if ok {
+		return node
+	}
+
+	// cache the miss as nil to avoid reading /proc again.
+	t.nodes[pid] = nil
+	stat, err := readProcStat(pid)
+	if err != nil {
+		return nil
+	}
+
+	node = &treeNode{
+		pid:  pid,
+		ppid: stat.PPid,
+		exe:  getProcessExe(pid),
+	}
+	t.nodes[pid] = node
+	return node
+}
+
+// serviceRoot fold worker processes into their master, it walks up the
+// parents while they run the same executable, eg: nginx worker -> nginx master.
+func (t *processTree) serviceRoot(pid string) string {
+	node := t.get(pid)
+	if node == nil {
+		return pid
+	}
+
+	root := node
+	for depth := 0; depth < 64; depth++ {
+		if root.ppid == "" || root.ppid == "0" || root.ppid == "1" {
+			break
+		}
+
+		parent := t.get(root.ppid)
+		if parent == nil || parent.exe == "" || parent.exe != root.exe {
+			break
+		}
+		root = parent
+	}
+	return root.pid
+}
@@ -0,0 +1,54 @@
+package netflow
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProcStat(t *testing.T) {
+	line := "2034103 (nginx: worker (1)) S 2034100 2034100 2034100 0 -1 4194624 1 0 0 0 3 2 0 0 20 0 1 0 12345 1 1 18446744073709551615"
+	stat, err := parseProcStat(line)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "S", stat.State)
+	assert.Equal(t, "2034100", stat.PPid)
+	assert.Equal(t, "2034100", stat.Pgid)
+	assert.Equal(t, getBootTime()+123, stat.StartTime)
+
+	_, err = parseProcStat("2034103 (nginx) S 1")
+	assert.Equal(t, errInvalidStat, err)
+}
+
+func TestReadProcStat(t *testing.T) {
+	stat, err := readProcStat(strconv.Itoa(os.Getpid()))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, strconv.Itoa(os.Getppid()), stat.PPid)
+	assert.NotEqual(t, int64(0), stat.StartTime)
+}
+
+func TestParseCmdline(t *testing.T) {
+	assert.Equal(t, "nginx: worker process", parseCmdline([]byte("nginx: worker process\x00\x00")))
+	assert.Equal(t, "python3 -m http.server 80", parseCmdline([]byte("python3\x00-m\x00http.server\x0080\x00")))
+}
+
+func TestGroupByParent(t *testing.T) {
+	pos := []*Process{
+		{Pid: "100", PPid: "1", Exe: "/usr/sbin/nginx", Name: "Nginx", TrafficStats: &trafficStatsEntry{In: 1}},
+		{Pid: "101", PPid: "100", Exe: "/usr/sbin/nginx", Name: "Nginx", TrafficStats: &trafficStatsEntry{In: 100}},
+		{Pid: "102", PPid: "100", Exe: "/usr/sbin/nginx", Name: "Nginx", TrafficStats: &trafficStatsEntry{In: 100}},
+		{Pid: "200", PPid: "100", Exe: "/usr/bin/php", Name: "Php", TrafficStats: &trafficStatsEntry{In: 10}},
+	}
+
+	groups := groupProcesses(pos, GroupByParent)
+	assert.Equal(t, 2, len(groups))
+	assert.Equal(t, "100", groups[0].Key)
+	assert.Equal(t, []string{"100", "101", "102"}, groups[0].Pids)
+	assert.EqualValues(t, 201, groups[0].TrafficStats.In)
+	assert.Equal(t, "200", groups[1].Key)
+
+	groups = groupProcesses(pos, GroupByExe)
+	assert.Equal(t, 2, len(groups))
+	assert.Equal(t, "/usr/sbin/nginx", groups[0].Key)
+}
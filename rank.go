@@ -0,0 +1,137 @@
+package netflow
+
+import (
+	"errors"
+	"sort"
+)
+
+// SortKey is the value processes are ranked by.
+type SortKey string
+
+const (
+	SortByTotal       SortKey = "total" // in + out, the default
+	SortByIn          SortKey = "in"
+	SortByOut         SortKey = "out"
+	SortByInRate      SortKey = "in_rate"
+	SortByOutRate     SortKey = "out_rate"
+	SortByPackets     SortKey = "packets"      // in + out packets
+	SortByConnections SortKey = "connections"  // sockets owned by the process
+	SortByPPS         SortKey = "pps"          // in + out packets per second
+	SortByNewConns    SortKey = "new_conns"    // connections opened per second
+	SortByActiveConns SortKey = "active_conns" // connections not listening
+	SortByRetrans     SortKey = "retrans"      // retransmitted tcp segments
+	SortByBacklog     SortKey = "backlog"      // average bytes in the send queues
+)
+
+var (
+	errInvalidSortKey = errors.New("invalid sort key")
+)
+
+// RankOptions select and order the processes of rank.
+type RankOptions struct {
+	// recent seconds of stats, it must be within retention.
+	Window int
+
+	SortBy    SortKey
+	Ascending bool
+
+	// size of processes returned, 0 means all.
+	Limit int
+
+	// only the processes matching the selector are ranked, nil matches all.
+	Selector Selector
+
+	// skip the processes without traffic in the window.
+	SkipIdle bool
+}
+
+// sortValue return the value of process for the key.
+func sortValue(po *Process, key SortKey) int64 {
+	stats := po.TrafficStats
+	switch key {
+	case SortByIn:
+		return stats.In
+	case SortByOut:
+		return stats.Out
+	case SortByInRate:
+		return stats.InRate
+	case SortByOutRate:
+		return stats.OutRate
+	case SortByPackets:
+		return stats.InPackets + stats.OutPackets
+	case SortByConnections:
+		return int64(po.InodeCount)
+	case SortByPPS:
+		return stats.InPacketRate + stats.OutPacketRate
+	case SortByNewConns:
+		return stats.NewConnRate
+	case SortByActiveConns:
+		return int64(po.activeConnections())
+	case SortByRetrans:
+		return stats.TCP.Retrans
+	case SortByBacklog:
+		return stats.Backlog.TxQueue
+	}
+	return stats.In + stats.Out
+}
+
+func isValidSortKey(key SortKey) bool {
+	switch key {
+	case "", SortByTotal, SortByIn, SortByOut, SortByInRate, SortByOutRate, SortByPackets, SortByConnections,
+		SortByPPS, SortByNewConns, SortByActiveConns, SortByRetrans, SortByBacklog:
+		return true
+	}
+	return false
+}
+
+// rank analyse the processes into snapshots and sort them, the live processes
+// and the cached rank of Sort aren't changed, so ranks with different options
+// can run concurrently.
+func (pm *processController) rank(opts RankOptions) []*Process {
+	pm.RLock()
+	res := make([]*Process, 0, len(pm.dict))
+	for _, po := range pm.dict {
+		if opts.Selector != nil && !opts.Selector.Match(po) {
+			continue
+		}
+
+		stats := po.getSeries().analyse(opts.Window)
+		if opts.SkipIdle && stats.In+stats.Out == 0 {
+			continue
+		}
+		res = append(res, po.snapshot(stats))
+	}
+	pm.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		vi, vj := sortValue(res[i], opts.SortBy), sortValue(res[j], opts.SortBy)
+		if vi == vj {
+			return res[i].Pid < res[j].Pid
+		}
+		if opts.Ascending {
+			return vi < vj
+		}
+		return vi > vj
+	})
+
+	if opts.Limit > 0 && len(res) > opts.Limit {
+		res = res[:opts.Limit]
+	}
+	return res
+}
+
+// GetProcessRankWithOptions return the snapshots of processes ranked by the options.
+func (nf *Netflow) GetProcessRankWithOptions(opts RankOptions) ([]*Process, error) {
+	if err := nf.checkWindow(opts.Window); err != nil {
+		return nil, err
+	}
+	if !isValidSortKey(opts.SortBy) {
+		return nil, errInvalidSortKey
+	}
+
+	prank := nf.processHash.rank(opts)
+	for _, po := range prank {
+		nf.markSampleRate(po.TrafficStats)
+	}
+	return prank, nil
+}
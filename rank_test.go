@@ -0,0 +1,116 @@
+package netflow
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newRankNetflow() *Netflow {
+	nf := &Netflow{
+		processHash: NewProcessController(context.Background()),
+		retention:   defaultRetention,
+	}
+
+	for _, item := range []struct {
+		pid     string
+		name    string
+		in, out int64
+		packets int64
+		inodes  int
+	}{
+		{"100", "nginx", 1000, 9000, 10, 50},
+		{"101", "curl", 8000, 100, 80, 1},
+		{"102", "redis", 3000, 3000, 300, 20},
+		{"103", "sshd", 0, 0, 0, 2},
+	} {
+		po := &Process{Pid: item.pid, Name: item.name, InodeCount: item.inodes, ListenPorts: []int{80}}
+		po.Connections = map[string]int{"LISTEN": 1, "ESTABLISHED": int(item.packets) / 10}
+		nf.processHash.Add(item.pid, po)
+		if item.in+item.out == 0 {
+			continue
+		}
+		po.IncreaseInput(item.in)
+		po.IncreaseOutput(item.out)
+		po.increasePackets(item.packets, inputSide)
+	}
+	return nf
+}
+
+func rankPids(pos []*Process) []string {
+	var pids []string
+	for _, po := range pos {
+		pids = append(pids, po.Pid)
+	}
+	return pids
+}
+
+func TestRankOptions(t *testing.T) {
+	nf := newRankNetflow()
+
+	cases := []struct {
+		opts RankOptions
+		pids []string
+	}{
+		{RankOptions{Window: 5}, []string{"100", "101", "102", "103"}},
+		{RankOptions{Window: 5, SortBy: SortByOut, Limit: 2}, []string{"100", "102"}},
+		{RankOptions{Window: 5, SortBy: SortByIn}, []string{"101", "102", "100", "103"}},
+		{RankOptions{Window: 5, SortBy: SortByOutRate, Ascending: true}, []string{"103", "101", "102", "100"}},
+		{RankOptions{Window: 5, SortBy: SortByPackets, Limit: 1}, []string{"102"}},
+		{RankOptions{Window: 5, SortBy: SortByConnections}, []string{"100", "102", "103", "101"}},
+		{RankOptions{Window: 5, SkipIdle: true, Ascending: true}, []string{"102", "101", "100"}},
+		{RankOptions{Window: 5, Selector: SelectName("curl")}, []string{"101"}},
+		{RankOptions{Window: 5, SortBy: SortByPPS}, []string{"102", "101", "100", "103"}},
+		{RankOptions{Window: 5, SortBy: SortByActiveConns, Limit: 2}, []string{"102", "101"}},
+	}
+	for _, c := range cases {
+		pos, err := nf.GetProcessRankWithOptions(c.opts)
+		assert.Nil(t, err)
+		assert.Equal(t, c.pids, rankPids(pos), c.opts)
+	}
+
+	_, err := nf.GetProcessRankWithOptions(RankOptions{Window: 5, SortBy: "bytes"})
+	assert.Equal(t, errInvalidSortKey, err)
+	_, err = nf.GetProcessRankWithOptions(RankOptions{})
+	assert.NotNil(t, err)
+	_, err = nf.GetProcessRankWithOptions(RankOptions{Window: 100 * 3600})
+	assert.NotNil(t, err)
+}
+
+func TestRankSnapshot(t *testing.T) {
+	nf := newRankNetflow()
+
+	pos, _ := nf.GetProcessRankWithOptions(RankOptions{Window: 5, Limit: 1})
+	snap := pos[0]
+	assert.EqualValues(t, 10, snap.TrafficStats.InPackets)
+
+	// the snapshot isn't changed by later traffic and ranks.
+	live := nf.processHash.Get(snap.Pid)
+	live.IncreaseInput(5000)
+	snap.ListenPorts[0] = 8080
+	nf.GetProcessRankWithOptions(RankOptions{Window: 60})
+
+	assert.EqualValues(t, 1000, snap.TrafficStats.In)
+	assert.Equal(t, []int{80}, live.ListenPorts)
+	assert.Nil(t, live.TrafficStats)
+
+	// snapshots are serialized while others are ranking.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				pos, err := nf.GetProcessRankWithOptions(RankOptions{Window: 1 + i, SortBy: SortByOut})
+				assert.Nil(t, err)
+				_, err = json.Marshal(pos)
+				assert.Nil(t, err)
+				live.IncreaseOutput(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
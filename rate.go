@@ -0,0 +1,137 @@
+package netflow
+
+import (
+	"sort"
+)
+
+const (
+	// bursts are the max average rate of any 5 seconds in the window.
+	defaultBurstWindow = int64(5)
+)
+
+// RateStats is the distribution of bucket rates in the window, bytes per
+// second. buckets are seconds for short windows, minutes or hours for long
+// windows by retention.
+type RateStats struct {
+	P50   int64 `json:"p50"`
+	P95   int64 `json:"p95"`
+	P99   int64 `json:"p99"`
+	Max   int64 `json:"max"`
+	Burst int64 `json:"burst"`
+}
+
+// setRates fill the ewma, percentiles and bursts from the rates of buckets
+// ordered by time, the rates are kept for folding groups.
+func (stats *trafficStatsEntry) setRates(in, out []int64, step int64) {
+	stats.inRates, stats.outRates, stats.step = in, out, step
+
+	stats.InputEWMA = ewma(in)
+	stats.OutputEWMA = ewma(out)
+	stats.InRates = newRateStats(in, step)
+	stats.OutRates = newRateStats(out, step)
+
+	stats.BurstWindow = defaultBurstWindow
+	if step > stats.BurstWindow {
+		stats.BurstWindow = step
+	}
+}
+
+// setCountRates fill the packets and connections per second of the window. the
+// larger of SYNs and new sockets is the connection rate, SYNs may be missed by
+// sampling, while connections closed between rescans are never seen in socket tables.
+func (stats *trafficStatsEntry) setCountRates(sec int64) {
+	stats.InPacketRate = stats.InPackets / sec
+	stats.OutPacketRate = stats.OutPackets / sec
+
+	conns := stats.NewConnsIn + stats.NewConnsOut
+	if stats.NewSockets > conns {
+		conns = stats.NewSockets
+	}
+	stats.NewConnRate = conns / sec
+}
+
+// addRates add the bucket rates of other stats, it's used by groups, percentiles
+// can't be summed.
+func (stats *trafficStatsEntry) addRates(other *trafficStatsEntry) {
+	if len(other.inRates) == 0 {
+		return
+	}
+
+	in, out := stats.inRates, stats.outRates
+	if len(in) != len(other.inRates) {
+		in = make([]int64, len(other.inRates))
+		out = make([]int64, len(other.outRates))
+	}
+	for idx := range in {
+		in[idx] += other.inRates[idx]
+		out[idx] += other.outRates[idx]
+	}
+	stats.setRates(in, out, other.step)
+}
+
+// ewma smooth the rates with the span of window, alpha = 2 / (n + 1).
+func ewma(rates []int64) int64 {
+	if len(rates) == 0 {
+		return 0
+	}
+
+	var (
+		alpha = 2 / float64(len(rates)+1)
+		avg   = float64(rates[0])
+	)
+	for _, rate := range rates[1:] {
+		avg = alpha*float64(rate) + (1-alpha)*avg
+	}
+	return int64(avg)
+}
+
+func newRateStats(rates []int64, step int64) RateStats {
+	if len(rates) == 0 {
+		return RateStats{}
+	}
+
+	sorted := make([]int64, len(rates))
+	copy(sorted, rates)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	return RateStats{
+		P50:   percentile(sorted, 50),
+		P95:   percentile(sorted, 95),
+		P99:   percentile(sorted, 99),
+		Max:   sorted[len(sorted)-1],
+		Burst: burst(rates, int(defaultBurstWindow/step)),
+	}
+}
+
+// percentile return the nearest rank of sorted rates.
+func percentile(sorted []int64, p int) int64 {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// burst return the max average rate of any size buckets in a row.
+func burst(rates []int64, size int) int64 {
+	if size < 1 {
+		size = 1
+	}
+	if size > len(rates) {
+		size = len(rates)
+	}
+
+	var sum, max int64
+	for idx, rate := range rates {
+		sum += rate
+		if idx >= size {
+			sum -= rates[idx-size]
+		}
+		if idx >= size-1 && sum > max {
+			max = sum
+		}
+	}
+	return max / int64(size)
+}
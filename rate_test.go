@@ -0,0 +1,81 @@
+package netflow
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateStats(t *testing.T) {
+	rates := make([]int64, 0, 100)
+	for i := int64(1); i <= 100; i++ {
+		rates = append(rates, i)
+	}
+
+	stats := newRateStats(rates, 1)
+	assert.Equal(t, RateStats{P50: 50, P95: 95, P99: 99, Max: 100, Burst: 98}, stats)
+
+	// a short burst is found in the idle window.
+	rates = make([]int64, 60)
+	rates[10], rates[11], rates[12] = 1000, 1000, 500
+	stats = newRateStats(rates, 1)
+	assert.EqualValues(t, 0, stats.P95)
+	assert.EqualValues(t, 1000, stats.P99)
+	assert.EqualValues(t, 500, stats.Burst)
+
+	// the burst of minute buckets is the max bucket.
+	assert.EqualValues(t, 1000, newRateStats(rates, 60).Burst)
+	assert.Equal(t, RateStats{}, newRateStats(nil, 1))
+}
+
+func TestEWMA(t *testing.T) {
+	assert.EqualValues(t, 0, ewma(nil))
+	assert.EqualValues(t, 100, ewma([]int64{100, 100, 100}))
+
+	// recent rates weigh more than the mean.
+	rising := ewma([]int64{0, 0, 0, 100, 100})
+	assert.True(t, rising > 40)
+	assert.True(t, rising < 100)
+}
+
+func TestAnalyseRates(t *testing.T) {
+	var (
+		ring = newTrafficRing()
+		now  = int64(1700000000)
+	)
+	for i := int64(0); i < 10; i++ {
+		ring.increaseAt(now-i, 100*i, inputSide)
+	}
+
+	stats := ring.analyseAt(now, 9)
+	assert.Equal(t, 10, len(stats.inRates))
+	assert.EqualValues(t, 900, stats.inRates[0])
+	assert.EqualValues(t, 0, stats.inRates[9])
+	assert.EqualValues(t, 900, stats.InRates.Max)
+	assert.EqualValues(t, 700, stats.InRates.Burst)
+	assert.EqualValues(t, 5, stats.BurstWindow)
+
+	// groups fold the rates of processes before percentiles.
+	group := new(trafficStatsEntry)
+	group.addRates(stats)
+	group.addRates(stats)
+	assert.EqualValues(t, 1800, group.InRates.Max)
+	assert.EqualValues(t, 900, stats.InRates.Max)
+
+	copied := stats.copyStats()
+	assert.Equal(t, stats.InRates, copied.InRates)
+	assert.Nil(t, copied.inRates)
+}
+
+func TestAnalyseRatesOfMinutes(t *testing.T) {
+	var (
+		series = newTrafficSeries(defaultRetention)
+		now    = int64(1700000000)
+	)
+	series.increaseAt(now-600, 6000, outputSide)
+
+	stats := series.analyseAt(now, 900)
+	assert.EqualValues(t, 60, stats.BurstWindow)
+	assert.EqualValues(t, 100, stats.OutRates.Max)
+	assert.EqualValues(t, 0, stats.OutRates.P50)
+}
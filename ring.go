@@ -0,0 +1,459 @@
+package netflow
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// size of the default ring, the last minute at 1s resolution.
+	maxRingSize = 61
+
+	// the bucket is being reset by a writer of the new second.
+	bucketResetting = -1
+)
+
+// trafficBucket is the traffic of one step, all fields are accessed atomically.
+type trafficBucket struct {
+	timestamp int64
+	in        int64
+	out       int64
+
+	// bytes of the outer packets when tunnels are accounted with outer bytes.
+	outerIn  int64
+	outerOut int64
+
+	inPackets  int64
+	outPackets int64
+
+	// connections opened by SYNs, accepted and initiated.
+	connsIn  int64
+	connsOut int64
+
+	// sockets found new in the socket tables by rescans.
+	sockets int64
+
+	// health of tcp flows.
+	tcp tcpCounters
+
+	// socket queues summed by rescans, they're averaged by the scans.
+	txQueue    int64
+	rxQueue    int64
+	queueScans int64
+}
+
+// trafficRing is a fixed size ring of buckets indexed by unix second / step,
+// it's updated by workers with atomic ops and never allocates after created.
+type trafficRing struct {
+	step    int64
+	buckets []trafficBucket
+
+	// the coarser ring, the stale buckets are rolled up into it when they're
+	// reused, so a bucket is either in this ring or in the coarser one.
+	next *trafficRing
+}
+
+func newTrafficRing() *trafficRing {
+	return newStepRing(1, maxRingSize)
+}
+
+// newStepRing create the ring of size buckets, each bucket holds step seconds.
+func newStepRing(step int64, size int) *trafficRing {
+	return &trafficRing{
+		step:    step,
+		buckets: make([]trafficBucket, size),
+	}
+}
+
+// align return the start of the bucket holding the second.
+func (r *trafficRing) align(ts int64) int64 {
+	return ts - ts%r.step
+}
+
+// span return the seconds covered by the ring, the bucket being written isn't full.
+func (r *trafficRing) span() int64 {
+	return int64(len(r.buckets)-1) * r.step
+}
+
+// increase add n to the bucket of current second.
+func (r *trafficRing) increase(n int64, side sideOption) {
+	r.increaseAt(time.Now().Unix(), n, side)
+}
+
+func (r *trafficRing) increaseAt(now int64, n int64, side sideOption) {
+	bucket := r.bucketAt(now)
+	if bucket == nil {
+		return
+	}
+
+	switch side {
+	case inputSide:
+		atomic.AddInt64(&bucket.in, n)
+	case outputSide:
+		atomic.AddInt64(&bucket.out, n)
+	}
+}
+
+// increaseOuter add n to the outer bytes of current second.
+func (r *trafficRing) increaseOuter(n int64, side sideOption) {
+	r.increaseOuterAt(time.Now().Unix(), n, side)
+}
+
+func (r *trafficRing) increaseOuterAt(now int64, n int64, side sideOption) {
+	bucket := r.bucketAt(now)
+	if bucket == nil {
+		return
+	}
+
+	switch side {
+	case inputSide:
+		atomic.AddInt64(&bucket.outerIn, n)
+	case outputSide:
+		atomic.AddInt64(&bucket.outerOut, n)
+	}
+}
+
+// increasePacketsAt add n to the packets of the second.
+func (r *trafficRing) increasePacketsAt(now int64, n int64, side sideOption) {
+	bucket := r.bucketAt(now)
+	if bucket == nil {
+		return
+	}
+
+	switch side {
+	case inputSide:
+		atomic.AddInt64(&bucket.inPackets, n)
+	case outputSide:
+		atomic.AddInt64(&bucket.outPackets, n)
+	}
+}
+
+// increaseConnsAt add n to the connections opened in the second.
+func (r *trafficRing) increaseConnsAt(now int64, n int64, side sideOption) {
+	bucket := r.bucketAt(now)
+	if bucket == nil {
+		return
+	}
+
+	switch side {
+	case inputSide:
+		atomic.AddInt64(&bucket.connsIn, n)
+	case outputSide:
+		atomic.AddInt64(&bucket.connsOut, n)
+	}
+}
+
+// increaseSocketsAt add n to the new sockets of the second.
+func (r *trafficRing) increaseSocketsAt(now int64, n int64) {
+	bucket := r.bucketAt(now)
+	if bucket == nil {
+		return
+	}
+	atomic.AddInt64(&bucket.sockets, n)
+}
+
+// increaseTCPAt add the tcp health counters to the second.
+func (r *trafficRing) increaseTCPAt(now int64, c *tcpCounters) {
+	bucket := r.bucketAt(now)
+	if bucket == nil {
+		return
+	}
+	bucket.tcp.atomicAdd(c)
+}
+
+// increaseBacklogAt add the socket queues of a rescan to the second.
+func (r *trafficRing) increaseBacklogAt(now int64, tx, rx int64) {
+	bucket := r.bucketAt(now)
+	if bucket == nil {
+		return
+	}
+	atomic.AddInt64(&bucket.txQueue, tx)
+	atomic.AddInt64(&bucket.rxQueue, rx)
+	atomic.AddInt64(&bucket.queueScans, 1)
+}
+
+// bucketAt return the bucket of the second, it's reset when it holds a stale step,
+// nil is returned when the second is too old.
+func (r *trafficRing) bucketAt(now int64) *trafficBucket {
+	now = r.align(now)
+	bucket := &r.buckets[now/r.step%int64(len(r.buckets))]
+
+	for {
+		ts := atomic.LoadInt64(&bucket.timestamp)
+		if ts == now {
+			break
+		}
+		if ts == bucketResetting {
+			runtime.Gosched()
+			continue
+		}
+		if ts > now {
+			return nil // too old, the bucket is reused by a newer second.
+		}
+
+		// the first writer of the new second reset the stale bucket.
+		if atomic.CompareAndSwapInt64(&bucket.timestamp, ts, bucketResetting) {
+			stale := bucket.swap()
+			atomic.StoreInt64(&bucket.timestamp, now)
+			if r.next != nil && ts > 0 {
+				r.next.rollUp(ts, &stale)
+			}
+			break
+		}
+	}
+	return bucket
+}
+
+// swap reset the counters of bucket, the old ones are returned, the caller
+// holds the bucket by bucketResetting.
+func (b *trafficBucket) swap() trafficBucket {
+	return trafficBucket{
+		in:         atomic.SwapInt64(&b.in, 0),
+		out:        atomic.SwapInt64(&b.out, 0),
+		outerIn:    atomic.SwapInt64(&b.outerIn, 0),
+		outerOut:   atomic.SwapInt64(&b.outerOut, 0),
+		inPackets:  atomic.SwapInt64(&b.inPackets, 0),
+		outPackets: atomic.SwapInt64(&b.outPackets, 0),
+		connsIn:    atomic.SwapInt64(&b.connsIn, 0),
+		connsOut:   atomic.SwapInt64(&b.connsOut, 0),
+		sockets:    atomic.SwapInt64(&b.sockets, 0),
+		tcp:        b.tcp.atomicSwap(),
+		txQueue:    atomic.SwapInt64(&b.txQueue, 0),
+		rxQueue:    atomic.SwapInt64(&b.rxQueue, 0),
+		queueScans: atomic.SwapInt64(&b.queueScans, 0),
+	}
+}
+
+// rollUp add the stale bucket of a finer ring to the bucket holding ts, it
+// goes to the coarser rings when the bucket is reused already.
+func (r *trafficRing) rollUp(ts int64, stale *trafficBucket) {
+	if *stale == (trafficBucket{}) {
+		return
+	}
+
+	for ring := r; ring != nil; ring = ring.next {
+		if bucket := ring.bucketAt(ts); bucket != nil {
+			bucket.add(stale)
+			return
+		}
+	}
+}
+
+func (b *trafficBucket) add(o *trafficBucket) {
+	atomic.AddInt64(&b.in, o.in)
+	atomic.AddInt64(&b.out, o.out)
+	atomic.AddInt64(&b.outerIn, o.outerIn)
+	atomic.AddInt64(&b.outerOut, o.outerOut)
+	atomic.AddInt64(&b.inPackets, o.inPackets)
+	atomic.AddInt64(&b.outPackets, o.outPackets)
+	atomic.AddInt64(&b.connsIn, o.connsIn)
+	atomic.AddInt64(&b.connsOut, o.connsOut)
+	atomic.AddInt64(&b.sockets, o.sockets)
+	b.tcp.atomicAdd(&o.tcp)
+	atomic.AddInt64(&b.txQueue, o.txQueue)
+	atomic.AddInt64(&b.rxQueue, o.rxQueue)
+	atomic.AddInt64(&b.queueScans, o.queueScans)
+}
+
+// load return a consistent copy of the bucket, ok is false when it's empty or being reset.
+func (b *trafficBucket) load() (trafficEntry, bool) {
+	for {
+		ts := atomic.LoadInt64(&b.timestamp)
+		if ts == 0 || ts == bucketResetting {
+			return trafficEntry{}, false
+		}
+
+		ent := trafficEntry{
+			Timestamp: ts,
+			In:        atomic.LoadInt64(&b.in),
+			Out:       atomic.LoadInt64(&b.out),
+			OuterIn:   atomic.LoadInt64(&b.outerIn),
+			OuterOut:  atomic.LoadInt64(&b.outerOut),
+
+			InPackets:  atomic.LoadInt64(&b.inPackets),
+			OutPackets: atomic.LoadInt64(&b.outPackets),
+
+			NewConnsIn:  atomic.LoadInt64(&b.connsIn),
+			NewConnsOut: atomic.LoadInt64(&b.connsOut),
+			NewSockets:  atomic.LoadInt64(&b.sockets),
+
+			tcp: b.tcp.atomicLoad(),
+		}
+		if scans := atomic.LoadInt64(&b.queueScans); scans > 0 {
+			ent.TxQueue = atomic.LoadInt64(&b.txQueue) / scans
+			ent.RxQueue = atomic.LoadInt64(&b.rxQueue) / scans
+			ent.queueScans = scans
+		}
+		if atomic.LoadInt64(&b.timestamp) == ts {
+			return ent, true
+		}
+	}
+}
+
+// entries return the snapshot of all buckets of the ring, ordered by time.
+func (r *trafficRing) entries() []*trafficEntry {
+	return r.entriesAt(time.Now().Unix())
+}
+
+func (r *trafficRing) entriesAt(now int64) []*trafficEntry {
+	return r.rangeAt(now, now-r.span(), now)
+}
+
+// rangeAt return the buckets starting in [start, end], ordered by time. the
+// buckets of finer rings not rolled up yet are merged into the buckets
+// holding them.
+func (r *trafficRing) rangeAt(now, start, end int64, finer ...*trafficRing) []*trafficEntry {
+	latest := r.align(now)
+	if oldest := latest - r.span(); start < oldest {
+		start = oldest
+	}
+	if end > latest {
+		end = latest
+	}
+
+	first := r.align(start)
+	if first < start {
+		first += r.step
+	}
+	if end < first {
+		return []*trafficEntry{}
+	}
+
+	var (
+		slots = make([]*trafficEntry, (end-first)/r.step+1)
+		count int
+	)
+	r.collect(now, finer, func(ent *trafficEntry) {
+		if ent.Timestamp < first || ent.Timestamp > end {
+			return
+		}
+
+		pos := (ent.Timestamp - first) / r.step
+		if slots[pos] == nil {
+			slots[pos] = ent
+			count++
+			return
+		}
+		slots[pos].merge(ent)
+	})
+
+	res := make([]*trafficEntry, 0, count)
+	for _, ent := range slots {
+		if ent != nil {
+			res = append(res, ent)
+		}
+	}
+	return res
+}
+
+// collect call fn with the buckets of the ring and the buckets of finer rings
+// not rolled up yet, their timestamps are aligned to the step of the ring.
+// buckets after now are skipped.
+func (r *trafficRing) collect(now int64, finer []*trafficRing, fn func(ent *trafficEntry)) {
+	visit := func(ring *trafficRing) {
+		for idx := range ring.buckets {
+			ent, ok := ring.buckets[idx].load()
+			if !ok || ent.Timestamp > now {
+				continue
+			}
+			ent.Timestamp = r.align(ent.Timestamp)
+			fn(&ent)
+		}
+	}
+
+	for _, ring := range finer {
+		visit(ring)
+	}
+	visit(r)
+}
+
+// last return the bucket of the latest second.
+func (r *trafficRing) last() *trafficEntry {
+	var res *trafficEntry
+	for idx := range r.buckets {
+		ent, ok := r.buckets[idx].load()
+		if !ok {
+			continue
+		}
+		if res == nil || ent.Timestamp > res.Timestamp {
+			res = &ent
+		}
+	}
+	return res
+}
+
+// analyse sum the buckets of recent seconds.
+func (r *trafficRing) analyse(sec int) *trafficStatsEntry {
+	return r.analyseAt(time.Now().Unix(), sec)
+}
+
+// analyseAt sum the buckets starting in the window, the buckets of finer rings
+// not rolled up yet are counted into the buckets holding them.
+func (r *trafficRing) analyseAt(now int64, sec int, finer ...*trafficRing) *trafficStatsEntry {
+	// the window is validated by apis, the last second is analysed for others.
+	if sec < 1 {
+		sec = 1
+	}
+
+	var (
+		stats = new(trafficStatsEntry)
+		thold = now - int64(sec)
+		first = r.align(thold + r.step - 1) // the first bucket starting in the window
+		size  = (r.align(now)-first)/r.step + 1
+
+		tcp     tcpCounters
+		backlog backlogCounter
+	)
+	// no bucket starts in a window shorter than the step.
+	if size < 1 {
+		size = 1
+	}
+
+	// the finer buckets are merged first, the max of backlog is of buckets.
+	slots := make([]*trafficEntry, size)
+	r.collect(now, finer, func(ent *trafficEntry) {
+		if ent.Timestamp < thold {
+			return
+		}
+
+		pos := (ent.Timestamp - first) / r.step
+		if slots[pos] == nil {
+			slots[pos] = ent
+			return
+		}
+		slots[pos].merge(ent)
+	})
+
+	// rates of buckets, idle buckets are 0.
+	in := make([]int64, size)
+	out := make([]int64, size)
+
+	for pos, ent := range slots {
+		if ent == nil {
+			continue
+		}
+		stats.In += ent.In
+		stats.Out += ent.Out
+		stats.OuterIn += ent.OuterIn
+		stats.OuterOut += ent.OuterOut
+		stats.InPackets += ent.InPackets
+		stats.OutPackets += ent.OutPackets
+		stats.NewConnsIn += ent.NewConnsIn
+		stats.NewConnsOut += ent.NewConnsOut
+		stats.NewSockets += ent.NewSockets
+		tcp.add(&ent.tcp)
+		backlog.add(ent)
+
+		in[pos] = ent.In / r.step
+		out[pos] = ent.Out / r.step
+	}
+
+	stats.InRate = stats.In / int64(sec)
+	stats.OutRate = stats.Out / int64(sec)
+	stats.setCountRates(int64(sec))
+	stats.TCP = tcp.health()
+	stats.Backlog = backlog.stats()
+	stats.setRates(in, out, r.step)
+	return stats
+}
@@ -0,0 +1,121 @@
+package netflow
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrafficRing(t *testing.T) {
+	var (
+		ring = newTrafficRing()
+		now  = int64(1700000000)
+	)
+
+	ring.increaseAt(now-2, 10, inputSide)
+	ring.increaseAt(now-1, 50, inputSide)
+	ring.increaseAt(now, 100, inputSide)
+	ring.increaseAt(now, 40, outputSide)
+
+	entries := ring.entriesAt(now)
+	assert.Equal(t, 3, len(entries))
+	assert.Equal(t, now-2, entries[0].Timestamp)
+	assert.EqualValues(t, 100, entries[2].In)
+	assert.EqualValues(t, 40, entries[2].Out)
+
+	stats := ring.analyseAt(now, 1)
+	assert.EqualValues(t, 150, stats.In)
+	assert.EqualValues(t, 40, stats.Out)
+
+	// the bucket is reused after a round, old values are dropped.
+	ring.increaseAt(now+maxRingSize, 7, inputSide)
+	entries = ring.entriesAt(now + maxRingSize)
+	assert.Equal(t, 1, len(entries))
+	assert.EqualValues(t, 7, entries[0].In)
+
+	// the writer of an expired second is ignored.
+	ring.increaseAt(now, 1000, inputSide)
+	assert.EqualValues(t, 7, ring.analyseAt(now+maxRingSize, 1).In)
+
+	// a bad window is the last second.
+	assert.EqualValues(t, 7, ring.analyseAt(now+maxRingSize, 0).In)
+	assert.EqualValues(t, 7, ring.analyseAt(now+maxRingSize, -5).In)
+}
+
+func TestConcurrentAccounting(t *testing.T) {
+	var (
+		pm      = NewProcessController(context.Background())
+		po      = &Process{Pid: "100", TrafficStats: new(trafficStatsEntry), series: newTrafficSeries(defaultRetention)}
+		workers = 8
+		loops   = 10000
+		wg      sync.WaitGroup
+		done    = make(chan struct{})
+	)
+	pm.Add(po.Pid, po)
+
+	sc := newServiceController()
+	lt := newListenTable("")
+	lt.add(&ConnectionItem{SrcIP: "0.0.0.0", SrcPort: "9080", Inode: "200"}, protoTCP)
+	sc.updateListens(lt)
+	key := testFlowKey("10.0.0.1", 9080, "10.0.0.2", 50000)
+
+	// readers rank while workers are counting.
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			pm.Sort(5)
+			pm.GetRank(10)
+			sc.Sort(5, pm)
+			sc.GetRank(10)
+		}
+	}()
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			cache := newFlowCache()
+			for j := 0; j < loops; j++ {
+				proc := cache.get(key, pm.getRevision())
+				if proc == nil {
+					proc = pm.Get("100")
+					cache.add(key, proc)
+				}
+				proc.IncreaseInput(1)
+				proc.IncreaseOutput(2)
+				sc.increase(key, 1, outputSide)
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+
+	stats := po.getSeries().analyse(maxRingSize - 1)
+	assert.EqualValues(t, workers*loops, stats.In)
+	assert.EqualValues(t, 2*workers*loops, stats.Out)
+
+	sc.Sort(maxRingSize-1, pm)
+	assert.EqualValues(t, workers*loops, sc.GetRank(1)[0].TrafficStats.Out)
+}
+
+func TestFlowCacheRevision(t *testing.T) {
+	var (
+		cache = newFlowCache()
+		key   = testFlowKey("10.0.0.1", 80, "10.0.0.2", 5555)
+		po    = &Process{Pid: "100"}
+	)
+
+	assert.Nil(t, cache.get(key, 1))
+	cache.add(key, po)
+	assert.Equal(t, po, cache.get(key, 1))
+
+	// processes are rescanned, the cache is reset.
+	assert.Nil(t, cache.get(key, 2))
+}
@@ -0,0 +1,256 @@
+package netflow
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// the queue of worker is checked every adaptInterval packets.
+	adaptInterval = 1024
+
+	adaptHighWater = 0.75
+	adaptLowWater  = 0.25
+
+	// a flow is heavy with 1/64 of the packets of an interval.
+	adaptHeavyPackets = adaptInterval / 64
+)
+
+var (
+	errSamplingConflict = errors.New("1-in-N and probabilistic sampling can't be used together")
+)
+
+// samplingConfig is read only after Netflow is created.
+type samplingConfig struct {
+	rate        int     // 1-in-N, 0 and 1 disable it
+	prob        float64 // probabilistic, 0 and 1 disable it
+	adaptiveMax int     // max rate of adaptive sampling, 0 disables it
+}
+
+// scale is the factor to estimate the real bytes from the sampled bytes.
+func (c *samplingConfig) scale() float64 {
+	switch {
+	case c.rate > 1:
+		return float64(c.rate)
+	case c.prob > 0 && c.prob < 1:
+		return 1 / c.prob
+	}
+	return 1
+}
+
+// packetSampler is owned by one capture goroutine.
+type packetSampler struct {
+	cfg   *samplingConfig
+	count int
+	rnd   *rand.Rand
+}
+
+func newPacketSampler(cfg *samplingConfig, seed int64) *packetSampler {
+	return &packetSampler{
+		cfg: cfg,
+		rnd: rand.New(rand.NewSource(seed)),
+	}
+}
+
+// sample return false when the packet is skipped, the length of kept packet
+// is scaled up by the rate. tcp control segments are never skipped, so the
+// handshakes and new connections are exact.
+func (s *packetSampler) sample(meta *packetMeta) bool {
+	if meta.control() {
+		return true
+	}
+
+	switch {
+	case s.cfg.rate > 1:
+		s.count++
+		if s.count < s.cfg.rate {
+			return false
+		}
+		s.count = 0
+		meta.length *= int64(s.cfg.rate)
+		meta.outer *= int64(s.cfg.rate)
+		meta.packets *= int64(s.cfg.rate)
+
+	case s.cfg.prob > 0 && s.cfg.prob < 1:
+		if s.rnd.Float64() >= s.cfg.prob {
+			return false
+		}
+		meta.length = int64(float64(meta.length)/s.cfg.prob + 0.5)
+		meta.outer = int64(float64(meta.outer)/s.cfg.prob + 0.5)
+		meta.packets = int64(float64(meta.packets)/s.cfg.prob + 0.5)
+	}
+	return true
+}
+
+// WithSampleRate only count 1 of every n packets, bytes are scaled up by n.
+func WithSampleRate(n int) optionFunc {
+	return func(o *Netflow) error {
+		if n < 1 {
+			return errors.New("invalid sample rate")
+		}
+		if o.sampling.prob > 0 {
+			return errSamplingConflict
+		}
+
+		o.sampling.rate = n
+		return nil
+	}
+}
+
+// WithSampleProbability count each packet with the probability p, bytes are scaled up by 1/p.
+func WithSampleProbability(p float64) optionFunc {
+	return func(o *Netflow) error {
+		if p <= 0 || p > 1 {
+			return errors.New("invalid sample probability")
+		}
+		if o.sampling.rate > 1 {
+			return errSamplingConflict
+		}
+
+		o.sampling.prob = p
+		return nil
+	}
+}
+
+// WithAdaptiveSampling sample the heavy flows of a worker when its queue is
+// filling, the rate is doubled up to maxRate, and halved after the queue is drained.
+func WithAdaptiveSampling(maxRate int) optionFunc {
+	return func(o *Netflow) error {
+		if maxRate < 2 {
+			return errors.New("invalid adaptive sample rate")
+		}
+
+		o.sampling.adaptiveMax = maxRate
+		return nil
+	}
+}
+
+// flowSampling is the adaptive state of a flow in the sampler.
+type flowSampling struct {
+	seq      int64
+	rate     int64 // of the current interval, 1 means no sampling
+	packets  int64 // in the current interval
+	interval int64
+}
+
+// adaptiveSampler is shared by the capture goroutines pushing to one worker.
+// the fill of queue decides the rate, it's only applied to the heavy flows of
+// the last interval, the packets of small flows are all counted. each flow
+// is sampled by its own sequence, so kept packets are spread over the flow.
+type adaptiveSampler struct {
+	sync.Mutex
+	max      int64
+	rate     int64 // atomic, current rate of heavy flows, 1 means no sampling
+	seq      int64
+	interval int64
+
+	// flows seen in the current and the last interval.
+	flows map[flowKey]flowSampling
+}
+
+func newAdaptiveSampler(max int) *adaptiveSampler {
+	return &adaptiveSampler{
+		max:   int64(max),
+		rate:  1,
+		flows: make(map[flowKey]flowSampling),
+	}
+}
+
+// sample adapt the rate by the fill of queue, and skip packets of the flow by
+// its rate. tcp control segments are never skipped.
+func (s *adaptiveSampler) sample(meta *packetMeta, qlen, qcap int) bool {
+	if meta.control() {
+		return true
+	}
+
+	s.Lock()
+	s.seq++
+	if s.seq%adaptInterval == 0 {
+		s.adapt(float64(qlen) / float64(qcap))
+	}
+
+	fs := s.flows[meta.key]
+	if fs.interval != s.interval {
+		// heavy in the last interval, the state of older flows is gone.
+		fs.rate = 1
+		if fs.interval == s.interval-1 && fs.packets >= adaptHeavyPackets {
+			fs.rate = atomic.LoadInt64(&s.rate)
+		}
+		fs.packets, fs.interval = 0, s.interval
+	}
+	fs.seq++
+	fs.packets++
+	s.flows[meta.key] = fs
+	s.Unlock()
+
+	rate := fs.rate
+	if rate <= 1 {
+		return true
+	}
+	if fs.seq%rate != 0 {
+		return false
+	}
+
+	meta.length *= rate
+	meta.outer *= rate
+	meta.packets *= rate
+	return true
+}
+
+// adapt start a new interval with the rate by the fill of queue, the flows
+// not seen in the last interval are removed. the caller holds the lock.
+func (s *adaptiveSampler) adapt(fill float64) {
+	rate := atomic.LoadInt64(&s.rate)
+	switch {
+	case fill > adaptHighWater && rate < s.max:
+		rate *= 2
+		if rate > s.max {
+			rate = s.max
+		}
+	case fill < adaptLowWater && rate > 1:
+		rate /= 2
+	}
+	atomic.StoreInt64(&s.rate, rate)
+
+	for key, fs := range s.flows {
+		if fs.interval < s.interval {
+			delete(s.flows, key)
+		}
+	}
+	s.interval++
+}
+
+func (s *adaptiveSampler) getRate() int64 {
+	return atomic.LoadInt64(&s.rate)
+}
+
+func newSamplerSeed() int64 {
+	return time.Now().UnixNano()
+}
+
+// sampleRate return the current factor of estimated bytes, adaptive rate
+// takes the max of workers.
+func (nf *Netflow) sampleRate() float64 {
+	var adaptive int64 = 1
+	for _, w := range nf.workers {
+		if w.sampler == nil {
+			continue
+		}
+		if rate := w.sampler.getRate(); rate > adaptive {
+			adaptive = rate
+		}
+	}
+	return nf.sampling.scale() * float64(adaptive)
+}
+
+// markSampleRate record the sample rate in exported stats.
+func (nf *Netflow) markSampleRate(stats *trafficStatsEntry) {
+	if stats == nil {
+		return
+	}
+	stats.SampleRate = nf.sampleRate()
+	stats.TCP.SampleRate = stats.SampleRate
+}
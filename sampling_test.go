@@ -0,0 +1,175 @@
+package netflow
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampleOneInN(t *testing.T) {
+	var (
+		cfg     = &samplingConfig{rate: 10}
+		sampler = newPacketSampler(cfg, 1)
+		kept    int
+		bytes   int64
+	)
+
+	for i := 0; i < 1000; i++ {
+		meta := packetMeta{length: 100}
+		if sampler.sample(&meta) {
+			kept++
+			bytes += meta.length
+		}
+	}
+
+	assert.Equal(t, 100, kept)
+	assert.EqualValues(t, 1000*100, bytes)
+	assert.EqualValues(t, 10, cfg.scale())
+}
+
+func TestSampleProbability(t *testing.T) {
+	var (
+		cfg     = &samplingConfig{prob: 0.1}
+		sampler = newPacketSampler(cfg, 1)
+		bytes   int64
+	)
+
+	for i := 0; i < 100000; i++ {
+		meta := packetMeta{length: 100}
+		if sampler.sample(&meta) {
+			bytes += meta.length
+		}
+	}
+
+	// the estimate is close to the real bytes.
+	assert.InEpsilon(t, 100000*100, bytes, 0.05)
+	assert.EqualValues(t, 10, cfg.scale())
+}
+
+func TestSamplingOptions(t *testing.T) {
+	nf := &Netflow{}
+	assert.Nil(t, WithSampleRate(100)(nf))
+	assert.Equal(t, errSamplingConflict, WithSampleProbability(0.5)(nf))
+	assert.NotNil(t, WithSampleRate(0)(nf))
+	assert.NotNil(t, WithAdaptiveSampling(1)(nf))
+
+	nf = &Netflow{}
+	assert.Nil(t, WithSampleProbability(0.5)(nf))
+	assert.Equal(t, errSamplingConflict, WithSampleRate(100)(nf))
+	assert.NotNil(t, WithSampleProbability(1.5)(nf))
+}
+
+func TestAdaptiveSampling(t *testing.T) {
+	nf := &Netflow{
+		sampling: samplingConfig{rate: 2, adaptiveMax: 8},
+	}
+	nf.workers = newPacketWorkers(1, minWorkerQueueSize, nf.sampling.adaptiveMax)
+	w := nf.workers[0]
+	meta := packetMeta{key: testFlowKey("10.0.0.1", 9080, "10.0.0.2", 50000), length: 100}
+
+	// no sampling while the queue is empty.
+	for i := 0; i < adaptInterval; i++ {
+		m := meta
+		assert.True(t, w.sample(&m))
+		assert.EqualValues(t, 100, m.length)
+	}
+
+	// fill the queue, the rate is raised up to the max.
+	for len(w.queue) < cap(w.queue) {
+		w.queue <- meta
+	}
+	for i := 0; i < 5*adaptInterval; i++ {
+		m := meta
+		w.sample(&m)
+	}
+	assert.EqualValues(t, 8, w.sampler.getRate())
+	assert.True(t, w.stats().Sampled > 0)
+	assert.EqualValues(t, 16, nf.sampleRate())
+	assert.EqualValues(t, 16, nf.GetWorkerStats()[0].SampleRate)
+
+	// kept packets are scaled by the rate.
+	kept := 0
+	for i := 0; i < 8; i++ {
+		m := meta
+		if w.sample(&m) {
+			kept++
+			assert.EqualValues(t, 800, m.length)
+		}
+	}
+	assert.Equal(t, 1, kept)
+
+	// drain the queue, the rate falls back.
+	for len(w.queue) > 0 {
+		<-w.queue
+	}
+	for i := 0; i < 5*adaptInterval; i++ {
+		m := meta
+		w.sample(&m)
+	}
+	assert.EqualValues(t, 1, w.sampler.getRate())
+
+	stats := &trafficStatsEntry{}
+	nf.markSampleRate(stats)
+	assert.EqualValues(t, 2, stats.SampleRate)
+}
+
+func TestAdaptiveSamplingPerFlow(t *testing.T) {
+	var (
+		w     = newPacketWorker(0, minWorkerQueueSize, 8)
+		heavy = packetMeta{key: testFlowKey("10.0.0.1", 9080, "10.0.0.2", 50000), length: 100, packets: 1}
+		light = packetMeta{key: testFlowKey("10.0.0.1", 9080, "10.0.0.3", 50000), length: 100, packets: 1}
+	)
+	for len(w.queue) < cap(w.queue) {
+		w.queue <- heavy
+	}
+
+	// the packets of small flows are all counted while heavy flows are sampled.
+	var heavyKept, lightBytes int64
+	for i := 0; i < 8*adaptInterval; i++ {
+		m := heavy
+		if w.sample(&m) && i >= 4*adaptInterval {
+			heavyKept++
+			assert.EqualValues(t, 800, m.length)
+		}
+		if i%128 == 0 {
+			m = light
+			assert.True(t, w.sample(&m))
+			lightBytes += m.length
+		}
+	}
+	assert.EqualValues(t, 8, w.sampler.getRate())
+	assert.EqualValues(t, 8*adaptInterval/128*100, lightBytes)
+	assert.InDelta(t, 4*adaptInterval/8, heavyKept, 1)
+
+	// tcp control segments are never skipped.
+	for i := 0; i < 8; i++ {
+		m := heavy
+		m.tcp.flags = tcpSYN
+		assert.True(t, w.sample(&m))
+		assert.EqualValues(t, 100, m.length)
+	}
+
+	// flows not seen in the last interval are removed.
+	assert.True(t, len(w.sampler.flows) <= 2)
+}
+
+func TestSampleControlSegments(t *testing.T) {
+	var (
+		cfg     = &samplingConfig{rate: 10}
+		sampler = newPacketSampler(cfg, 1)
+		kept    int
+	)
+
+	for i := 0; i < 100; i++ {
+		meta := packetMeta{length: 100, packets: 1}
+		if i%10 == 0 {
+			meta.tcp.flags = tcpSYN
+		}
+		if sampler.sample(&meta) {
+			kept++
+		}
+	}
+
+	// 10 SYNs and 1 of every 10 other segments.
+	assert.Equal(t, 10+9, kept)
+}
@@ -0,0 +1,222 @@
+package netflow
+
+import (
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Selector decide whether a process is captured or ranked, selectors can be
+// combined with And, Or and Not.
+//
+// at capture time the process carries pid, exe, name, cmdline, uid and cgroup,
+// its sockets are only known after the inodes are scanned.
+type Selector interface {
+	Match(po *Process) bool
+}
+
+// socketSelector is implemented by selectors depending on the sockets of process.
+type socketSelector interface {
+	needSockets() bool
+}
+
+func selectorNeedSockets(sel Selector) bool {
+	ss, ok := sel.(socketSelector)
+	return ok && ss.needSockets()
+}
+
+// SelectorFunc adapt a func to Selector.
+type SelectorFunc func(po *Process) bool
+
+func (fn SelectorFunc) Match(po *Process) bool {
+	return fn(po)
+}
+
+// SelectPids match the process by pid list.
+func SelectPids(pids ...string) Selector {
+	set := make(map[string]nullObject, len(pids))
+	for _, pid := range pids {
+		set[pid] = nullObject{}
+	}
+
+	return SelectorFunc(func(po *Process) bool {
+		_, ok := set[po.Pid]
+		return ok
+	})
+}
+
+// SelectName match the title-cased basename of exe exactly, eg: Nginx.
+func SelectName(name string) Selector {
+	return SelectorFunc(func(po *Process) bool {
+		return po.Name == name
+	})
+}
+
+// SelectExeGlob match the exe path or its basename by glob pattern,
+// eg: "/usr/bin/python*", "java".
+func SelectExeGlob(pattern string) (Selector, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	return SelectorFunc(func(po *Process) bool {
+		if po.Exe == "" {
+			return false
+		}
+		if ok, _ := path.Match(pattern, po.Exe); ok {
+			return true
+		}
+		ok, _ := path.Match(pattern, filepath.Base(po.Exe))
+		return ok
+	}), nil
+}
+
+// SelectCmdline match the cmdline by regexp, it's useful for interpreters,
+// eg: `python.* manage.py runserver`.
+func SelectCmdline(expr string) (Selector, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	return SelectorFunc(func(po *Process) bool {
+		return re.MatchString(po.Cmdline)
+	}), nil
+}
+
+// SelectUid match the real uid of process.
+func SelectUid(uids ...int) Selector {
+	set := make(map[int]nullObject, len(uids))
+	for _, uid := range uids {
+		set[uid] = nullObject{}
+	}
+
+	return SelectorFunc(func(po *Process) bool {
+		_, ok := set[po.Uid]
+		return ok
+	})
+}
+
+// SelectCgroup match the cgroup path by prefix or glob pattern,
+// eg: "/system.slice/nginx.service", "/kubepods/*/pod*/*".
+func SelectCgroup(pattern string) (Selector, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	return SelectorFunc(func(po *Process) bool {
+		if po.Cgroup == "" {
+			return false
+		}
+		if strings.HasPrefix(po.Cgroup, pattern) {
+			return true
+		}
+		ok, _ := path.Match(pattern, po.Cgroup)
+		return ok
+	}), nil
+}
+
+// SelectListenPort match the process listening on any of the ports.
+func SelectListenPort(ports ...int) Selector {
+	set := make(map[int]nullObject, len(ports))
+	for _, port := range ports {
+		set[port] = nullObject{}
+	}
+
+	return &listenPortSelector{ports: set}
+}
+
+type listenPortSelector struct {
+	ports map[int]nullObject
+}
+
+func (s *listenPortSelector) Match(po *Process) bool {
+	for _, port := range po.ListenPorts {
+		if _, ok := s.ports[port]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *listenPortSelector) needSockets() bool {
+	return true
+}
+
+// And match when all selectors match.
+func And(sels ...Selector) Selector {
+	return &logicSelector{op: "and", sels: sels}
+}
+
+// Or match when any selector matches.
+func Or(sels ...Selector) Selector {
+	return &logicSelector{op: "or", sels: sels}
+}
+
+// Not reverse the selector.
+func Not(sel Selector) Selector {
+	return &logicSelector{op: "not", sels: []Selector{sel}}
+}
+
+type logicSelector struct {
+	op   string
+	sels []Selector
+}
+
+func (s *logicSelector) Match(po *Process) bool {
+	switch s.op {
+	case "and":
+		for _, sel := range s.sels {
+			if !sel.Match(po) {
+				return false
+			}
+		}
+		return true
+
+	case "or":
+		for _, sel := range s.sels {
+			if sel.Match(po) {
+				return true
+			}
+		}
+		return false
+
+	case "not":
+		return !s.sels[0].Match(po)
+	}
+	return false
+}
+
+func (s *logicSelector) needSockets() bool {
+	for _, sel := range s.sels {
+		if selectorNeedSockets(sel) {
+			return true
+		}
+	}
+	return false
+}
+
+// preMatch evaluate the selector before sockets are scanned, a selector
+// depending on sockets can't be decided yet, so let it pass.
+func preMatch(sel Selector, po *Process) bool {
+	if sel == nil || selectorNeedSockets(sel) {
+		return true
+	}
+	return sel.Match(po)
+}
+
+// FilterProcesses return the processes matching the selector.
+func FilterProcesses(pos []*Process, sel Selector) []*Process {
+	if sel == nil {
+		return pos
+	}
+
+	res := make([]*Process, 0, len(pos))
+	for _, po := range pos {
+		if sel.Match(po) {
+			res = append(res, po)
+		}
+	}
+	return res
+}
@@ -0,0 +1,89 @@
+package netflow
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectors(t *testing.T) {
+	po := &Process{
+		Pid:         "100",
+		Name:        "Python3.8",
+		Exe:         "/usr/bin/python3.8",
+		Cmdline:     "python3 manage.py runserver 0.0.0.0:8000",
+		Uid:         1000,
+		Cgroup:      "/system.slice/django.service",
+		ListenPorts: []int{8000},
+	}
+
+	assert.True(t, SelectPids("1", "100").Match(po))
+	assert.False(t, SelectPids("1").Match(po))
+	assert.True(t, SelectName("Python3.8").Match(po))
+
+	sel, err := SelectExeGlob("python*")
+	assert.Equal(t, nil, err)
+	assert.True(t, sel.Match(po))
+	sel, err = SelectExeGlob("/usr/bin/java")
+	assert.Equal(t, nil, err)
+	assert.False(t, sel.Match(po))
+	_, err = SelectExeGlob("[")
+	assert.NotEqual(t, nil, err)
+
+	sel, err = SelectCmdline(`manage\.py runserver`)
+	assert.Equal(t, nil, err)
+	assert.True(t, sel.Match(po))
+	_, err = SelectCmdline("(")
+	assert.NotEqual(t, nil, err)
+
+	assert.True(t, SelectUid(0, 1000).Match(po))
+	assert.False(t, SelectUid(0).Match(po))
+
+	sel, err = SelectCgroup("/system.slice/")
+	assert.Equal(t, nil, err)
+	assert.True(t, sel.Match(po))
+	sel, err = SelectCgroup("/system.slice/*.service")
+	assert.Equal(t, nil, err)
+	assert.True(t, sel.Match(po))
+
+	assert.True(t, SelectListenPort(80, 8000).Match(po))
+	assert.False(t, SelectListenPort(80).Match(po))
+}
+
+func TestLogicSelectors(t *testing.T) {
+	po := &Process{Pid: "100", Uid: 0, ListenPorts: []int{80}}
+
+	assert.True(t, And(SelectPids("100"), SelectUid(0)).Match(po))
+	assert.False(t, And(SelectPids("100"), SelectUid(1)).Match(po))
+	assert.True(t, Or(SelectPids("1"), SelectUid(0)).Match(po))
+	assert.False(t, Or(SelectPids("1"), SelectUid(1)).Match(po))
+	assert.True(t, Not(SelectPids("1")).Match(po))
+	assert.True(t, And(Not(SelectUid(1)), Or(SelectListenPort(80), SelectPids("1"))).Match(po))
+
+	// selectors depending on sockets are decided after scanning inodes.
+	assert.False(t, selectorNeedSockets(And(SelectPids("1"), SelectUid(0))))
+	assert.True(t, selectorNeedSockets(Or(SelectPids("1"), Not(SelectListenPort(80)))))
+	assert.True(t, preMatch(SelectListenPort(443), po))
+	assert.False(t, preMatch(SelectPids("1"), po))
+}
+
+func TestFilterProcesses(t *testing.T) {
+	pos := []*Process{{Pid: "1"}, {Pid: "2"}, {Pid: "3"}}
+	assert.Equal(t, 3, len(FilterProcesses(pos, nil)))
+
+	res := FilterProcesses(pos, Not(SelectPids("2")))
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, "3", res[1].Pid)
+}
+
+func TestGetSelectedProcesses(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	ps, err := GetSelectedProcesses(SelectPids(pid))
+	assert.Equal(t, nil, err)
+	for k, po := range ps {
+		assert.Equal(t, pid, k)
+		assert.Equal(t, os.Getuid(), po.Uid)
+	}
+}
@@ -0,0 +1,296 @@
+package netflow
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// listeners on them accept connections to all local ips.
+	wildcardAddr  = newIPAddr(net.IPv4zero)
+	wildcardAddr6 = newIPAddr(net.IPv6unspecified)
+)
+
+// Service is the traffic of a local listening port, connections accepted by
+// the port are counted even when the owner process of the socket is unknown.
+type Service struct {
+	Port         int                `json:"port"`
+	Netns        string             `json:"netns"`
+	Inode        string             `json:"inode"`
+	Pid          string             `json:"pid"`
+	Name         string             `json:"name"`
+	Exe          string             `json:"exe"`
+	TrafficStats *trafficStatsEntry `json:"traffic_stats"`
+	Ring         []*trafficEntry    `json:"ring"`
+
+	series *trafficSeries
+}
+
+func (s *Service) copy() *Service {
+	return &Service{
+		Port:         s.Port,
+		Netns:        s.Netns,
+		Inode:        s.Inode,
+		Pid:          s.Pid,
+		Name:         s.Name,
+		Exe:          s.Exe,
+		TrafficStats: s.TrafficStats.copyStats(),
+		Ring:         s.series.entries(),
+	}
+}
+
+// listenKey is a listening port of the protocol in a network namespace,
+// containers listen on the same ports as the host.
+type listenKey struct {
+	netns string
+	proto uint8
+	port  uint16
+}
+
+// endpoint is the binary ip:port of listening socket.
+type endpoint struct {
+	listenKey
+	ip ipAddr
+}
+
+// listenTable is rebuilt on every rescan, it's read only after built.
+type listenTable struct {
+	host string // netns of host
+
+	// key -> ip:port, val -> inode
+	addrs map[endpoint]string
+	// key -> port, val -> inode
+	ports map[listenKey]string
+	// key -> local ip, val -> netns, it's learned from the sockets, the host
+	// namespace goes first, so it owns the ips in all namespaces, eg: 127.0.0.1.
+	netns map[ipAddr]string
+}
+
+func newListenTable(host string) *listenTable {
+	return &listenTable{
+		host:  host,
+		addrs: make(map[endpoint]string, 100),
+		ports: make(map[listenKey]string, 100),
+		netns: make(map[ipAddr]string, 100),
+	}
+}
+
+// add the listening socket of the protocol, the netns of item must be set.
+func (lt *listenTable) add(item *ConnectionItem, proto uint8) {
+	port, err := strconv.Atoi(item.SrcPort)
+	if err != nil {
+		return
+	}
+
+	ip := net.ParseIP(item.SrcIP)
+	if ip == nil {
+		return
+	}
+
+	var (
+		addr = newIPAddr(ip)
+		key  = listenKey{netns: item.Netns, proto: proto, port: uint16(port)}
+	)
+	lt.addrs[endpoint{listenKey: key, ip: addr}] = item.Inode
+	if _, ok := lt.ports[key]; !ok || isWildcard(addr) {
+		lt.ports[key] = item.Inode
+	}
+	if !isWildcard(addr) {
+		lt.learn(addr, item.Netns)
+	}
+}
+
+// learn the netns of local ip from the sockets in the socket table.
+func (lt *listenTable) learn(ip ipAddr, netns string) {
+	if _, ok := lt.netns[ip]; !ok {
+		lt.netns[ip] = netns
+	}
+}
+
+func isWildcard(addr ipAddr) bool {
+	return addr == wildcardAddr || addr == wildcardAddr6
+}
+
+// listenKey return the key of local endpoint, the ips not seen in sockets are
+// of the host.
+func (lt *listenTable) listenKey(ip ipAddr, proto uint8, port uint16) listenKey {
+	return listenKey{netns: lt.netnsOf(ip), proto: proto, port: port}
+}
+
+// netnsOf return the netns of local ip, the ips not seen in sockets are of the host.
+func (lt *listenTable) netnsOf(ip ipAddr) string {
+	if netns, ok := lt.netns[ip]; ok {
+		return netns
+	}
+	return lt.host
+}
+
+// lookup return inode of the socket listening on ip:port, 0.0.0.0:port or [::]:port
+// in the netns of ip.
+func (lt *listenTable) lookup(ip ipAddr, proto uint8, port uint16) string {
+	key := lt.listenKey(ip, proto, port)
+	if inode, ok := lt.addrs[endpoint{listenKey: key, ip: ip}]; ok {
+		return inode
+	}
+	if inode, ok := lt.addrs[endpoint{listenKey: key, ip: wildcardAddr}]; ok {
+		return inode
+	}
+	return lt.addrs[endpoint{listenKey: key, ip: wildcardAddr6}]
+}
+
+func (lt *listenTable) isListening(key listenKey) bool {
+	_, ok := lt.ports[key]
+	return ok
+}
+
+type serviceController struct {
+	sync.RWMutex
+
+	listens *listenTable
+
+	// key -> netns, proto and port, val -> service
+	dict map[listenKey]*Service
+
+	// cache
+	sortedServices sortedServices
+	retention      Retention
+}
+
+func newServiceController() *serviceController {
+	return &serviceController{
+		listens:   newListenTable(""),
+		dict:      make(map[listenKey]*Service, 100),
+		retention: defaultRetention,
+	}
+}
+
+// updateListens swap the listening sockets scanned from socket tables.
+func (sc *serviceController) updateListens(lt *listenTable) {
+	sc.Lock()
+	defer sc.Unlock()
+
+	sc.listens = lt
+	for key, inode := range lt.ports {
+		svc, ok := sc.dict[key]
+		if !ok {
+			svc = &Service{
+				Port:         int(key.port),
+				Netns:        key.netns,
+				TrafficStats: new(trafficStatsEntry),
+				series:       newTrafficSeries(sc.retention),
+			}
+			sc.dict[key] = svc
+		}
+		svc.Inode = inode
+	}
+}
+
+// lookupInode return the inode of listening socket accepting the local endpoint.
+func (sc *serviceController) lookupInode(key flowKey, side sideOption) string {
+	ip, port := key.local(side)
+
+	sc.RLock()
+	defer sc.RUnlock()
+
+	return sc.listens.lookup(ip, key.proto, port)
+}
+
+// localNetns return the netns of local ip, see listenTable.
+func (sc *serviceController) localNetns(ip ipAddr) string {
+	sc.RLock()
+	defer sc.RUnlock()
+
+	return sc.listens.netnsOf(ip)
+}
+
+// increase count the packet into the service of local port, packets of other ports are ignored.
+func (sc *serviceController) increase(key flowKey, length int64, side sideOption) {
+	ip, port := key.local(side)
+
+	// the ring is atomic, the read lock only protects the dict.
+	sc.RLock()
+	defer sc.RUnlock()
+
+	lk := sc.listens.listenKey(ip, key.proto, port)
+	if !sc.listens.isListening(lk) {
+		return
+	}
+
+	svc := sc.dict[lk]
+	svc.series.increase(length, side)
+}
+
+// Sort analyse services and resolve owner processes by inode.
+func (sc *serviceController) Sort(sec int, pm *processController) []*Service {
+	sc.Lock()
+	defer sc.Unlock()
+
+	var (
+		svcs = sortedServices{}
+		// closed services are kept while their traffic is within retention.
+		thold = time.Now().Unix() - int64(sc.retention.window())
+	)
+
+	for key, svc := range sc.dict {
+		last := svc.series.last()
+		idle := last == nil || last.Timestamp < thold
+		if idle && !sc.listens.isListening(key) {
+			delete(sc.dict, key) // closed and idle
+			continue
+		}
+
+		if sec != 0 {
+			svc.TrafficStats = svc.series.analyse(sec)
+		}
+
+		if po := pm.GetProcessByInode(svc.Inode); po != nil {
+			svc.Pid, svc.Name, svc.Exe = po.Pid, po.Name, po.Exe
+		}
+		svcs = append(svcs, svc)
+	}
+
+	sort.Sort(svcs)
+	sc.sortedServices = svcs
+	return svcs
+}
+
+func (sc *serviceController) GetRank(limit int) []*Service {
+	sc.RLock()
+	defer sc.RUnlock()
+
+	src := sc.sortedServices
+	if len(src) > limit {
+		src = src[:limit]
+	}
+
+	res := make([]*Service, 0, len(src))
+	for _, svc := range src {
+		res = append(res, svc.copy())
+	}
+	return res
+}
+
+type sortedServices []*Service
+
+func (s sortedServices) Len() int {
+	return len(s)
+}
+
+func (s sortedServices) Less(i, j int) bool {
+	val1 := s[i].TrafficStats.In + s[i].TrafficStats.Out
+	val2 := s[j].TrafficStats.In + s[j].TrafficStats.Out
+	if val1 == val2 {
+		if s[i].Port == s[j].Port {
+			return s[i].Netns < s[j].Netns
+		}
+		return s[i].Port < s[j].Port
+	}
+	return val1 > val2
+}
+
+func (s sortedServices) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
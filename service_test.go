@@ -0,0 +1,120 @@
+package netflow
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetListenItem(t *testing.T) {
+	line := "   0: 00000000:2378 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 20113 1 0000000000000000 100 0 0 10 0"
+	item := getListenItem(line)
+	assert.NotNil(t, item)
+	assert.Equal(t, "0.0.0.0:9080", item.Addr)
+	assert.Equal(t, "20113", item.Inode)
+
+	line = "   2: 00000000000000000000000000000000:0050 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 20115 1 0000000000000000 100 0 0 10 0"
+	item = getListenItem(line)
+	assert.NotNil(t, item)
+	assert.Equal(t, "::", item.SrcIP)
+	assert.Equal(t, "80", item.SrcPort)
+
+	line = "   3: 0000000000000000FFFF00000100007F:0050 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 20116 1 0000000000000000 100 0 0 10 0"
+	assert.Equal(t, "127.0.0.1", getListenItem(line).SrcIP)
+
+	line = "   1: 2E0010AC:E898 0100000A:0050 01 00000000:00000000 00:00000000 00000000     0        0 20114 1 0000000000000000 100 0 0 10 0"
+	assert.Nil(t, getListenItem(line))
+}
+
+func TestServiceController(t *testing.T) {
+	lt := newListenTable("")
+	lt.add(&ConnectionItem{Addr: "0.0.0.0:9080", SrcIP: "0.0.0.0", SrcPort: "9080", Inode: "100"}, protoTCP)
+	lt.add(&ConnectionItem{Addr: "127.0.0.1:6060", SrcIP: "127.0.0.1", SrcPort: "6060", Inode: "200"}, protoTCP)
+
+	sc := newServiceController()
+	sc.updateListens(lt)
+
+	assert.Equal(t, "100", sc.lookupInode(testFlowKey("10.0.0.2", 50000, "10.0.0.1", 9080), inputSide))
+	assert.Equal(t, "200", sc.lookupInode(testFlowKey("127.0.0.1", 6060, "127.0.0.1", 50000), outputSide))
+	assert.Equal(t, "", sc.lookupInode(testFlowKey("10.0.0.2", 50000, "10.0.0.1", 6060), inputSide))
+
+	sc.increase(testFlowKey("10.0.0.2", 50000, "10.0.0.1", 9080), 100, inputSide)
+	sc.increase(testFlowKey("10.0.0.1", 9080, "10.0.0.2", 50000), 300, outputSide)
+	sc.increase(testFlowKey("10.0.0.1", 50001, "10.0.0.3", 443), 1000, outputSide) // not a service
+
+	pm := NewProcessController(context.Background())
+	sc.Sort(1, pm)
+	rank := sc.GetRank(10)
+	assert.Equal(t, 2, len(rank))
+	assert.Equal(t, 9080, rank[0].Port)
+	assert.EqualValues(t, 100, rank[0].TrafficStats.In)
+	assert.EqualValues(t, 300, rank[0].TrafficStats.Out)
+
+	// the closed and idle service is removed.
+	sc.updateListens(newListenTable(""))
+	sc.Sort(1, pm)
+	assert.Equal(t, 1, len(sc.GetRank(10)))
+}
+
+func TestServiceRetention(t *testing.T) {
+	lt := newListenTable("")
+	lt.add(&ConnectionItem{SrcIP: "0.0.0.0", SrcPort: "80", Inode: "100"}, protoTCP)
+	lt.add(&ConnectionItem{SrcIP: "0.0.0.0", SrcPort: "443", Inode: "200"}, protoTCP)
+
+	sc := newServiceController()
+	sc.retention = Retention{Seconds: time.Minute, Minutes: 10 * time.Minute}
+	sc.updateListens(lt)
+
+	now := time.Now().Unix()
+	sc.dict[lt.listenKey(wildcardAddr, protoTCP, 80)].series.increaseAt(now-120, 100, inputSide)
+	sc.dict[lt.listenKey(wildcardAddr, protoTCP, 443)].series.increaseAt(now-3600, 100, inputSide)
+
+	// the service closed 2 minutes ago is kept within the retention window.
+	pm := NewProcessController(context.Background())
+	sc.updateListens(newListenTable(""))
+	sc.Sort(0, pm)
+	rank := sc.GetRank(10)
+	assert.Equal(t, 1, len(rank))
+	assert.Equal(t, 80, rank[0].Port)
+}
+
+func TestServiceNetns(t *testing.T) {
+	lt := newListenTable("1")
+	lt.add(&ConnectionItem{SrcIP: "0.0.0.0", SrcPort: "80", Inode: "100", Netns: "1"}, protoTCP)
+	lt.add(&ConnectionItem{SrcIP: "0.0.0.0", SrcPort: "80", Inode: "200", Netns: "2"}, protoTCP)
+	lt.add(&ConnectionItem{SrcIP: "::", SrcPort: "443", Inode: "300", Netns: "2"}, protoTCP)
+	lt.learn(testIPAddr("172.17.0.2"), "2")
+	lt.learn(testIPAddr("fd00::2"), "2")
+
+	sc := newServiceController()
+	sc.updateListens(lt)
+
+	// the same port of host and container doesn't collide.
+	assert.Equal(t, "100", sc.lookupInode(testFlowKey("10.0.0.2", 50000, "10.0.0.1", 80), inputSide))
+	assert.Equal(t, "200", sc.lookupInode(testFlowKey("10.0.0.2", 50000, "172.17.0.2", 80), inputSide))
+
+	// [::] accepts both ipv4 and ipv6.
+	assert.Equal(t, "300", sc.lookupInode(testFlowKey("10.0.0.2", 50000, "172.17.0.2", 443), inputSide))
+	assert.Equal(t, "300", sc.lookupInode(testFlowKey("fd00::2", 443, "fd00::9", 50000), outputSide))
+	assert.Equal(t, "", sc.lookupInode(testFlowKey("10.0.0.2", 50000, "10.0.0.1", 443), inputSide))
+
+	// udp isn't accepted by tcp listeners.
+	udp := newFlowKey(net.ParseIP("10.0.0.2"), 50000, net.ParseIP("10.0.0.1"), 80, protoUDP)
+	assert.Equal(t, "", sc.lookupInode(udp, inputSide))
+	sc.increase(udp, 100, inputSide)
+
+	sc.increase(testFlowKey("10.0.0.2", 50000, "10.0.0.1", 80), 100, inputSide)
+	sc.increase(testFlowKey("10.0.0.2", 50001, "172.17.0.2", 80), 300, inputSide)
+
+	pm := NewProcessController(context.Background())
+	sc.Sort(1, pm)
+	rank := sc.GetRank(10)
+	assert.Equal(t, 3, len(rank))
+	assert.Equal(t, "2", rank[0].Netns)
+	assert.EqualValues(t, 300, rank[0].TrafficStats.In)
+	assert.Equal(t, "1", rank[1].Netns)
+	assert.EqualValues(t, 100, rank[1].TrafficStats.In)
+}
@@ -0,0 +1,549 @@
+package netflow
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultStoreDir = "/var/lib/netflow"
+
+	SampleProcess = "process"
+	SampleDevice  = "device"
+	SampleUser    = "user"
+
+	defaultStoreBudget = int64(256 << 20)
+
+	// samples of a minute are written into the segment of the hour.
+	storeFlushInterval = int64(60)
+	segmentDuration    = int64(3600)
+
+	// segments older than it are compacted into hourly samples.
+	compactAfter = int64(24 * 3600)
+
+	segmentSuffix   = ".seg"
+	compactedSuffix = ".hseg"
+)
+
+// Sample is the traffic of a process, a device or a user in [Timestamp, Timestamp+Step).
+type Sample struct {
+	Timestamp int64  `json:"ts"`
+	Step      int64  `json:"step"`
+	Kind      string `json:"kind"`
+	Key       string `json:"key"`            // pid, device or user
+	Name      string `json:"name,omitempty"` // name of process
+	In        int64  `json:"in"`
+	Out       int64  `json:"out"`
+
+	InPackets  int64 `json:"in_packets,omitempty"`
+	OutPackets int64 `json:"out_packets,omitempty"`
+	NewConns   int64 `json:"new_conns,omitempty"` // connections opened in the step
+}
+
+// fold add the counters of other sample.
+func (s *Sample) fold(other *Sample) {
+	s.In += other.In
+	s.Out += other.Out
+	s.InPackets += other.InPackets
+	s.OutPackets += other.OutPackets
+	s.NewConns += other.NewConns
+}
+
+// StoreQuery select the samples in [Start, End), empty Kind or Key matches all.
+type StoreQuery struct {
+	Kind  string
+	Key   string
+	Start int64
+	End   int64
+}
+
+func (q StoreQuery) match(s *Sample) bool {
+	if q.Kind != "" && q.Kind != s.Kind {
+		return false
+	}
+	if q.Key != "" && q.Key != s.Key && q.Key != s.Name {
+		return false
+	}
+	return s.Timestamp+s.Step > q.Start && s.Timestamp < q.End
+}
+
+// Store keep samples in hourly segment files of json lines, segments older
+// than a day are compacted into hourly samples, the oldest segments are
+// removed when the size of dir exceeds the budget.
+type Store struct {
+	sync.Mutex
+
+	dir    string
+	budget int64
+
+	file      *os.File // the segment being written
+	fileStart int64
+}
+
+// OpenStore open the store in dir, budget is the max bytes of segments, 0 means 256MB.
+func OpenStore(dir string, budget int64) (*Store, error) {
+	if budget <= 0 {
+		budget = defaultStoreBudget
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &Store{dir: dir, budget: budget}, nil
+}
+
+type segment struct {
+	start     int64
+	path      string
+	compacted bool
+	size      int64
+}
+
+// segments list the segment files ordered by time.
+func (s *Store) segments() ([]segment, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []segment
+	for _, file := range files {
+		name := file.Name()
+		seg := segment{path: filepath.Join(s.dir, name)}
+		switch {
+		case strings.HasSuffix(name, segmentSuffix):
+			name = strings.TrimSuffix(name, segmentSuffix)
+		case strings.HasSuffix(name, compactedSuffix):
+			name = strings.TrimSuffix(name, compactedSuffix)
+			seg.compacted = true
+		default:
+			continue
+		}
+
+		start, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		seg.start = start
+
+		if info, err := file.Info(); err == nil {
+			seg.size = info.Size()
+		}
+		res = append(res, seg)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].start < res[j].start
+	})
+	return res, nil
+}
+
+// Append write the samples, they're appended to the segments of their hours.
+func (s *Store) Append(samples []Sample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	var (
+		buf    bytes.Buffer
+		latest int64
+	)
+	for idx := range samples {
+		sample := &samples[idx]
+		start := sample.Timestamp - sample.Timestamp%segmentDuration
+		if start != s.fileStart && buf.Len() > 0 {
+			if err := s.writeLocked(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		if err := s.openLocked(start); err != nil {
+			return err
+		}
+
+		bs, err := json.Marshal(sample)
+		if err != nil {
+			return err
+		}
+		buf.Write(bs)
+		buf.WriteByte('\n')
+
+		if sample.Timestamp > latest {
+			latest = sample.Timestamp
+		}
+	}
+	if err := s.writeLocked(buf.Bytes()); err != nil {
+		return err
+	}
+
+	if err := s.compactLocked(latest); err != nil {
+		return err
+	}
+	return s.enforceBudgetLocked()
+}
+
+// openLocked open the segment of the hour for appending.
+func (s *Store) openLocked(start int64) error {
+	if s.file != nil && s.fileStart == start {
+		return nil
+	}
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+
+	path := filepath.Join(s.dir, strconv.FormatInt(start, 10)+segmentSuffix)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	s.file, s.fileStart = file, start
+	return nil
+}
+
+func (s *Store) writeLocked(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	_, err := s.file.Write(data)
+	return err
+}
+
+// Compact fold the segments older than a day into hourly samples.
+func (s *Store) Compact(now int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.compactLocked(now)
+}
+
+func (s *Store) compactLocked(now int64) error {
+	segs, err := s.segments()
+	if err != nil {
+		return err
+	}
+
+	for _, seg := range segs {
+		if seg.compacted || seg.start+segmentDuration > now-compactAfter {
+			continue
+		}
+		if s.file != nil && seg.start == s.fileStart {
+			s.file.Close()
+			s.file = nil
+		}
+		if err := compactSegment(seg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type sampleKey struct {
+	kind string
+	key  string
+	name string
+}
+
+// compactSegment rewrite the segment into one sample per key, the file is
+// replaced by rename, so readers see the old or the new one.
+func compactSegment(seg segment) error {
+	samples, err := readSegment(seg.path)
+	if err != nil {
+		return err
+	}
+
+	var (
+		folded = make(map[sampleKey]*Sample)
+		keys   []sampleKey
+	)
+	for idx := range samples {
+		sample := &samples[idx]
+		key := sampleKey{sample.Kind, sample.Key, sample.Name}
+		ent, ok := folded[key]
+		if !ok {
+			ent = &Sample{Timestamp: seg.start, Step: segmentDuration, Kind: key.kind, Key: key.key, Name: key.name}
+			folded[key] = ent
+			keys = append(keys, key)
+		}
+		ent.fold(sample)
+	}
+
+	var buf bytes.Buffer
+	for _, key := range keys {
+		bs, err := json.Marshal(folded[key])
+		if err != nil {
+			return err
+		}
+		buf.Write(bs)
+		buf.WriteByte('\n')
+	}
+
+	path := strings.TrimSuffix(seg.path, segmentSuffix) + compactedSuffix
+	if err := os.WriteFile(path+".tmp", buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return os.Remove(seg.path)
+}
+
+// enforceBudgetLocked remove the oldest segments until the dir fits the
+// budget, the segment being written is kept.
+func (s *Store) enforceBudgetLocked() error {
+	segs, err := s.segments()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, seg := range segs {
+		total += seg.size
+	}
+
+	for _, seg := range segs {
+		if total <= s.budget {
+			break
+		}
+		if s.file != nil && seg.start == s.fileStart && !seg.compacted {
+			continue
+		}
+		if err := os.Remove(seg.path); err != nil {
+			return err
+		}
+		total -= seg.size
+	}
+	return nil
+}
+
+// readSegment decode the samples of segment, the torn line of crash is skipped.
+func readSegment(path string) ([]Sample, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil // removed by compaction or budget.
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var (
+		res     []Sample
+		scanner = bufio.NewScanner(file)
+	)
+	for scanner.Scan() {
+		var sample Sample
+		if err := json.Unmarshal(scanner.Bytes(), &sample); err != nil {
+			continue
+		}
+		res = append(res, sample)
+	}
+	return res, scanner.Err()
+}
+
+// Query return the samples matching the query, ordered by time.
+func (s *Store) Query(q StoreQuery) ([]Sample, error) {
+	if q.Start >= q.End {
+		return nil, errInvalidWindow
+	}
+
+	segs, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []Sample
+	for _, seg := range segs {
+		if seg.start >= q.End || seg.start+segmentDuration <= q.Start {
+			continue
+		}
+
+		samples, err := readSegment(seg.path)
+		if err != nil {
+			return nil, err
+		}
+		for idx := range samples {
+			if q.match(&samples[idx]) {
+				res = append(res, samples[idx])
+			}
+		}
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Timestamp < res[j].Timestamp
+	})
+	return res, nil
+}
+
+func (s *Store) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// ServeHTTP answer the range queries, eg: GET /?kind=process&key=nginx&since=24h,
+// start and end in unix seconds can be used instead of since.
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q, err := parseStoreQuery(r, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	samples, err := s.Query(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if samples == nil {
+		samples = []Sample{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(samples)
+}
+
+func parseStoreQuery(r *http.Request, now time.Time) (StoreQuery, error) {
+	var (
+		args = r.URL.Query()
+		q    = StoreQuery{
+			Kind: args.Get("kind"),
+			Key:  args.Get("key"),
+			End:  now.Unix() + 1,
+		}
+	)
+
+	if since := args.Get("since"); since != "" {
+		dur, err := time.ParseDuration(since)
+		if err != nil {
+			return q, err
+		}
+		q.Start = now.Add(-dur).Unix()
+	}
+	for name, ptr := range map[string]*int64{"start": &q.Start, "end": &q.End} {
+		val := args.Get(name)
+		if val == "" {
+			continue
+		}
+		ts, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return q, errors.New("invalid " + name)
+		}
+		*ptr = ts
+	}
+	return q, nil
+}
+
+// WithStore persist the traffic of processes, devices and users into the
+// store every minute, the store is closed by the caller.
+func WithStore(store *Store) optionFunc {
+	return func(o *Netflow) error {
+		o.store = store
+		return nil
+	}
+}
+
+// startStoreFlusher write the samples of the last minute until ctx is done.
+func (nf *Netflow) startStoreFlusher() {
+	ticker := time.NewTicker(time.Duration(storeFlushInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-nf.ctx.Done():
+			return
+		case now := <-ticker.C:
+			end := now.Unix() - now.Unix()%storeFlushInterval
+			samples := nf.collectSamples(now.Unix(), end-storeFlushInterval, end)
+			if err := nf.store.Append(samples); err != nil {
+				nf.logError("failed to write samples ", err)
+			}
+		}
+	}
+}
+
+// collectSamples sum the traffic in [start, end) of processes, devices and
+// users, the idle ones are skipped.
+func (nf *Netflow) collectSamples(now, start, end int64) []Sample {
+	var (
+		samples []Sample
+		users   = make(map[string]*Sample)
+		names   []string
+	)
+
+	add := func(kind, key, name string, series *trafficSeries) *Sample {
+		sum := series.sumAt(now, start, end)
+		if sum.In == 0 && sum.Out == 0 {
+			return nil
+		}
+
+		conns := sum.NewConnsIn + sum.NewConnsOut
+		if sum.NewSockets > conns {
+			conns = sum.NewSockets
+		}
+		samples = append(samples, Sample{
+			Timestamp: start, Step: end - start, Kind: kind, Key: key, Name: name, In: sum.In, Out: sum.Out,
+			InPackets: sum.InPackets, OutPackets: sum.OutPackets, NewConns: conns,
+		})
+		return &samples[len(samples)-1]
+	}
+
+	nf.processHash.RLock()
+	for pid, po := range nf.processHash.dict {
+		sample := add(SampleProcess, pid, po.Name, po.getSeries())
+		if sample == nil {
+			continue
+		}
+
+		user := getProcessUser(po.Uid)
+		ent, ok := users[user]
+		if !ok {
+			ent = &Sample{Timestamp: start, Step: end - start, Kind: SampleUser, Key: user}
+			users[user] = ent
+			names = append(names, user)
+		}
+		ent.fold(sample)
+	}
+	nf.processHash.RUnlock()
+
+	for _, name := range names {
+		samples = append(samples, *users[name])
+	}
+
+	nf.deviceLock.Lock()
+	for name, counter := range nf.devices {
+		add(SampleDevice, name, "", counter.series)
+	}
+	nf.deviceLock.Unlock()
+
+	return samples
+}
+
+// getProcessUser return the name of uid, uid is used when it's not in /etc/passwd.
+func getProcessUser(uid int) string {
+	key := strconv.Itoa(uid)
+	if name := getUserByUID(key); name != "" {
+		return name
+	}
+	return key
+}
@@ -0,0 +1,181 @@
+package netflow
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testSample(ts int64, kind, key string, in, out int64) Sample {
+	return Sample{Timestamp: ts, Step: storeFlushInterval, Kind: kind, Key: key, In: in, Out: out}
+}
+
+func TestStoreQuery(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		hour = int64(1700000000) - int64(1700000000)%segmentDuration
+	)
+
+	store, err := OpenStore(dir, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, store.Append([]Sample{
+		testSample(hour, SampleProcess, "100", 10, 1),
+		testSample(hour, SampleDevice, "eth0", 20, 2),
+		testSample(hour+60, SampleProcess, "100", 30, 3),
+		testSample(hour+3600, SampleProcess, "100", 40, 4),
+	}))
+	assert.Nil(t, store.Close())
+
+	// samples survive reopen, the segment is appended.
+	store, err = OpenStore(dir, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, store.Append([]Sample{testSample(hour+3660, SampleProcess, "100", 50, 5)}))
+
+	segs, _ := store.segments()
+	assert.Equal(t, 2, len(segs))
+
+	samples, err := store.Query(StoreQuery{Kind: SampleProcess, Key: "100", Start: hour, End: hour + 7200})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(samples))
+	assert.EqualValues(t, 50, samples[3].In)
+
+	samples, _ = store.Query(StoreQuery{Start: hour + 60, End: hour + 3600})
+	assert.Equal(t, 1, len(samples))
+	assert.EqualValues(t, 30, samples[0].In)
+
+	_, err = store.Query(StoreQuery{Start: hour, End: hour})
+	assert.NotNil(t, err)
+
+	// the torn line of crash is skipped.
+	f, _ := os.OpenFile(segs[1].path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"ts":17000`)
+	f.Close()
+	samples, err = store.Query(StoreQuery{Start: hour + 3600, End: hour + 7200})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(samples))
+}
+
+func TestStoreCompact(t *testing.T) {
+	var (
+		store, _ = OpenStore(t.TempDir(), 0)
+		hour     = int64(1700000000) - int64(1700000000)%segmentDuration
+	)
+	defer store.Close()
+
+	assert.Nil(t, store.Append([]Sample{
+		testSample(hour, SampleUser, "root", 10, 1),
+		testSample(hour+60, SampleUser, "root", 20, 2),
+		testSample(hour+120, SampleUser, "nobody", 5, 0),
+	}))
+	assert.Nil(t, store.Compact(hour+compactAfter))
+	segs, _ := store.segments()
+	assert.False(t, segs[0].compacted)
+
+	assert.Nil(t, store.Compact(hour+segmentDuration+compactAfter))
+	segs, _ = store.segments()
+	assert.Equal(t, 1, len(segs))
+	assert.True(t, segs[0].compacted)
+
+	samples, _ := store.Query(StoreQuery{Kind: SampleUser, Key: "root", Start: hour + 1800, End: hour + 1801})
+	assert.Equal(t, []Sample{{Timestamp: hour, Step: segmentDuration, Kind: SampleUser, Key: "root", In: 30, Out: 3}}, samples)
+}
+
+func TestStoreBudget(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		hour = time.Now().Unix() - time.Now().Unix()%segmentDuration
+	)
+
+	store, _ := OpenStore(dir, 200)
+	defer store.Close()
+
+	for i := int64(3); i >= 0; i-- {
+		assert.Nil(t, store.Append([]Sample{testSample(hour-i*segmentDuration, SampleDevice, "eth0", 10, 1)}))
+	}
+
+	// about 70 bytes per segment, the oldest ones are removed.
+	segs, _ := store.segments()
+	assert.Equal(t, 2, len(segs))
+	assert.Equal(t, hour-segmentDuration, segs[0].start)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	assert.Equal(t, 0, len(files))
+}
+
+func TestStoreHTTP(t *testing.T) {
+	var (
+		store, _ = OpenStore(t.TempDir(), 0)
+		now      = time.Now().Unix()
+	)
+	defer store.Close()
+	assert.Nil(t, store.Append([]Sample{
+		testSample(now-7200, SampleProcess, "100", 10, 1),
+		testSample(now-60, SampleProcess, "100", 20, 2),
+	}))
+
+	rec := httptest.NewRecorder()
+	store.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?kind=process&key=100&since=1h", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var samples []Sample
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &samples))
+	assert.Equal(t, 1, len(samples))
+	assert.EqualValues(t, 20, samples[0].In)
+
+	rec = httptest.NewRecorder()
+	store.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?since=1x", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestCollectSamples(t *testing.T) {
+	var (
+		nf = &Netflow{
+			processHash: NewProcessController(context.Background()),
+			devices:     make(map[string]*deviceCounter),
+		}
+		now   = int64(1700000000)
+		start = now - now%60 - 60
+	)
+
+	for _, pid := range []string{"100", "101", "102"} {
+		po := &Process{Pid: pid, Name: "nginx", Uid: -1, series: newTrafficSeries(defaultRetention)}
+		nf.processHash.Add(pid, po)
+		if pid != "102" {
+			po.series.increaseAt(start+10, 100, inputSide)
+			po.series.increasePacketsAt(start+10, 2, inputSide)
+			po.series.increaseSocketsAt(start+20, 1)
+		}
+	}
+	nf.devices["eth0"] = newDeviceCounter("eth0")
+	nf.devices["eth0"].series.increaseAt(start+59, 300, outputSide)
+	nf.devices["eth0"].series.increaseAt(start+60, 1000, outputSide)
+
+	samples := nf.collectSamples(now, start, start+60)
+	count := map[string]int{}
+	for _, sample := range samples {
+		count[sample.Kind]++
+		assert.Equal(t, start, sample.Timestamp)
+		assert.Equal(t, int64(60), sample.Step)
+
+		switch sample.Kind {
+		case SampleProcess:
+			assert.Equal(t, "nginx", sample.Name)
+			assert.EqualValues(t, 100, sample.In)
+		case SampleUser:
+			assert.Equal(t, "-1", sample.Key)
+			assert.EqualValues(t, 200, sample.In)
+			assert.EqualValues(t, 4, sample.InPackets)
+			assert.EqualValues(t, 2, sample.NewConns)
+		case SampleDevice:
+			assert.EqualValues(t, 300, sample.Out)
+		}
+	}
+	assert.Equal(t, map[string]int{SampleProcess: 2, SampleUser: 1, SampleDevice: 1}, count)
+}
@@ -0,0 +1,332 @@
+package netflow
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	tcpFIN = 1 << iota
+	tcpSYN
+	tcpRST
+	tcpACK
+
+	// received segments below the highest one are out of order when they
+	// arrive within it after the highest, or within the handshake rtt when
+	// it's shorter.
+	reorderThreshold = int64(3 * time.Millisecond)
+)
+
+// tcpHeader is the fields of tcp header for health tracking.
+type tcpHeader struct {
+	seq     uint32
+	ack     uint32
+	payload uint32 // from the ip length, the captured payload may be cut by snaplen
+	window  uint16
+	flags   uint8
+}
+
+// newTCPHeader build the header from the decoded layer, size is the length of
+// tcp segment in ip header.
+func newTCPHeader(tcp *layers.TCP, size int) tcpHeader {
+	h := tcpHeader{
+		seq:    tcp.Seq,
+		ack:    tcp.Ack,
+		window: tcp.Window,
+	}
+	if payload := size - int(tcp.DataOffset)*4; payload > 0 {
+		h.payload = uint32(payload)
+	}
+	if tcp.FIN {
+		h.flags |= tcpFIN
+	}
+	if tcp.SYN {
+		h.flags |= tcpSYN
+	}
+	if tcp.RST {
+		h.flags |= tcpRST
+	}
+	if tcp.ACK {
+		h.flags |= tcpACK
+	}
+	return h
+}
+
+// seqLen return the sequence space taken by the segment, SYN and FIN take one.
+func (h *tcpHeader) seqLen() uint32 {
+	n := h.payload
+	if h.flags&tcpSYN != 0 {
+		n++
+	}
+	if h.flags&tcpFIN != 0 {
+		n++
+	}
+	return n
+}
+
+// seqAfter compare the sequences with wrap around.
+func seqAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// TCPHealth is derived from the captured tcp headers. the ratio is retransmitted
+// of data segments, 0.05 means 5%, it's the source of TCPRetransmissionRatio of
+// network tests. HandshakeRTT is the average from SYN to the ACK of handshake in
+// microseconds. counters of data segments are estimated from 1 of SampleRate
+// packets, handshakes are exact, control segments are never sampled.
+type TCPHealth struct {
+	Segments     int64   `json:"segments"`
+	Retrans      int64   `json:"retrans"`
+	RetransRatio float64 `json:"retrans_ratio"`
+	OutOfOrder   int64   `json:"out_of_order"`
+	DupAcks      int64   `json:"dup_acks"`
+	ZeroWindows  int64   `json:"zero_windows"`
+	Handshakes   int64   `json:"handshakes"`
+	HandshakeRTT int64   `json:"handshake_rtt"`
+	SampleRate   float64 `json:"sample_rate"`
+}
+
+// tcpCounters is the counters of health, it's counted into buckets by workers.
+type tcpCounters struct {
+	segments    int64
+	retrans     int64
+	outOfOrder  int64
+	dupAcks     int64
+	zeroWindows int64
+	handshakes  int64
+	rttSum      int64 // microseconds
+}
+
+func (c *tcpCounters) isZero() bool {
+	return *c == tcpCounters{}
+}
+
+func (c *tcpCounters) add(other *tcpCounters) {
+	c.segments += other.segments
+	c.retrans += other.retrans
+	c.outOfOrder += other.outOfOrder
+	c.dupAcks += other.dupAcks
+	c.zeroWindows += other.zeroWindows
+	c.handshakes += other.handshakes
+	c.rttSum += other.rttSum
+}
+
+// atomicAdd add other to the counters of bucket.
+func (c *tcpCounters) atomicAdd(other *tcpCounters) {
+	atomic.AddInt64(&c.segments, other.segments)
+	atomic.AddInt64(&c.retrans, other.retrans)
+	atomic.AddInt64(&c.outOfOrder, other.outOfOrder)
+	atomic.AddInt64(&c.dupAcks, other.dupAcks)
+	atomic.AddInt64(&c.zeroWindows, other.zeroWindows)
+	atomic.AddInt64(&c.handshakes, other.handshakes)
+	atomic.AddInt64(&c.rttSum, other.rttSum)
+}
+
+func (c *tcpCounters) atomicLoad() tcpCounters {
+	return tcpCounters{
+		segments:    atomic.LoadInt64(&c.segments),
+		retrans:     atomic.LoadInt64(&c.retrans),
+		outOfOrder:  atomic.LoadInt64(&c.outOfOrder),
+		dupAcks:     atomic.LoadInt64(&c.dupAcks),
+		zeroWindows: atomic.LoadInt64(&c.zeroWindows),
+		handshakes:  atomic.LoadInt64(&c.handshakes),
+		rttSum:      atomic.LoadInt64(&c.rttSum),
+	}
+}
+
+// atomicSwap reset the counters of bucket, the old ones are returned.
+func (c *tcpCounters) atomicSwap() tcpCounters {
+	return tcpCounters{
+		segments:    atomic.SwapInt64(&c.segments, 0),
+		retrans:     atomic.SwapInt64(&c.retrans, 0),
+		outOfOrder:  atomic.SwapInt64(&c.outOfOrder, 0),
+		dupAcks:     atomic.SwapInt64(&c.dupAcks, 0),
+		zeroWindows: atomic.SwapInt64(&c.zeroWindows, 0),
+		handshakes:  atomic.SwapInt64(&c.handshakes, 0),
+		rttSum:      atomic.SwapInt64(&c.rttSum, 0),
+	}
+}
+
+func (c *tcpCounters) health() TCPHealth {
+	h := TCPHealth{
+		Segments:    c.segments,
+		Retrans:     c.retrans,
+		OutOfOrder:  c.outOfOrder,
+		DupAcks:     c.dupAcks,
+		ZeroWindows: c.zeroWindows,
+		Handshakes:  c.handshakes,
+	}
+	if c.segments > 0 {
+		h.RetransRatio = float64(c.retrans) / float64(c.segments)
+	}
+	if c.handshakes > 0 {
+		h.HandshakeRTT = c.rttSum / c.handshakes
+	}
+	return h
+}
+
+// counters return the counters of health, the rtt sum is restored from the average.
+func (h *TCPHealth) counters() tcpCounters {
+	return tcpCounters{
+		segments:    h.Segments,
+		retrans:     h.Retrans,
+		outOfOrder:  h.OutOfOrder,
+		dupAcks:     h.DupAcks,
+		zeroWindows: h.ZeroWindows,
+		handshakes:  h.Handshakes,
+		rttSum:      h.HandshakeRTT * h.Handshakes,
+	}
+}
+
+// add fold the health of other, it's used by groups.
+func (h *TCPHealth) add(other *TCPHealth) {
+	c, o := h.counters(), other.counters()
+	c.add(&o)
+	*h = c.health()
+}
+
+// tcpDirection is the sequence state of one direction of flow.
+type tcpDirection struct {
+	started bool
+	maxEnd  uint32 // the next sequence after the highest segment
+	maxTs   int64  // capture time of the highest segment
+
+	acked   bool
+	lastAck uint32
+	lastWin uint16
+	zero    bool // the window is zero
+
+	// a keepalive was sent, the ack of it isn't a dup.
+	keepalive bool
+}
+
+// tcpFlow track the sequences of both directions, it's owned by one worker.
+type tcpFlow struct {
+	dirs [2]tcpDirection // 0 is local -> remote, 1 is remote -> local
+
+	synDir    int
+	synTs     int64
+	synAckTs  int64
+	synAckSeq uint32
+	rtt       int64 // nanoseconds, 0 before the handshake is done
+
+	total tcpCounters
+}
+
+// observe track the packet of direction, the counters of packet are returned,
+// they're scaled by the packets of meta when sampling. segments sent by local
+// sockets are never reordered before the capture, old ones are retransmitted.
+func (f *tcpFlow) observe(dir int, sender bool, meta *packetMeta) tcpCounters {
+	var (
+		res   tcpCounters
+		h     = &meta.tcp
+		d     = &f.dirs[dir]
+		other = &f.dirs[1-dir]
+		n     = meta.packets
+	)
+	if n < 1 {
+		n = 1
+	}
+
+	if h.flags&tcpRST != 0 {
+		return res
+	}
+
+	f.observeHandshake(dir, meta, &res)
+
+	// keepalive carry the sequence before the next one and 0 or 1 byte.
+	seqLen := h.seqLen()
+	keepalive := d.started && h.payload <= 1 && h.flags&(tcpSYN|tcpFIN) == 0 && h.seq == d.maxEnd-1
+	if keepalive {
+		d.keepalive = true
+		seqLen = 0
+	}
+
+	if seqLen > 0 {
+		res.segments = n
+		end := h.seq + seqLen
+		switch {
+		case !d.started:
+			d.started = true
+			d.maxEnd, d.maxTs = end, meta.ts
+
+		case seqAfter(end, d.maxEnd):
+			if seqAfter(d.maxEnd, h.seq) {
+				res.retrans = n // part of it was sent, eg: repacketized
+			}
+			d.maxEnd, d.maxTs = end, meta.ts
+
+		case !sender && meta.ts-d.maxTs < f.reorderThreshold():
+			res.outOfOrder = n
+
+		default:
+			res.retrans = n
+		}
+	}
+
+	if h.flags&tcpACK != 0 && h.flags&tcpSYN == 0 {
+		pure := seqLen == 0 && !keepalive
+		if pure && d.acked && h.ack == d.lastAck && h.window == d.lastWin && !other.keepalive {
+			res.dupAcks = n
+		}
+		other.keepalive = false
+		d.acked, d.lastAck, d.lastWin = true, h.ack, h.window
+	}
+
+	if h.flags&(tcpSYN|tcpACK) == tcpACK {
+		if h.window == 0 && !d.zero {
+			res.zeroWindows = n
+		}
+		d.zero = h.window == 0
+	}
+
+	f.total.add(&res)
+	return res
+}
+
+// observeHandshake measure the rtt from SYN to the ACK of SYN-ACK, it's the
+// round trip of network at both ends. the ACK is matched by the sequence, a
+// later segment isn't measured when the ACK is skipped by sampling.
+func (f *tcpFlow) observeHandshake(dir int, meta *packetMeta, res *tcpCounters) {
+	flags := meta.tcp.flags
+	switch {
+	case flags&(tcpSYN|tcpACK) == tcpSYN:
+		// the latest SYN is measured when it's retransmitted.
+		f.synDir, f.synTs, f.synAckTs = dir, meta.ts, 0
+
+	case flags&(tcpSYN|tcpACK) == tcpSYN|tcpACK:
+		if f.synTs != 0 && dir != f.synDir {
+			f.synAckTs, f.synAckSeq = meta.ts, meta.tcp.seq
+		}
+
+	case flags&tcpACK != 0:
+		if f.rtt != 0 || f.synAckTs == 0 || dir != f.synDir || meta.ts <= f.synTs {
+			return
+		}
+		if meta.tcp.ack != f.synAckSeq+1 || meta.tcp.payload > 0 {
+			return
+		}
+		f.rtt = meta.ts - f.synTs
+		res.handshakes = 1
+		res.rttSum = f.rtt / int64(time.Microsecond)
+	}
+}
+
+func (f *tcpFlow) reorderThreshold() int64 {
+	if f.rtt > 0 && f.rtt < reorderThreshold {
+		return f.rtt
+	}
+	return reorderThreshold
+}
+
+// GetTCPHealth return the health of tcp flows on this host in the recent seconds.
+func (nf *Netflow) GetTCPHealth(recentSeconds int) (TCPHealth, error) {
+	if err := nf.checkWindow(recentSeconds); err != nil {
+		return TCPHealth{}, err
+	}
+	health := nf.tcpSeries.analyse(recentSeconds).TCP
+	health.SampleRate = nf.sampleRate()
+	return health, nil
+}
@@ -0,0 +1,155 @@
+package netflow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testTCPMeta(side sideOption, ms float64, seq, ack, payload uint32, window uint16, flags uint8) *packetMeta {
+	key := testFlowKey("10.0.0.1", 50000, "10.0.0.2", 80)
+	if side == inputSide {
+		key = key.reverse()
+	}
+	return &packetMeta{
+		key:     key,
+		length:  int64(40 + payload),
+		side:    side,
+		packets: 1,
+		ts:      int64(1700000000*time.Second) + int64(ms*float64(time.Millisecond)),
+		tcp:     tcpHeader{seq: seq, ack: ack, payload: payload, window: window, flags: flags},
+	}
+}
+
+func TestTCPFlowHealth(t *testing.T) {
+	var (
+		ft  = newFlowTable()
+		now = int64(1700000000)
+		sum tcpCounters
+	)
+	observe := func(metas ...*packetMeta) {
+		for _, meta := range metas {
+			c := ft.increaseAt(now, meta, nil)
+			sum.add(&c)
+		}
+	}
+
+	// the handshake of outbound connection, the SYN is retransmitted.
+	observe(
+		testTCPMeta(outputSide, 0, 100, 0, 0, 1000, tcpSYN),
+		testTCPMeta(outputSide, 1000, 100, 0, 0, 1000, tcpSYN),
+		testTCPMeta(inputSide, 1020, 500, 101, 0, 1000, tcpSYN|tcpACK),
+		testTCPMeta(outputSide, 1021, 101, 501, 0, 1000, tcpACK),
+	)
+	assert.EqualValues(t, 1, sum.retrans)
+	assert.EqualValues(t, 1, sum.handshakes)
+	assert.EqualValues(t, 21000, sum.rttSum)
+
+	// sent segments below the highest are retransmitted.
+	observe(
+		testTCPMeta(outputSide, 1030, 101, 501, 1000, 1000, tcpACK),
+		testTCPMeta(outputSide, 1030.1, 1101, 501, 1000, 1000, tcpACK),
+		testTCPMeta(outputSide, 1030.2, 101, 501, 1000, 1000, tcpACK),
+	)
+	assert.EqualValues(t, 2, sum.retrans)
+	assert.EqualValues(t, 0, sum.outOfOrder)
+
+	// received segments filling the hole soon are out of order, late ones are retransmitted.
+	observe(
+		testTCPMeta(inputSide, 1040, 501, 2101, 1000, 1000, tcpACK),
+		testTCPMeta(inputSide, 1040.1, 2501, 2101, 1000, 1000, tcpACK),
+		testTCPMeta(inputSide, 1040.2, 1501, 2101, 1000, 1000, tcpACK),
+		testTCPMeta(inputSide, 1200, 1501, 2101, 1000, 1000, tcpACK),
+	)
+	assert.EqualValues(t, 1, sum.outOfOrder)
+	assert.EqualValues(t, 3, sum.retrans)
+
+	// the same pure acks are dups, window updates aren't.
+	observe(
+		testTCPMeta(outputSide, 1300, 2101, 1501, 0, 1000, tcpACK),
+		testTCPMeta(outputSide, 1301, 2101, 1501, 0, 1000, tcpACK),
+		testTCPMeta(outputSide, 1302, 2101, 1501, 0, 1000, tcpACK),
+		testTCPMeta(outputSide, 1303, 2101, 1501, 0, 2000, tcpACK),
+	)
+	assert.EqualValues(t, 2, sum.dupAcks)
+
+	// the ack of keepalive isn't a dup.
+	observe(
+		testTCPMeta(inputSide, 1400, 3500, 2101, 0, 1000, tcpACK),
+		testTCPMeta(outputSide, 1401, 2101, 3501, 0, 2000, tcpACK),
+		testTCPMeta(inputSide, 1500, 3500, 2101, 0, 1000, tcpACK),
+		testTCPMeta(outputSide, 1501, 2101, 3501, 0, 2000, tcpACK),
+	)
+	assert.EqualValues(t, 2, sum.dupAcks)
+	assert.EqualValues(t, 3, sum.retrans)
+
+	// zero windows are counted once until the window is opened.
+	observe(
+		testTCPMeta(inputSide, 1600, 3501, 2101, 0, 0, tcpACK),
+		testTCPMeta(inputSide, 1700, 3501, 2101, 0, 0, tcpACK),
+		testTCPMeta(inputSide, 1800, 3501, 2101, 0, 1000, tcpACK),
+		testTCPMeta(inputSide, 1900, 3501, 2101, 0, 0, tcpACK),
+	)
+	assert.EqualValues(t, 2, sum.zeroWindows)
+
+	flows := ft.snapshot(now, nil)
+	assert.Equal(t, 1, len(flows))
+	assert.Equal(t, sum.health(), *flows[0].TCP)
+	assert.EqualValues(t, 21000, flows[0].TCP.HandshakeRTT)
+	assert.InDelta(t, 3.0/10, flows[0].TCP.RetransRatio, 0.001)
+}
+
+func TestTCPSeqWrap(t *testing.T) {
+	f := new(tcpFlow)
+	seq := uint32(1<<32 - 500)
+	f.observe(0, true, testTCPMeta(outputSide, 0, seq, 1, 1000, 1000, tcpACK))
+	c := f.observe(0, true, testTCPMeta(outputSide, 1, seq+1000, 1, 1000, 1000, tcpACK))
+	assert.EqualValues(t, 0, c.retrans)
+	c = f.observe(0, true, testTCPMeta(outputSide, 2, seq, 1, 1000, 1000, tcpACK))
+	assert.EqualValues(t, 1, c.retrans)
+}
+
+func TestTCPHandshakeSampled(t *testing.T) {
+	f := new(tcpFlow)
+	f.observe(0, true, testTCPMeta(outputSide, 0, 100, 0, 0, 1000, tcpSYN))
+	f.observe(1, false, testTCPMeta(inputSide, 20, 500, 101, 0, 1000, tcpSYN|tcpACK))
+
+	// the ACK of handshake is skipped, the request isn't measured as the rtt.
+	c := f.observe(0, true, testTCPMeta(outputSide, 50, 101, 501, 100, 1000, tcpACK))
+	assert.EqualValues(t, 0, c.handshakes)
+	assert.EqualValues(t, 0, f.rtt)
+}
+
+func TestTCPHealthOfProcess(t *testing.T) {
+	var (
+		nf = &Netflow{
+			retention: defaultRetention,
+			tcpSeries: newTrafficSeries(defaultRetention),
+		}
+		po = &Process{Pid: "100", series: newTrafficSeries(defaultRetention)}
+	)
+
+	nf.increaseTCPHealth(po, &tcpCounters{segments: 10, retrans: 1, handshakes: 1, rttSum: 300})
+	nf.increaseTCPHealth(nil, &tcpCounters{segments: 10, handshakes: 1, rttSum: 100})
+
+	health, err := nf.GetTCPHealth(5)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 20, health.Segments)
+	assert.EqualValues(t, 0.05, health.RetransRatio)
+	assert.EqualValues(t, 200, health.HandshakeRTT)
+	assert.EqualValues(t, 1, health.SampleRate)
+
+	stats := po.getSeries().analyse(5)
+	assert.EqualValues(t, 0.1, stats.TCP.RetransRatio)
+	assert.EqualValues(t, 300, stats.copyStats().TCP.HandshakeRTT)
+
+	_, err = nf.GetTCPHealth(0)
+	assert.NotNil(t, err)
+
+	// groups fold the rtt by handshakes.
+	group := TCPHealth{Handshakes: 1, HandshakeRTT: 300, Segments: 10, Retrans: 1}
+	group.add(&TCPHealth{Handshakes: 3, HandshakeRTT: 100, Segments: 10})
+	assert.EqualValues(t, 150, group.HandshakeRTT)
+	assert.EqualValues(t, 0.05, group.RetransRatio)
+}
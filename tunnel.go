@@ -0,0 +1,341 @@
+package netflow
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	protoIPIP  = uint8(layers.IPProtocolIPv4)
+	protoIPv6  = uint8(layers.IPProtocolIPv6) // 6in4, sit
+	protoGRE   = uint8(layers.IPProtocolGRE)
+	portVXLAN  = 4789
+	portGeneve = 6081
+	portWG     = 51820
+
+	greFlagChecksum = 0x8000
+	greFlagKey      = 0x2000
+	greFlagSequence = 0x1000
+	greVersionMask  = 0x0007
+
+	// ethernet type of transparent ethernet bridging, the payload of gre and geneve.
+	ethTypeTEB = 0x6558
+)
+
+const (
+	TunnelGRE       = "gre"
+	TunnelIPIP      = "ipip"
+	TunnelVXLAN     = "vxlan"
+	TunnelGeneve    = "geneve"
+	TunnelWireGuard = "wireguard" // encrypted, only the outer bytes are counted
+)
+
+// tunnelInfo is the outer packet of the last decoded packet, kind is empty when
+// the packet isn't tunneled.
+type tunnelInfo struct {
+	kind     string
+	outer    flowKey
+	outerLen int // l3 length of the outer packet
+	vni      uint32
+	decap    bool // the inner packet is decoded into meta
+}
+
+// the outer packets of tunnels are captured with tcp by default. frames in vlan
+// tags and pppoe sessions are matched by the ethertype, the keywords vlan and
+// pppoes shift the offsets for the rest of filter, the decoder drops the frames
+// without tcp or udp inside.
+const defaultPcapFilter = "(tcp or ip proto 47 or ip proto 4 or ip proto 41 or ip6 proto 47 or ip6 proto 4" +
+	" or udp dst port 4789 or udp dst port 6081 or udp port 51820" +
+	" or ether proto 0x8100 or ether proto 0x88a8 or ether proto 0x8864) and (not broadcast and not multicast)"
+
+// ipv4Layer stop the parser at ip in ip packets, so the outer header isn't
+// overwritten by the inner one.
+type ipv4Layer struct {
+	layers.IPv4
+}
+
+func (ip *ipv4Layer) NextLayerType() gopacket.LayerType {
+	if isTunnelProto(uint8(ip.Protocol)) {
+		return gopacket.LayerTypePayload
+	}
+	return ip.IPv4.NextLayerType()
+}
+
+type ipv6Layer struct {
+	layers.IPv6
+}
+
+func (ip *ipv6Layer) NextLayerType() gopacket.LayerType {
+	if isTunnelProto(uint8(ip.NextHeader)) {
+		return gopacket.LayerTypePayload
+	}
+	return ip.IPv6.NextLayerType()
+}
+
+func isTunnelProto(proto uint8) bool {
+	switch proto {
+	case protoIPIP, protoIPv6, protoGRE:
+		return true
+	}
+	return false
+}
+
+// decodeTunnel decode the inner packet of tunnel into meta, return false when
+// it's not a tunnel or the inner packet isn't tcp or udp.
+func (d *packetDecoder) decodeTunnel(meta *packetMeta, outer flowKey, outerLen int, proto uint8, payload []byte) bool {
+	var (
+		kind  string
+		vni   uint32
+		inner *packetDecoder
+	)
+
+	switch proto {
+	case protoGRE:
+		ethType, key, offset, ok := parseGRE(payload)
+		if !ok {
+			return false
+		}
+		kind, vni, payload = TunnelGRE, key, payload[offset:]
+		inner = d.innerByEthType(ethType)
+
+	case protoIPIP:
+		kind, inner = TunnelIPIP, d.innerIP4
+
+	case protoIPv6:
+		kind, inner = TunnelIPIP, d.innerIP6
+
+	case protoUDP:
+		payload = d.udp.Payload
+		switch {
+		case outer.dstPort == portVXLAN:
+			// flags(1) reserved(3) vni(3) reserved(1)
+			if len(payload) < 8 || payload[0]&0x08 == 0 {
+				return false
+			}
+			kind, inner = TunnelVXLAN, d.innerEth
+			vni = binary.BigEndian.Uint32(payload[4:8]) >> 8
+			payload = payload[8:]
+
+		case outer.dstPort == portGeneve:
+			// ver/optlen(1) flags(1) protocol(2) vni(3) reserved(1) options
+			if len(payload) < 8 {
+				return false
+			}
+			offset := 8 + int(payload[0]&0x3f)*4
+			if len(payload) < offset {
+				return false
+			}
+			kind = TunnelGeneve
+			inner = d.innerByEthType(binary.BigEndian.Uint16(payload[2:4]))
+			vni = binary.BigEndian.Uint32(payload[4:8]) >> 8
+			payload = payload[offset:]
+
+		case outer.srcPort == portWG || outer.dstPort == portWG:
+			kind = TunnelWireGuard
+
+		default:
+			return false
+		}
+
+	default:
+		return false
+	}
+
+	d.tunnel = tunnelInfo{
+		kind:     kind,
+		outer:    outer,
+		outerLen: outerLen,
+		vni:      vni,
+	}
+	if inner == nil {
+		return false
+	}
+
+	var im packetMeta
+	if !inner.decode(payload, &im) {
+		return false
+	}
+
+	meta.key, meta.length, meta.tcp = im.key, im.length, im.tcp
+	d.tunnel.decap = true
+	return true
+}
+
+func (d *packetDecoder) innerByEthType(ethType uint16) *packetDecoder {
+	switch ethType {
+	case ethTypeTEB:
+		return d.innerEth
+	case uint16(layers.EthernetTypeIPv4):
+		return d.innerIP4
+	case uint16(layers.EthernetTypeIPv6):
+		return d.innerIP6
+	}
+	return nil
+}
+
+// parseGRE return the protocol, key and header length of gre version 0.
+func parseGRE(data []byte) (uint16, uint32, int, bool) {
+	if len(data) < 4 {
+		return 0, 0, 0, false
+	}
+
+	flags := binary.BigEndian.Uint16(data[0:2])
+	if flags&greVersionMask != 0 {
+		return 0, 0, 0, false // pptp
+	}
+
+	var (
+		ethType = binary.BigEndian.Uint16(data[2:4])
+		offset  = 4
+		key     uint32
+	)
+	if flags&greFlagChecksum != 0 {
+		offset += 4 // checksum and reserved
+	}
+	if flags&greFlagKey != 0 {
+		if len(data) < offset+4 {
+			return 0, 0, 0, false
+		}
+		key = binary.BigEndian.Uint32(data[offset : offset+4])
+		offset += 4
+	}
+	if flags&greFlagSequence != 0 {
+		offset += 4
+	}
+	if len(data) < offset {
+		return 0, 0, 0, false
+	}
+	return ethType, key, offset, true
+}
+
+// TunnelStats is the traffic of a tunnel endpoint pair, inner bytes are the
+// logical traffic carried, outer bytes are billed on the underlay.
+type TunnelStats struct {
+	Kind     string         `json:"kind"`
+	Local    string         `json:"local"`
+	Remote   string         `json:"remote"`
+	VNI      uint32         `json:"vni"` // vni of vxlan and geneve, key of gre
+	Mode     AccountingMode `json:"mode"`
+	InnerIn  int64          `json:"inner_in"`
+	InnerOut int64          `json:"inner_out"`
+	OuterIn  int64          `json:"outer_in"`
+	OuterOut int64          `json:"outer_out"`
+	Packets  int64          `json:"packets"`
+}
+
+type tunnelKey struct {
+	kind   string
+	local  ipAddr
+	remote ipAddr
+	vni    uint32
+}
+
+type tunnelCounters struct {
+	innerIn  int64
+	innerOut int64
+	outerIn  int64
+	outerOut int64
+	packets  int64
+}
+
+// tunnelTable is updated by capture goroutines of all devices.
+type tunnelTable struct {
+	sync.Mutex
+	dict map[tunnelKey]*tunnelCounters
+}
+
+func newTunnelTable() *tunnelTable {
+	return &tunnelTable{
+		dict: make(map[tunnelKey]*tunnelCounters),
+	}
+}
+
+// increase count the packet of tunnel, inner is 0 when the tunnel isn't decapsulated.
+func (tt *tunnelTable) increase(t *tunnelInfo, side sideOption, inner, outer int64) {
+	if tt == nil {
+		return
+	}
+
+	local, _ := t.outer.local(side)
+	remote, _ := t.outer.reverse().local(side)
+	key := tunnelKey{kind: t.kind, local: local, remote: remote, vni: t.vni}
+
+	tt.Lock()
+	defer tt.Unlock()
+
+	tc, ok := tt.dict[key]
+	if !ok {
+		tc = &tunnelCounters{}
+		tt.dict[key] = tc
+	}
+
+	switch side {
+	case inputSide:
+		tc.innerIn += inner
+		tc.outerIn += outer
+	case outputSide:
+		tc.innerOut += inner
+		tc.outerOut += outer
+	}
+	tc.packets++
+}
+
+func (tt *tunnelTable) snapshot(mode AccountingMode) []TunnelStats {
+	if tt == nil {
+		return nil
+	}
+
+	tt.Lock()
+	defer tt.Unlock()
+
+	res := make([]TunnelStats, 0, len(tt.dict))
+	for key, tc := range tt.dict {
+		res = append(res, TunnelStats{
+			Kind:     key.kind,
+			Local:    key.local.String(),
+			Remote:   key.remote.String(),
+			VNI:      key.vni,
+			Mode:     mode,
+			InnerIn:  tc.innerIn,
+			InnerOut: tc.innerOut,
+			OuterIn:  tc.outerIn,
+			OuterOut: tc.outerOut,
+			Packets:  tc.packets,
+		})
+	}
+	return res
+}
+
+// WithTunnelOuterBytes count the billed bytes of outer packets into processes
+// besides the bytes of inner packets, see OuterIn and OuterOut of stats.
+func WithTunnelOuterBytes(enable bool) optionFunc {
+	return func(o *Netflow) error {
+		o.tunnelOuter = enable
+		return nil
+	}
+}
+
+// tunnelLength return the counted lengths of the inner and the outer packet, the
+// link layer overhead of inner packet is the wire length without the outer headers.
+func tunnelLength(mode AccountingMode, t *tunnelInfo, innerLen int64, wireLen int) (int64, int64) {
+	outer := packetLength(mode, int64(t.outerLen), wireLen)
+	if !t.decap {
+		return 0, outer
+	}
+
+	innerWire := wireLen - (t.outerLen - int(innerLen))
+	return packetLength(mode, innerLen, innerWire), outer
+}
+
+// GetTunnelStats return the traffic of tunnel endpoints, sorted by bytes.
+func (nf *Netflow) GetTunnelStats() []TunnelStats {
+	res := nf.tunnels.snapshot(nf.accounting)
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].OuterIn+res[i].OuterOut > res[j].OuterIn+res[j].OuterOut
+	})
+	return res
+}
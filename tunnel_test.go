@@ -0,0 +1,216 @@
+package netflow
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+)
+
+// buildTunnelFrame serialize the outer layers with the encapsulated packet as payload.
+func buildTunnelFrame(t *testing.T, inner []byte, ls ...gopacket.SerializableLayer) []byte {
+	for idx, l := range ls {
+		if udp, ok := l.(*layers.UDP); ok {
+			udp.SetNetworkLayerForChecksum(ls[idx-1].(gopacket.NetworkLayer))
+		}
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	ls = append(ls, gopacket.Payload(inner))
+	err := gopacket.SerializeLayers(buf, opts, ls...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testOuterIPv4(proto layers.IPProtocol) *layers.IPv4 {
+	return &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: proto,
+		SrcIP:    net.ParseIP("192.168.0.1").To4(),
+		DstIP:    net.ParseIP("192.168.0.2").To4(),
+	}
+}
+
+func testOuterEthernet() *layers.Ethernet {
+	return &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4}
+}
+
+// inner tcp packet of 140 bytes, and the ethernet frame of 154 bytes carrying it.
+func testInnerPackets(t *testing.T) ([]byte, []byte) {
+	ip := buildTestFrame(t, 100, testIPv4(layers.IPProtocolTCP), testTCP())
+	frame := buildTestFrame(t, 100,
+		&layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4},
+		testIPv4(layers.IPProtocolTCP),
+		testTCP(),
+	)
+	return ip, frame
+}
+
+func TestDecodeTunnel(t *testing.T) {
+	ip, frame := testInnerPackets(t)
+
+	vxlan := append([]byte{0x08, 0, 0, 0, 0, 0, 0x64, 0}, frame...)
+	// one word of options
+	geneve := append([]byte{0x01, 0, 0x65, 0x58, 0, 0, 0x64, 0, 0x01, 0x02, 0x03, 0x04}, frame...)
+	greTEB := append([]byte{0x20, 0, 0x65, 0x58, 0, 0, 0, 0x64}, frame...)
+	greIP := append([]byte{0, 0, 0x08, 0}, ip...)
+
+	cases := []struct {
+		name     string
+		data     []byte
+		kind     string
+		vni      uint32
+		outerLen int
+		proto    uint8
+	}{
+		{
+			name: "vxlan",
+			data: buildTunnelFrame(t, vxlan, testOuterEthernet(), testOuterIPv4(layers.IPProtocolUDP),
+				&layers.UDP{SrcPort: 41000, DstPort: portVXLAN}),
+			kind: TunnelVXLAN, vni: 100, outerLen: 20 + 8 + len(vxlan), proto: protoUDP,
+		},
+		{
+			name: "geneve",
+			data: buildTunnelFrame(t, geneve, testOuterEthernet(), testOuterIPv4(layers.IPProtocolUDP),
+				&layers.UDP{SrcPort: 41000, DstPort: portGeneve}),
+			kind: TunnelGeneve, vni: 100, outerLen: 20 + 8 + len(geneve), proto: protoUDP,
+		},
+		{
+			name: "gre teb",
+			data: buildTunnelFrame(t, greTEB, testOuterEthernet(), testOuterIPv4(layers.IPProtocolGRE)),
+			kind: TunnelGRE, vni: 100, outerLen: 20 + len(greTEB), proto: protoGRE,
+		},
+		{
+			name: "gre ip",
+			data: buildTunnelFrame(t, greIP, testOuterEthernet(), testOuterIPv4(layers.IPProtocolGRE)),
+			kind: TunnelGRE, outerLen: 20 + len(greIP), proto: protoGRE,
+		},
+		{
+			name: "ipip",
+			data: buildTunnelFrame(t, ip, testOuterEthernet(), testOuterIPv4(layers.IPProtocolIPv4)),
+			kind: TunnelIPIP, outerLen: 20 + len(ip), proto: protoIPIP,
+		},
+	}
+
+	d := newPacketDecoder(layers.LinkTypeEthernet)
+	for _, c := range cases {
+		var meta packetMeta
+		assert.True(t, d.decode(c.data, &meta), c.name)
+		assert.Equal(t, testFlowKey("10.0.0.1", 9080, "10.0.0.2", 50000), meta.key, c.name)
+		assert.EqualValues(t, 140, meta.length, c.name)
+
+		assert.Equal(t, c.kind, d.tunnel.kind, c.name)
+		assert.Equal(t, c.vni, d.tunnel.vni, c.name)
+		assert.Equal(t, c.outerLen, d.tunnel.outerLen, c.name)
+		assert.Equal(t, c.proto, d.tunnel.outer.proto, c.name)
+		assert.Equal(t, testIPAddr("192.168.0.1"), d.tunnel.outer.srcIP, c.name)
+		assert.True(t, d.tunnel.decap, c.name)
+	}
+
+	// plain packets reset the tunnel of last packet.
+	var meta packetMeta
+	assert.True(t, d.decode(frame, &meta))
+	assert.Equal(t, "", d.tunnel.kind)
+}
+
+func TestDecodeWireGuard(t *testing.T) {
+	data := buildTunnelFrame(t, make([]byte, 148), testOuterEthernet(), testOuterIPv4(layers.IPProtocolUDP),
+		&layers.UDP{SrcPort: 41000, DstPort: portWG})
+
+	var meta packetMeta
+	d := newPacketDecoder(layers.LinkTypeEthernet)
+	assert.True(t, d.decode(data, &meta))
+	assert.Equal(t, TunnelWireGuard, d.tunnel.kind)
+	assert.False(t, d.tunnel.decap)
+	assert.Equal(t, protoUDP, meta.key.proto)
+	assert.EqualValues(t, 20+8+148, meta.length)
+}
+
+func TestParseGRE(t *testing.T) {
+	// checksum, key and sequence
+	ethType, key, offset, ok := parseGRE([]byte{0xb0, 0, 0x08, 0, 0, 0, 0, 0, 0, 0, 0, 0x07, 0, 0, 0, 0x01})
+	assert.True(t, ok)
+	assert.EqualValues(t, layers.EthernetTypeIPv4, ethType)
+	assert.EqualValues(t, 7, key)
+	assert.Equal(t, 16, offset)
+
+	// version 1 is pptp
+	_, _, _, ok = parseGRE([]byte{0x30, 0x01, 0x88, 0x0b, 0, 0, 0, 0})
+	assert.False(t, ok)
+
+	_, _, _, ok = parseGRE([]byte{0x20, 0, 0x08, 0, 0})
+	assert.False(t, ok)
+}
+
+func TestTunnelAccounting(t *testing.T) {
+	_, frame := testInnerPackets(t)
+	vxlan := append([]byte{0x08, 0, 0, 0, 0, 0, 0x64, 0}, frame...)
+	data := buildTunnelFrame(t, vxlan, testOuterEthernet(), testOuterIPv4(layers.IPProtocolUDP),
+		&layers.UDP{SrcPort: 41000, DstPort: portVXLAN})
+	outerLen := 20 + 8 + len(vxlan)
+
+	var (
+		counter = newDeviceCounter("eth0")
+		d       = newPacketDecoder(layers.LinkTypeEthernet)
+		meta    packetMeta
+		nf      = &Netflow{
+			// the inner ips are of containers, the side is decided by the outer ip.
+			bindAddrs:  parseBindAddrs(map[string]nullObject{"192.168.0.1": {}}),
+			devices:    map[string]*deviceCounter{"eth0": counter},
+			tunnels:    newTunnelTable(),
+			accounting: AccountL3,
+		}
+	)
+
+	assert.True(t, nf.handlePacket(d, data, len(data), &meta, counter))
+	assert.Equal(t, outputSide, meta.side)
+	assert.EqualValues(t, 140, meta.length)
+	assert.EqualValues(t, 0, meta.outer)
+
+	nf.tunnelOuter = true
+	assert.True(t, nf.handlePacket(d, data, len(data), &meta, counter))
+	assert.EqualValues(t, 140, meta.length)
+	assert.EqualValues(t, outerLen, meta.outer)
+
+	// the inner frame is counted without the outer headers.
+	nf.accounting = AccountL2
+	assert.True(t, nf.handlePacket(d, data, len(data), &meta, counter))
+	assert.EqualValues(t, len(frame), meta.length)
+	assert.EqualValues(t, len(data), meta.outer)
+
+	devices := nf.GetDeviceStats()
+	assert.EqualValues(t, 2*outerLen+len(data), devices[0].Out)
+
+	tunnels := nf.GetTunnelStats()
+	assert.Equal(t, 1, len(tunnels))
+	assert.Equal(t, TunnelVXLAN, tunnels[0].Kind)
+	assert.Equal(t, "192.168.0.1", tunnels[0].Local)
+	assert.Equal(t, "192.168.0.2", tunnels[0].Remote)
+	assert.EqualValues(t, 100, tunnels[0].VNI)
+	assert.EqualValues(t, 2*140+len(frame), tunnels[0].InnerOut)
+	assert.EqualValues(t, 2*outerLen+len(data), tunnels[0].OuterOut)
+	assert.EqualValues(t, 3, tunnels[0].Packets)
+}
+
+func TestProcessOuterBytes(t *testing.T) {
+	var (
+		nf   = &Netflow{}
+		proc = &Process{}
+	)
+
+	nf.increaseProcessTraffic(proc, &packetMeta{length: 140, packets: 1, outer: 190, side: outputSide})
+	nf.increaseProcessTraffic(proc, &packetMeta{length: 100, packets: 1, side: inputSide})
+	proc.analyseStats(1)
+
+	assert.EqualValues(t, 140, proc.TrafficStats.Out)
+	assert.EqualValues(t, 190, proc.TrafficStats.OuterOut)
+	assert.EqualValues(t, 100, proc.TrafficStats.In)
+	assert.EqualValues(t, 0, proc.TrafficStats.OuterIn)
+}
@@ -1,10 +1,7 @@
 package netflow
 
 import (
-	"encoding/json"
 	"fmt"
-	"sync"
-	"time"
 )
 
 const (
@@ -54,90 +51,6 @@ var StateMapping = map[string]string{
 	"0B": "CLOSING",
 }
 
-//type Mapping struct {
-//	cb   func()
-//	dict map[string]string
-//	sync.RWMutex
-//}
-
-type Mapping struct {
-	cb   func()
-	dict map[string]*entry
-	sync.RWMutex
-}
-type entry struct {
-	value     string
-	timestamp time.Time
-}
-
-func (m *Mapping) Length() int {
-	m.RLock()
-	defer m.RUnlock()
-	return len(m.dict)
-}
-func NewMapping() *Mapping {
-	size := 1000
-	return &Mapping{
-		dict: make(map[string]*entry, size),
-	}
-}
-
-func (m *Mapping) Handle() {
-}
-
-// Add 向 Mapping 中添加键值对，并记录时间戳
-func (m *Mapping) Add(key string, value string) {
-	m.Lock()
-	defer m.Unlock()
-	m.dict[key] = &entry{
-		value:     value,
-		timestamp: time.Now(),
-	}
-}
-
-// Cleanup 清理过期的条目
-func (m *Mapping) Cleanup(expiration time.Duration) {
-	m.Lock()
-	defer m.Unlock()
-	now := time.Now()
-	println("清理数据")
-	for key, e := range m.dict {
-		if now.Sub(e.timestamp) > expiration {
-			delete(m.dict, key)
-		}
-	}
-}
-func (m *Mapping) Exists(key, value string) bool {
-	m.RLock()
-	defer m.RUnlock()
-	v, exists := m.dict[key]
-	return exists && v.value == value
-}
-
-func (m *Mapping) Get(key string) (string, bool) {
-	m.RLock()
-	defer m.RUnlock()
-	ent, exists := m.dict[key]
-	if !exists {
-		return "", false
-	}
-	return ent.value, true
-}
-func (m *Mapping) Delete(k string) {
-	m.Lock()
-	defer m.Unlock()
-
-	delete(m.dict, k)
-}
-
-func (m *Mapping) String() string {
-	m.RLock()
-	defer m.RUnlock()
-
-	bs, _ := json.Marshal(m.dict)
-	return string(bs)
-}
-
 type Null struct{}
 
 type LoggerInterface interface {
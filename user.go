@@ -2,7 +2,6 @@ package netflow
 
 import (
 	"bufio"
-	"io"
 	"os"
 	"strings"
 )
@@ -26,18 +25,16 @@ func loadSystemUsersInfo() {
 	bf := bufio.NewReader(f)
 	for {
 		line, err := bf.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-		}
 
+		// name:password:uid:gid:...
 		items := strings.Split(line, ":")
-		if len(items) != 2 {
-			return
+		if len(items) > 2 {
+			systemUsers[items[2]] = items[0]
 		}
 
-		systemUsers[items[2]] = items[0]
+		if err != nil {
+			break
+		}
 	}
 }
 
@@ -0,0 +1,494 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+const (
+	defaultMonitorHistory = 60 // seconds
+	defaultMonitorSnaplen = 128
+	defaultMonitorQueue   = 10000
+)
+
+// PortRange 端口范围, 包含 Start 和 End, 单个端口 Start == End
+type PortRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+func (r PortRange) contains(port int) bool {
+	return port >= r.Start && port <= r.End
+}
+
+func (r PortRange) filter() string {
+	if r.Start == r.End {
+		return fmt.Sprintf("port %d", r.Start)
+	}
+	return fmt.Sprintf("portrange %d-%d", r.Start, r.End)
+}
+
+// ParsePortRanges 解析端口列表, eg: "80,443,8000-8100"
+func ParsePortRanges(spec string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		var (
+			start, end int
+			err        error
+		)
+
+		bounds := strings.SplitN(item, "-", 2)
+		start, err = parsePort(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		end = start
+		if len(bounds) == 2 {
+			end, err = parsePort(bounds[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if start > end {
+			return nil, fmt.Errorf("invalid port range: %s", item)
+		}
+
+		ranges = append(ranges, PortRange{Start: start, End: end})
+	}
+
+	if len(ranges) == 0 {
+		return nil, errors.New("empty ports")
+	}
+	return ranges, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port: %s", s)
+	}
+	return port, nil
+}
+
+// PortTraffic 端口的累计流量, upload 为本机发出, download 为本机收到
+type PortTraffic struct {
+	Port     int   `json:"port"`
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+// PortSample 端口每秒的流量
+type PortSample struct {
+	Timestamp int64 `json:"timestamp"`
+	Upload    int64 `json:"upload"`
+	Download  int64 `json:"download"`
+}
+
+type portStats struct {
+	upload   int64
+	download int64
+
+	// ring of per-second samples, the latest one is at history[(head-1) % len]
+	history []PortSample
+	head    int
+	count   int
+}
+
+func (ps *portStats) add(ts int64, upload, download int64) {
+	ps.upload += upload
+	ps.download += download
+
+	if ps.count > 0 {
+		last := &ps.history[(ps.head-1+len(ps.history))%len(ps.history)]
+		if last.Timestamp == ts {
+			last.Upload += upload
+			last.Download += download
+			return
+		}
+	}
+
+	ps.history[ps.head] = PortSample{Timestamp: ts, Upload: upload, Download: download}
+	ps.head = (ps.head + 1) % len(ps.history)
+	if ps.count < len(ps.history) {
+		ps.count++
+	}
+}
+
+// samples 返回最近 seconds 秒的流量, 按时间升序
+func (ps *portStats) samples(seconds int, now int64) []PortSample {
+	var (
+		res   = make([]PortSample, 0, ps.count)
+		thold = now - int64(seconds)
+	)
+	for i := ps.count; i > 0; i-- {
+		item := ps.history[(ps.head-i+len(ps.history))%len(ps.history)]
+		if item.Timestamp <= thold {
+			continue
+		}
+		res = append(res, item)
+	}
+	return res
+}
+
+type MonitorOption func(*TrafficMonitor) error
+
+// WithMonitorDevices 指定抓包的网卡, 默认选择第一个有 IP 且 UP 的网卡
+func WithMonitorDevices(devices ...string) MonitorOption {
+	return func(tm *TrafficMonitor) error {
+		if len(devices) == 0 {
+			return errors.New("invalid devices")
+		}
+		tm.devices = devices
+		return nil
+	}
+}
+
+// WithMonitorHistory 每个端口保留的秒级历史数量
+func WithMonitorHistory(seconds int) MonitorOption {
+	return func(tm *TrafficMonitor) error {
+		if seconds <= 0 {
+			return errors.New("invalid history size")
+		}
+		tm.historySize = seconds
+		return nil
+	}
+}
+
+// WithMonitorLocalIPs 指定本机地址, 用于区分上传和下载, 默认使用所有网卡的地址
+func WithMonitorLocalIPs(ips ...string) MonitorOption {
+	return func(tm *TrafficMonitor) error {
+		for _, ip := range ips {
+			tm.localIPs[ip] = struct{}{}
+		}
+		return nil
+	}
+}
+
+// TrafficMonitor 监控多个端口 (或端口范围) 在多个网卡上的上传和下载流量
+type TrafficMonitor struct {
+	devices     []string
+	ranges      []PortRange
+	historySize int
+	localIPs    map[string]struct{}
+
+	handles    []*pcap.Handle
+	packetChan chan gopacket.Packet
+
+	mu    sync.RWMutex
+	stats map[int]*portStats
+
+	// for GetUploadTraffic
+	lastUpload int64
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	readers   sync.WaitGroup
+	processor sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// NewPortMonitor 创建端口组流量监控器, ports 格式为 "80,443,8000-8100"
+func NewPortMonitor(ports string, opts ...MonitorOption) (*TrafficMonitor, error) {
+	tm, err := newPortMonitor(ports, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tm.devices) == 0 {
+		device, err := GetDefaultDevice()
+		if err != nil {
+			tm.cancel()
+			return nil, fmt.Errorf("Error selecting default device: %v", err)
+		}
+		tm.devices = []string{device}
+	}
+
+	if len(tm.localIPs) == 0 {
+		tm.localIPs = getLocalIPs()
+	}
+
+	filter := tm.bpfFilter()
+	for _, device := range tm.devices {
+		handle, err := pcap.OpenLive(device, defaultMonitorSnaplen, false, time.Second)
+		if err != nil {
+			tm.cancel()
+			tm.closeHandles()
+			return nil, fmt.Errorf("Error opening device %s: %v", device, err)
+		}
+
+		// 设置 BPF 过滤器，过滤特定端口的流量
+		err = handle.SetBPFFilter(filter)
+		if err != nil {
+			handle.Close()
+			tm.cancel()
+			tm.closeHandles()
+			return nil, fmt.Errorf("Error setting BPF filter: %v", err)
+		}
+		tm.handles = append(tm.handles, handle)
+	}
+
+	tm.start()
+	return tm, nil
+}
+
+func newPortMonitor(ports string, opts ...MonitorOption) (*TrafficMonitor, error) {
+	ranges, err := ParsePortRanges(ports)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tm := &TrafficMonitor{
+		ranges:      ranges,
+		historySize: defaultMonitorHistory,
+		localIPs:    make(map[string]struct{}),
+		packetChan:  make(chan gopacket.Packet, defaultMonitorQueue),
+		stats:       make(map[int]*portStats),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+
+	for _, opt := range opts {
+		if err := opt(tm); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+	return tm, nil
+}
+
+// NewTrafficMonitor 创建单端口的流量监控器, device 为空时选择默认网卡
+func NewTrafficMonitor(device string, port string) (*TrafficMonitor, error) {
+	if device == "" {
+		return NewPortMonitor(port)
+	}
+	return NewPortMonitor(port, WithMonitorDevices(device))
+}
+
+func (tm *TrafficMonitor) bpfFilter() string {
+	items := make([]string, 0, len(tm.ranges))
+	for _, r := range tm.ranges {
+		items = append(items, r.filter())
+	}
+	return fmt.Sprintf("tcp and (%s)", strings.Join(items, " or "))
+}
+
+func (tm *TrafficMonitor) start() {
+	for _, handle := range tm.handles {
+		tm.readers.Add(1)
+		go tm.readPackets(handle)
+	}
+
+	// packetChan is closed after all readers exit, then the processor exits.
+	go func() {
+		tm.readers.Wait()
+		close(tm.packetChan)
+	}()
+
+	tm.processor.Add(1)
+	go tm.processPackets()
+}
+
+func (tm *TrafficMonitor) readPackets(handle *pcap.Handle) {
+	defer tm.readers.Done()
+
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	packets := packetSource.Packets()
+	for {
+		select {
+		case <-tm.ctx.Done():
+			drainPackets(packets)
+			return
+
+		case packet, ok := <-packets:
+			if !ok {
+				return
+			}
+
+			select {
+			case tm.packetChan <- packet:
+			case <-tm.ctx.Done():
+				drainPackets(packets)
+				return
+			}
+		}
+	}
+}
+
+// drainPackets 丢弃剩余的数据包, 直到 handle 关闭后 packet source 退出
+func drainPackets(packets <-chan gopacket.Packet) {
+	for range packets {
+	}
+}
+
+// processPackets 处理数据包并按端口累积上传和下载流量
+func (tm *TrafficMonitor) processPackets() {
+	defer tm.processor.Done()
+
+	for packet := range tm.packetChan {
+		tm.handlePacket(packet)
+	}
+}
+
+func (tm *TrafficMonitor) handlePacket(packet gopacket.Packet) {
+	var srcIP, dstIP string
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		srcIP, dstIP = ip.SrcIP.String(), ip.DstIP.String()
+	case *layers.IPv6:
+		srcIP, dstIP = ip.SrcIP.String(), ip.DstIP.String()
+	default:
+		return
+	}
+
+	tcp, ok := packet.TransportLayer().(*layers.TCP)
+	if !ok {
+		return
+	}
+
+	var (
+		length = int64(packet.Metadata().Length)
+		ts     = packet.Metadata().Timestamp.Unix()
+	)
+	if length == 0 {
+		length = int64(len(packet.Data()))
+	}
+	if ts <= 0 {
+		ts = time.Now().Unix()
+	}
+
+	// 源地址为本机地址则为上传, 否则为下载
+	if _, ok := tm.localIPs[srcIP]; ok {
+		tm.increase(int(tcp.SrcPort), ts, length, 0)
+	}
+	if _, ok := tm.localIPs[dstIP]; ok {
+		tm.increase(int(tcp.DstPort), ts, 0, length)
+	}
+}
+
+func (tm *TrafficMonitor) increase(port int, ts int64, upload, download int64) {
+	if !tm.watching(port) {
+		return
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	ps, ok := tm.stats[port]
+	if !ok {
+		ps = &portStats{history: make([]PortSample, tm.historySize)}
+		tm.stats[port] = ps
+	}
+	ps.add(ts, upload, download)
+}
+
+func (tm *TrafficMonitor) watching(port int) bool {
+	for _, r := range tm.ranges {
+		if r.contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetTraffic 返回端口的累计流量, 读取不会重置计数
+func (tm *TrafficMonitor) GetTraffic(port int) PortTraffic {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	res := PortTraffic{Port: port}
+	if ps, ok := tm.stats[port]; ok {
+		res.Upload, res.Download = ps.upload, ps.download
+	}
+	return res
+}
+
+// GetAllTraffic 返回所有有流量端口的累计流量, 按端口升序
+func (tm *TrafficMonitor) GetAllTraffic() []PortTraffic {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	res := make([]PortTraffic, 0, len(tm.stats))
+	for port, ps := range tm.stats {
+		res = append(res, PortTraffic{Port: port, Upload: ps.upload, Download: ps.download})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Port < res[j].Port })
+	return res
+}
+
+// GetHistory 返回端口最近 seconds 秒的每秒流量
+func (tm *TrafficMonitor) GetHistory(port int, seconds int) []PortSample {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	ps, ok := tm.stats[port]
+	if !ok {
+		return nil
+	}
+	return ps.samples(seconds, time.Now().Unix())
+}
+
+// GetUploadTraffic 返回从上次调用以来所有端口的上传流量（字节）, 累计计数不会被重置
+func (tm *TrafficMonitor) GetUploadTraffic() int64 {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	var total int64
+	for _, ps := range tm.stats {
+		total += ps.upload
+	}
+
+	delta := total - tm.lastUpload
+	tm.lastUpload = total
+	return delta
+}
+
+// Close 关闭监控器, 等待所有协程退出
+func (tm *TrafficMonitor) Close() {
+	tm.closeOnce.Do(func() {
+		tm.cancel()
+		tm.closeHandles()
+		tm.readers.Wait()
+		tm.processor.Wait()
+	})
+}
+
+func (tm *TrafficMonitor) closeHandles() {
+	for _, handle := range tm.handles {
+		handle.Close()
+	}
+	tm.handles = nil
+}
+
+func getLocalIPs() map[string]struct{} {
+	ips := make(map[string]struct{})
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ips
+	}
+
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ips[ipnet.IP.String()] = struct{}{}
+	}
+	return ips
+}
@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePortRanges(t *testing.T) {
+	ranges, err := ParsePortRanges("80, 443,8000-8100")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []PortRange{{80, 80}, {443, 443}, {8000, 8100}}, ranges)
+
+	for _, spec := range []string{"", "0", "70000", "90-80", "a-b", "80-"} {
+		_, err = ParsePortRanges(spec)
+		assert.NotEqual(t, nil, err, spec)
+	}
+}
+
+func buildTestPacket(t *testing.T, src, dst string, sport, dport int, payload int) gopacket.Packet {
+	var (
+		eth = &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+			EthernetType: layers.EthernetTypeIPv4,
+		}
+		ip = &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolTCP,
+			SrcIP:    net.ParseIP(src),
+			DstIP:    net.ParseIP(dst),
+		}
+		tcp = &layers.TCP{
+			SrcPort: layers.TCPPort(sport),
+			DstPort: layers.TCPPort(dport),
+		}
+		buf = gopacket.NewSerializeBuffer()
+	)
+
+	tcp.SetNetworkLayerForChecksum(ip)
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		eth, ip, tcp, gopacket.Payload(make([]byte, payload)))
+	assert.Equal(t, nil, err)
+
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+	packet.Metadata().Length = len(buf.Bytes())
+	packet.Metadata().Timestamp = time.Now()
+	return packet
+}
+
+func TestTrafficMonitorHandlePacket(t *testing.T) {
+	tm, err := newPortMonitor("9080,8000-8001", WithMonitorLocalIPs("10.0.0.1"), WithMonitorHistory(5))
+	assert.Equal(t, nil, err)
+
+	// upload from local 9080, download to local 8001, 443 is not watched.
+	tm.handlePacket(buildTestPacket(t, "10.0.0.1", "10.0.0.2", 9080, 50000, 946))
+	tm.handlePacket(buildTestPacket(t, "10.0.0.2", "10.0.0.1", 50001, 8001, 46))
+	tm.handlePacket(buildTestPacket(t, "10.0.0.1", "10.0.0.2", 443, 50002, 100))
+
+	assert.Equal(t, PortTraffic{Port: 9080, Upload: 1000}, tm.GetTraffic(9080))
+	assert.Equal(t, PortTraffic{Port: 8001, Download: 100}, tm.GetTraffic(8001))
+	assert.Equal(t, 2, len(tm.GetAllTraffic()))
+
+	// reading doesn't reset counters.
+	assert.EqualValues(t, 1000, tm.GetUploadTraffic())
+	assert.EqualValues(t, 0, tm.GetUploadTraffic())
+	assert.Equal(t, PortTraffic{Port: 9080, Upload: 1000}, tm.GetTraffic(9080))
+
+	history := tm.GetHistory(9080, 5)
+	assert.Equal(t, 1, len(history))
+	assert.EqualValues(t, 1000, history[0].Upload)
+
+	tm.start()
+	tm.Close()
+	tm.Close()
+}
+
+func TestPortStatsHistory(t *testing.T) {
+	ps := &portStats{history: make([]PortSample, 3)}
+	for ts := int64(1); ts <= 5; ts++ {
+		ps.add(ts, ts, 0)
+		ps.add(ts, ts, 0)
+	}
+
+	assert.EqualValues(t, 30, ps.upload)
+	samples := ps.samples(10, 5)
+	assert.Equal(t, []PortSample{{3, 6, 0}, {4, 8, 0}, {5, 10, 0}}, samples)
+	assert.Equal(t, 2, len(ps.samples(2, 5)))
+}
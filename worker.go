@@ -0,0 +1,159 @@
+package netflow
+
+import (
+	"sync/atomic"
+)
+
+const (
+	minWorkerQueueSize = 1000
+)
+
+// WorkerStats is the counters of a packet worker, Dropped and HighWater show
+// whether the worker can't keep up with the capture.
+type WorkerStats struct {
+	ID        int   `json:"id"`
+	QueueLen  int   `json:"queue_len"`
+	QueueCap  int   `json:"queue_cap"`
+	Enqueued  int64 `json:"enqueued"`
+	Dropped   int64 `json:"dropped"`
+	Processed int64 `json:"processed"`
+	HighWater int64 `json:"high_water"` // max queue length seen
+
+	// packets skipped by adaptive sampling, and the factor of estimated bytes.
+	Sampled    int64   `json:"sampled"`
+	SampleRate float64 `json:"sample_rate"`
+}
+
+// packetWorker consume the packets of flows hashed to it, so packets of the
+// same connection are always handled in order by one goroutine.
+type packetWorker struct {
+	id    int
+	queue chan packetMeta
+
+	// owned by the worker goroutine
+	cache *flowCache
+	flows *flowTable
+
+	// nil when adaptive sampling is disabled
+	sampler *adaptiveSampler
+
+	// atomic counters
+	enqueued  int64
+	dropped   int64
+	processed int64
+	highWater int64
+	sampled   int64
+}
+
+func newPacketWorker(id int, size int, adaptiveMax int) *packetWorker {
+	w := &packetWorker{
+		id:    id,
+		queue: make(chan packetMeta, size),
+		cache: newFlowCache(),
+		flows: newFlowTable(),
+	}
+	if adaptiveMax > 1 {
+		w.sampler = newAdaptiveSampler(adaptiveMax)
+	}
+	return w
+}
+
+// newPacketWorkers split the queue size to workers.
+func newPacketWorkers(num int, qsize int, adaptiveMax int) []*packetWorker {
+	size := qsize / num
+	if size < minWorkerQueueSize {
+		size = minWorkerQueueSize
+	}
+
+	workers := make([]*packetWorker, 0, num)
+	for i := 0; i < num; i++ {
+		workers = append(workers, newPacketWorker(i, size, adaptiveMax))
+	}
+	return workers
+}
+
+// sample return false when the packet is skipped by adaptive sampling.
+func (w *packetWorker) sample(meta *packetMeta) bool {
+	if w.sampler == nil {
+		return true
+	}
+
+	if !w.sampler.sample(meta, len(w.queue), cap(w.queue)) {
+		atomic.AddInt64(&w.sampled, 1)
+		return false
+	}
+	return true
+}
+
+// push never blocks the capture, the packet is dropped when the queue is full.
+func (w *packetWorker) push(meta packetMeta) bool {
+	select {
+	case w.queue <- meta:
+	default:
+		atomic.AddInt64(&w.dropped, 1)
+		return false
+	}
+
+	atomic.AddInt64(&w.enqueued, 1)
+
+	qlen := int64(len(w.queue))
+	for {
+		hw := atomic.LoadInt64(&w.highWater)
+		if qlen <= hw || atomic.CompareAndSwapInt64(&w.highWater, hw, qlen) {
+			break
+		}
+	}
+	return true
+}
+
+func (w *packetWorker) stats() WorkerStats {
+	var rate int64 = 1
+	if w.sampler != nil {
+		rate = w.sampler.getRate()
+	}
+
+	return WorkerStats{
+		ID:        w.id,
+		QueueLen:  len(w.queue),
+		QueueCap:  cap(w.queue),
+		Enqueued:  atomic.LoadInt64(&w.enqueued),
+		Dropped:   atomic.LoadInt64(&w.dropped),
+		Processed: atomic.LoadInt64(&w.processed),
+		HighWater: atomic.LoadInt64(&w.highWater),
+		Sampled:   atomic.LoadInt64(&w.sampled),
+		// scaled by the static sampling in GetWorkerStats
+		SampleRate: float64(rate),
+	}
+}
+
+// pickWorker select the worker by the symmetric hash of flow.
+func pickWorker(workers []*packetWorker, key flowKey) *packetWorker {
+	return workers[key.hash()%uint32(len(workers))]
+}
+
+// flowCache is owned by one worker, so flows are mapped to processes without lock,
+// it's reset when processes are rescanned.
+type flowCache struct {
+	revision int64
+	dict     map[flowKey]*Process
+}
+
+func newFlowCache() *flowCache {
+	return &flowCache{
+		dict: make(map[flowKey]*Process, 1000),
+	}
+}
+
+func (c *flowCache) get(key flowKey, revision int64) *Process {
+	if c.revision != revision {
+		for k := range c.dict {
+			delete(c.dict, k)
+		}
+		c.revision = revision
+	}
+	return c.dict[key]
+}
+
+func (c *flowCache) add(key flowKey, po *Process) {
+	c.dict[key] = po
+}
@@ -0,0 +1,45 @@
+package netflow
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlowHashSymmetric(t *testing.T) {
+	key := testFlowKey("10.0.0.1", 9080, "10.0.0.2", 50000)
+	assert.Equal(t, key.hash(), key.reverse().hash())
+	assert.NotEqual(t, key.hash(), testFlowKey("10.0.0.1", 9080, "10.0.0.2", 50001).hash())
+
+	// flows are spread to workers.
+	workers := newPacketWorkers(4, 4000, 0)
+	seen := map[int]bool{}
+	for port := uint16(50000); port < 50100; port++ {
+		key := testFlowKey("10.0.0.1", 9080, "10.0.0.2", port)
+		w := pickWorker(workers, key)
+		assert.Equal(t, w, pickWorker(workers, key.reverse()))
+		seen[w.id] = true
+	}
+	assert.Equal(t, 4, len(seen))
+}
+
+func TestWorkerBackpressure(t *testing.T) {
+	workers := newPacketWorkers(2, 10, 0)
+	assert.Equal(t, minWorkerQueueSize, cap(workers[0].queue))
+
+	w := workers[0]
+	meta := packetMeta{key: testFlowKey("10.0.0.1", 9080, "10.0.0.2", 50000), length: 100}
+	for i := 0; i < minWorkerQueueSize+10; i++ {
+		w.push(meta)
+	}
+
+	stats := w.stats()
+	assert.EqualValues(t, minWorkerQueueSize, stats.Enqueued)
+	assert.EqualValues(t, 10, stats.Dropped)
+	assert.EqualValues(t, minWorkerQueueSize, stats.HighWater)
+	assert.Equal(t, minWorkerQueueSize, stats.QueueLen)
+
+	<-w.queue
+	assert.Equal(t, minWorkerQueueSize-1, w.stats().QueueLen)
+	assert.EqualValues(t, minWorkerQueueSize, w.stats().HighWater)
+}